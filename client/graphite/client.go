@@ -16,11 +16,13 @@ package graphite
 
 import (
 	"net"
+	"net/http"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -28,64 +30,170 @@ import (
 	graphiteCfg "github.com/criteo/graphite-remote-adapter/client/graphite/config"
 	"github.com/criteo/graphite-remote-adapter/client/graphite/paths"
 	"github.com/criteo/graphite-remote-adapter/config"
+
+	"golang.org/x/net/context"
 )
 
-const (
-	expandEndpoint  = "/metrics/expand"
-	renderEndpoint  = "/render/"
-	maxFetchWorkers = 10
+var pathsCacheEnabled = promauto.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "remote_adapter_graphite",
+		Name:      "paths_cache_enabled",
+		Help:      "Whether the paths cache is enabled (1) or not (0).",
+	},
 )
 
 // Client allows sending batches of Prometheus samples to Graphite.
 type Client struct {
-	lock           sync.RWMutex
-	cfg            *graphiteCfg.Config
-	writeTimeout   time.Duration
-	readTimeout    time.Duration
-	readDelay      time.Duration
-	ignoredSamples prometheus.Counter
-	format         paths.Format
+	lock         sync.RWMutex
+	cfg          *graphiteCfg.Config
+	writeTimeout time.Duration
+	readTimeout  time.Duration
+	readDelay    time.Duration
+	// sourceLabel, if set, labels read series with the URL of their
+	// graphite-web backend.
+	sourceLabel string
+	// maxFetchWorkers bounds the concurrent requests to graphite-web.
+	maxFetchWorkers int
+	ignoredSamples  prometheus.Counter
+	format          paths.Format
+	defaultPrefix   paths.Prefix
+	deadLetters     *deadLetterWriter
+	heartbeatStop   chan struct{}
+	heartbeatDone   chan struct{}
+	shutdownOnce    sync.Once
+	writeHealth     *writeHealth
 
 	carbonCon               net.Conn
 	carbonLastReconnectTime time.Time
+	carbonLastWriteTime     time.Time
+	carbonIdleTimer         *time.Timer
+	carbonRoutes            map[string]*carbonConn
 	carbonConLock           sync.Mutex
+	// carbonPool, if set, holds the connections to the carbon address so
+	// that concurrent writes don't wait for each other.
+	carbonPool *carbonPool
+	// rateLimiter, if set, bounds the datapoints written per second.
+	rateLimiter *rateLimiter
+	// carbonLinesPerBatch and carbonBytes describe the batches written to
+	// carbon.
+	carbonLinesPerBatch *prometheus.HistogramVec
+	carbonBytes         *prometheus.CounterVec
+
+	// httpClient sends the requests to graphite-web, unless it couldn't be
+	// configured because of httpClientErr.
+	httpClient    *http.Client
+	httpClientErr error
+
+	// mergedTemplateData is the template data merged with the template data
+	// file, replaced every time the file is refreshed.
+	mergedTemplateData map[string]interface{}
+	templateDataLock   sync.RWMutex
+	templateDataStop   chan struct{}
+	templateDataDone   chan struct{}
+
+	clockSkewStop context.CancelFunc
+	clockSkewDone chan struct{}
+
+	readLogger  log.Logger
+	writeLogger log.Logger
+}
 
-	logger log.Logger
+// registerCollector registers collector with the default registerer, or
+// returns the collector already registered by a previous client.
+func registerCollector(collector prometheus.Collector) prometheus.Collector {
+	if err := prometheus.Register(collector); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+		panic(err)
+	}
+	return collector
 }
 
-// NewClient returns a new Client.
-func NewClient(cfg *config.Config, logger log.Logger) *Client {
-	if cfg.Graphite.Write.CarbonAddress == "" && cfg.Graphite.Read.URL == "" {
+// NewClient returns a new Client. baseLogger must not be filtered, the
+// graphite, graphite_read and graphite_write components log at their level.
+func NewClient(cfg *config.Config, baseLogger log.Logger) *Client {
+	logger := cfg.Logger(baseLogger, "graphite")
+	writeLogger := cfg.Logger(baseLogger, "graphite_write")
+	if cfg.Graphite.Write.CarbonAddress == "" && len(cfg.Graphite.Read.URL) == 0 {
 		return nil
 	}
 	if cfg.Graphite.Write.EnablePathsCache {
 		paths.InitPathsCache(cfg.Graphite.Write.PathsCacheTTL,
 			cfg.Graphite.Write.PathsCachePurgeInterval)
+		pathsCacheEnabled.Set(1)
 		level.Debug(logger).Log(
 			"PathsCacheTTL", cfg.Graphite.Write.PathsCacheTTL,
 			"PathsCachePurgeInterval", cfg.Graphite.Write.PathsCachePurgeInterval,
 			"msg", "Paths cache initialized")
+	} else {
+		paths.DisablePathsCache()
+		pathsCacheEnabled.Set(0)
+		if cfg.Graphite.Write.CarbonAddress != "" {
+			level.Warn(logger).Log(
+				"msg", "Paths cache disabled, paths will be rendered for every written sample")
+		}
 	}
 
+	paths.SetTemplateTimeout(cfg.Graphite.Write.TemplateTimeout)
+	setMaxConcurrentDials(cfg.Graphite.Write.MaxConcurrentDials)
+
 	// Which format are we using to write points?
-	format := paths.Format{Type: paths.FormatCarbon}
+	formatType := paths.FormatCarbon
 	if cfg.Graphite.EnableTags || cfg.Graphite.FilteredTags != "" {
 		if cfg.Graphite.UseOpenMetricsFormat {
-			format = paths.Format{Type: paths.FormatCarbonOpenMetrics}
+			formatType = paths.FormatCarbonOpenMetrics
 		} else {
-			format = paths.Format{Type: paths.FormatCarbonTags}
+			formatType = paths.FormatCarbonTags
+		}
+	}
+	format := newFormat(formatType, &cfg.Graphite)
+
+	defaultPrefix, err := paths.ParsePrefix(cfg.Graphite.DefaultPrefix)
+	if err != nil {
+		level.Error(logger).Log(
+			"prefix", cfg.Graphite.DefaultPrefix,
+			"err", err, "msg", "Error parsing the default prefix, no graphite client is built")
+		return nil
+	}
+	if defaultPrefix.Templated() && len(cfg.Graphite.Read.URL) > 0 {
+		level.Error(logger).Log(
+			"prefix", cfg.Graphite.DefaultPrefix,
+			"msg", "Templated default prefix can't be read, no graphite client is built")
+		return nil
+	}
+
+	var deadLetters *deadLetterWriter
+	if cfg.Graphite.Write.DeadLetterFile != "" {
+		var err error
+		deadLetters, err = newDeadLetterWriter(cfg.Graphite.Write.DeadLetterFile, writeLogger)
+		if err != nil {
+			level.Error(logger).Log(
+				"file", cfg.Graphite.Write.DeadLetterFile,
+				"err", err, "msg", "Error opening dead-letter file, dropped samples won't be recorded")
 		}
+	}
 
-		format.FilteredTags = strings.Split(cfg.Graphite.FilteredTags, ",")
+	// Reads fail rather than being sent without the configured credentials.
+	httpClient, httpClientErr := newHTTPClient(&cfg.Graphite.Read)
+	if httpClientErr != nil {
+		level.Error(logger).Log(
+			"err", httpClientErr, "msg", "Error configuring the graphite-web client, reads will fail")
 	}
 
-	return &Client{
-		logger:       logger,
-		cfg:          &cfg.Graphite,
-		writeTimeout: cfg.Write.Timeout,
-		format:       format,
-		readTimeout:  cfg.Read.Timeout,
-		readDelay:    cfg.Read.Delay,
+	c := &Client{
+		readLogger:      cfg.Logger(baseLogger, "graphite_read"),
+		writeLogger:     writeLogger,
+		cfg:             &cfg.Graphite,
+		writeTimeout:    cfg.Write.Timeout,
+		format:          format,
+		defaultPrefix:   defaultPrefix,
+		readTimeout:     cfg.Read.Timeout,
+		readDelay:       cfg.Read.Delay,
+		sourceLabel:     cfg.Read.SourceLabel,
+		maxFetchWorkers: cfg.Graphite.Read.MaxFetchWorkers,
+		httpClient:      httpClient,
+		httpClientErr:   httpClientErr,
 		ignoredSamples: prometheus.NewCounter(
 			prometheus.CounterOpts{
 				Namespace: "remote_adapter_graphite",
@@ -93,17 +201,132 @@ func NewClient(cfg *config.Config, logger log.Logger) *Client {
 				Help:      "The total number of samples not sent to Graphite due to unsupported float values (Inf, -Inf, NaN).",
 			},
 		),
+		deadLetters:             deadLetters,
 		carbonCon:               nil,
 		carbonLastReconnectTime: time.Time{},
 		carbonConLock:           sync.Mutex{},
+		carbonLinesPerBatch: registerCollector(prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "remote_adapter_graphite",
+				Name:      "carbon_lines_per_batch",
+				Help:      "The number of lines of the batches written to carbon, at most one UDP datagram each over UDP, per carbon address.",
+				Buckets:   prometheus.ExponentialBuckets(1, 4, 9),
+			},
+			[]string{"destination"},
+		)).(*prometheus.HistogramVec),
+		carbonBytes: registerCollector(prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "remote_adapter_graphite",
+				Name:      "carbon_bytes_total",
+				Help:      "The total number of bytes of the batches written to carbon, per carbon address.",
+			},
+			[]string{"destination"},
+		)).(*prometheus.CounterVec),
 	}
+	if cfg.Graphite.Write.CarbonConnectionPoolSize > 1 && cfg.Graphite.Write.CarbonTransport == "tcp" {
+		// Datagrams are sent independently of each other, UDP doesn't need a pool.
+		c.carbonPool = newCarbonPool(cfg.Graphite.Write.CarbonConnectionPoolSize)
+	}
+	if cfg.Graphite.Write.MaxSamplesPerSecond > 0 {
+		c.rateLimiter = newRateLimiter(float64(cfg.Graphite.Write.MaxSamplesPerSecond), time.Now())
+	}
+	if cfg.Graphite.Write.UnhealthyThreshold > 0 {
+		c.writeHealth = newWriteHealth(cfg.Graphite.Write.UnhealthyWindow)
+	}
+	if cfg.Graphite.Write.TemplateDataFile != "" {
+		if err := c.loadTemplateData(); err != nil {
+			level.Error(logger).Log(
+				"file", cfg.Graphite.Write.TemplateDataFile,
+				"err", err, "msg", "Error reading template data file, only template_data is used")
+		}
+		if cfg.Graphite.Write.TemplateDataRefresh > 0 {
+			c.startTemplateDataRefresh(cfg.Graphite.Write.TemplateDataRefresh)
+		}
+	}
+	if cfg.Graphite.Write.CarbonAddress != "" && cfg.Graphite.Write.HeartbeatInterval > 0 {
+		c.startHeartbeat(cfg.Graphite.Write.HeartbeatInterval)
+	}
+	if len(cfg.Graphite.Read.URL) > 0 && cfg.Graphite.Read.ClockSkewProbeTarget != "" {
+		c.startClockSkewProbe(cfg.Graphite.Read.ClockSkewProbeInterval)
+	}
+	return c
 }
 
-// Shutdown the client.
+// newFormat returns the format of the given type configured from cfg.
+func newFormat(formatType paths.FormatType, cfg *graphiteCfg.Config) paths.Format {
+	format := paths.Format{
+		Type:             formatType,
+		NameDelimiter:    cfg.Write.NameSplit.Delimiter,
+		NameReplacement:  cfg.Write.NameSplit.Replacement,
+		SchemaVersion:    cfg.Write.SchemaVersion,
+		LeadingLabels:    cfg.Write.LeadingLabels,
+		Separator:        cfg.Separator,
+		AggregationLabel: cfg.Write.AggregationFromLabel,
+		ClampFutureToNow: cfg.Write.ClampFutureToNow,
+		PrefixSeparator:  cfg.NormalizePrefix,
+	}
+	if cfg.Write.LineTerminator == graphiteCfg.LineTerminatorCRLF {
+		format.LineTerminator = "\r\n"
+	}
+	if formatType != paths.FormatCarbon {
+		if cfg.FilteredTags != "" {
+			format.FilteredTags = strings.Split(cfg.FilteredTags, ",")
+		}
+		format.SanitizeTagKeys = cfg.Write.SanitizeTagKeys
+		format.NameLabelTag = cfg.NameLabelTag
+		format.GraphiteTagEscaping = cfg.Write.TagEscaping == graphiteCfg.TagEscapingTag
+		format.AggregationTag = cfg.Write.AggregationTag
+	}
+	return format
+}
+
+// Shutdown the client. The same client may be shut down both as a writer
+// and a reader, only the first call has an effect.
 func (c *Client) Shutdown() {
-	c.carbonConLock.Lock()
-	defer c.carbonConLock.Unlock()
-	c.disconnectFromCarbon()
+	c.shutdownOnce.Do(func() {
+		// Stop the heartbeat first, it would reconnect to carbon otherwise.
+		c.stopHeartbeat()
+		c.stopTemplateDataRefresh()
+		c.stopClockSkewProbe()
+
+		c.carbonConLock.Lock()
+		defer c.carbonConLock.Unlock()
+		if c.carbonIdleTimer != nil {
+			c.carbonIdleTimer.Stop()
+		}
+		c.disconnectFromCarbon()
+		c.disconnectFromRoutes()
+		if c.carbonPool != nil {
+			c.carbonPool.close()
+		}
+		c.deadLetters.Close()
+	})
+}
+
+// ApplyReadConfig implements the client.ReadReloader interface. Only the read
+// options are replaced, the connections to carbon are kept.
+func (c *Client) ApplyReadConfig(cfg *config.Config) {
+	// The probe reads the read options and uses the graphite-web client, it
+	// is stopped before they are replaced.
+	c.stopClockSkewProbe()
+	httpClient, err := newHTTPClient(&cfg.Graphite.Read)
+	if err != nil {
+		level.Error(c.readLogger).Log(
+			"err", err, "msg", "Error configuring the graphite-web client, keeping the previous one")
+	} else {
+		if c.httpClient != nil {
+			c.httpClient.CloseIdleConnections()
+		}
+		c.httpClient, c.httpClientErr = httpClient, nil
+	}
+	c.cfg.Read = cfg.Graphite.Read
+	c.readTimeout = cfg.Read.Timeout
+	c.readDelay = cfg.Read.Delay
+	c.sourceLabel = cfg.Read.SourceLabel
+	c.maxFetchWorkers = cfg.Graphite.Read.MaxFetchWorkers
+	if len(c.cfg.Read.URL) > 0 && c.cfg.Read.ClockSkewProbeTarget != "" {
+		c.startClockSkewProbe(c.cfg.Read.ClockSkewProbeInterval)
+	}
 }
 
 // Name implements the client.Client interface.
@@ -113,6 +336,9 @@ func (c *Client) Name() string {
 
 // Target respond with a more low level representation of the client's remote
 func (c *Client) Target() string {
+	if c.carbonPool != nil {
+		return c.cfg.Write.CarbonAddress
+	}
 	if c.carbonCon == nil {
 		return "unknown"
 	}
@@ -19,19 +19,25 @@ import (
 	"testing"
 
 	"github.com/criteo/graphite-remote-adapter/client/graphite/config"
+	"github.com/criteo/graphite-remote-adapter/client/graphite/paths"
+	rootConfig "github.com/criteo/graphite-remote-adapter/config"
 	"github.com/go-kit/kit/log"
 )
 
 var (
 	testClient = &Client{
-		logger: log.NewNopLogger(),
+		readLogger:  log.NewNopLogger(),
+		writeLogger: log.NewNopLogger(),
 		cfg: &config.Config{
 			DefaultPrefix: "prometheus-prefix.",
 			Write:         config.WriteConfig{},
 			Read: config.ReadConfig{
-				URL: "http://fakeHost:6666",
+				URL:        config.URLList{"http://fakeHost:6666"},
+				RenderPath: "/render/",
+				ExpandPath: "/metrics/expand",
 			},
 		},
+		defaultPrefix: paths.LiteralPrefix("prometheus-prefix."),
 	}
 )
 
@@ -54,3 +60,64 @@ func TestGetCustomGraphitePrefix(t *testing.T) {
 		t.Errorf("Expected %s, got %s", expectedPrefix, actualPrefix)
 	}
 }
+
+func TestGetForwardedParams(t *testing.T) {
+	fakeRequest, _ := http.NewRequest("POST", "http://fakeHost:6666?cacheTimeout=60&noNullPoints=true&foo=bar", nil)
+	cfg := &config.Config{
+		Read: config.ReadConfig{
+			ForwardParams: []string{"cacheTimeout", "noNullPoints", "maxDataPoints"},
+		},
+	}
+	expectedParams := map[string]string{"cacheTimeout": "60", "noNullPoints": "true"}
+
+	actualParams := cfg.ForwardedParamsFromRequest(fakeRequest)
+	if !reflect.DeepEqual(expectedParams, actualParams) {
+		t.Errorf("Expected %s, got %s", expectedParams, actualParams)
+	}
+}
+
+func TestGetForwardedTemplateParams(t *testing.T) {
+	fakeRequest, _ := http.NewRequest("POST", "http://fakeHost:6666?template%5Bdc%5D=par&template%5Bhost%5D=web1&template=foo", nil)
+	cfg := &config.Config{
+		Read: config.ReadConfig{
+			ForwardTemplates: []string{"dc", "env"},
+		},
+	}
+	expectedParams := map[string]string{"template[dc]": "par"}
+
+	actualParams := cfg.ForwardedParamsFromRequest(fakeRequest)
+	if !reflect.DeepEqual(expectedParams, actualParams) {
+		t.Errorf("Expected %s, got %s", expectedParams, actualParams)
+	}
+}
+
+func TestNewClientsShareCarbonBatchMetrics(t *testing.T) {
+	cfg := rootConfig.DefaultConfig
+	cfg.Graphite.Write.CarbonAddress = "localhost:2003"
+
+	first := NewClient(&cfg, log.NewNopLogger())
+	defer first.Shutdown()
+	second := NewClient(&cfg, log.NewNopLogger())
+	defer second.Shutdown()
+	if first.carbonBytes != second.carbonBytes || first.carbonLinesPerBatch != second.carbonLinesPerBatch {
+		t.Errorf("Expected clients to share the metrics already registered")
+	}
+}
+
+func TestNewClientRejectsTemplatedPrefixWithReads(t *testing.T) {
+	cfg := rootConfig.DefaultConfig
+	cfg.Graphite.DefaultPrefix = "{{.labels.tenant}}."
+	cfg.Graphite.Write.CarbonAddress = "localhost:2003"
+
+	c := NewClient(&cfg, log.NewNopLogger())
+	if c == nil {
+		t.Fatalf("Expected a client writing with a templated prefix")
+	}
+	c.Shutdown()
+
+	cfg.Graphite.Read.URL = []string{"http://localhost:8080"}
+	if c := NewClient(&cfg, log.NewNopLogger()); c != nil {
+		c.Shutdown()
+		t.Errorf("Expected no client reading with a templated prefix")
+	}
+}
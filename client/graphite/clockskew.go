@@ -0,0 +1,137 @@
+// Copyright 2017 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	graphiteCfg "github.com/criteo/graphite-remote-adapter/client/graphite/config"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"golang.org/x/net/context"
+)
+
+// clockSkewProbeWindow is how far back the latest datapoint of the probe
+// target is looked for.
+const clockSkewProbeWindow = 10 * time.Minute
+
+var clockSkew = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "remote_adapter_graphite",
+		Name:      "clock_skew_seconds",
+		Help:      "The local time minus the timestamp of the latest datapoint of graphite.read.clock_skew_probe_target, per graphite-web backend.",
+	},
+	[]string{"graphite_web"},
+)
+
+// startClockSkewProbe periodically renders the probe target from each
+// graphite-web backend until stopClockSkewProbe is called, which also
+// cancels an ongoing render.
+func (c *Client) startClockSkewProbe(interval time.Duration) {
+	probeCtx, stop := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	c.clockSkewStop, c.clockSkewDone = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-probeCtx.Done():
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(probeCtx, interval)
+				c.probeClockSkews(ctx)
+				cancel()
+			}
+		}
+	}()
+}
+
+// stopClockSkewProbe stops the probe, if started, and waits for it to
+// return. The probe can be started again afterwards.
+func (c *Client) stopClockSkewProbe() {
+	if c.clockSkewStop == nil {
+		return
+	}
+	c.clockSkewStop()
+	<-c.clockSkewDone
+	c.clockSkewStop, c.clockSkewDone = nil, nil
+}
+
+// probeClockSkews sets the clock skew of each graphite-web backend, probed
+// concurrently.
+func (c *Client) probeClockSkews(ctx context.Context) {
+	wg := sync.WaitGroup{}
+	for _, u := range c.cfg.Read.URL {
+		wg.Add(1)
+		go func(u string) {
+			defer wg.Done()
+			skew, err := c.probeClockSkew(ctx, u)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				level.Warn(c.readLogger).Log(
+					"graphite_web", u, "target", c.cfg.Read.ClockSkewProbeTarget,
+					"err", err, "msg", "Error probing the clock skew of graphite")
+				return
+			}
+			clockSkew.WithLabelValues(u).Set(skew.Seconds())
+		}(u)
+	}
+	wg.Wait()
+}
+
+// probeClockSkew returns the local time minus the timestamp of the latest
+// datapoint of the probe target on the graphite-web backend graphiteURL,
+// which includes the delay of writes and the resolution of the target.
+func (c *Client) probeClockSkew(ctx context.Context, graphiteURL string) (time.Duration, error) {
+	params := url.Values{
+		"format": {graphiteCfg.RenderFormatJSON},
+		"from":   {fmt.Sprintf("-%ds", int(clockSkewProbeWindow.Seconds()))},
+		"until":  {"now"},
+		"target": {c.cfg.Read.ClockSkewProbeTarget},
+	}
+	if c.cfg.Read.RenderFormat == graphiteCfg.RenderFormatCSV {
+		params.Set("format", graphiteCfg.RenderFormatCSV)
+		params.Set("tz", "UTC")
+	}
+	renderURL, err := prepareURLValues(graphiteURL, c.cfg.Read.RenderPath, params)
+	if err != nil {
+		return 0, err
+	}
+	renderResponses, err := c.render(ctx, renderURL)
+	if err != nil {
+		return 0, err
+	}
+
+	var latest int64
+	for _, r := range renderResponses {
+		for _, d := range r.Datapoints {
+			if d.Value != nil && d.Timestamp > latest {
+				latest = d.Timestamp
+			}
+		}
+	}
+	if latest == 0 {
+		return 0, fmt.Errorf("no datapoint of %s in the last %s", c.cfg.Read.ClockSkewProbeTarget, clockSkewProbeWindow)
+	}
+	return time.Since(time.Unix(latest, 0)), nil
+}
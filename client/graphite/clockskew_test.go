@@ -0,0 +1,140 @@
+// Copyright 2017 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/criteo/graphite-remote-adapter/client/graphite/config"
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"golang.org/x/net/context"
+)
+
+func TestProbeClockSkew(t *testing.T) {
+	latest := time.Now().Add(-30 * time.Second).Unix()
+	var target string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target = r.URL.Query().Get("target")
+		if latest == 0 {
+			w.Write([]byte("[]"))
+			return
+		}
+		fmt.Fprintf(w, `[{"target": "up", "datapoints": [[1, %d], [1, %d], [null, %d]]}]`,
+			latest-60, latest, latest+60)
+	}))
+	defer server.Close()
+
+	c := &Client{
+		readLogger: log.NewNopLogger(),
+		httpClient: http.DefaultClient,
+		cfg: &config.Config{Read: config.ReadConfig{
+			URL:                  config.URLList{server.URL},
+			RenderPath:           "/render/",
+			ClockSkewProbeTarget: "prometheus-prefix.remote_adapter.up",
+		}},
+	}
+	skew, err := c.probeClockSkew(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "prometheus-prefix.remote_adapter.up" {
+		t.Errorf("Expected the probe target to be rendered, got %q", target)
+	}
+	// Null datapoints are ignored.
+	if skew < 30*time.Second || skew > 40*time.Second {
+		t.Errorf("Expected a skew of about 30s, got %s", skew)
+	}
+
+	latest = 0
+	if _, err := c.probeClockSkew(context.Background(), server.URL); err == nil {
+		t.Errorf("Expected an error without datapoints")
+	}
+}
+
+func TestProbeClockSkewsOfAllBackends(t *testing.T) {
+	var servers []*httptest.Server
+	for _, skew := range []time.Duration{10 * time.Second, 5 * time.Minute} {
+		latest := time.Now().Add(-skew).Unix()
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `[{"target": "up", "datapoints": [[1, %d]]}]`, latest)
+		}))
+		defer server.Close()
+		servers = append(servers, server)
+	}
+
+	c := &Client{
+		readLogger: log.NewNopLogger(),
+		httpClient: http.DefaultClient,
+		cfg: &config.Config{Read: config.ReadConfig{
+			URL:                  config.URLList{servers[0].URL, servers[1].URL},
+			RenderPath:           "/render/",
+			ClockSkewProbeTarget: "prometheus-prefix.remote_adapter.up",
+		}},
+	}
+	c.probeClockSkews(context.Background())
+	if skew := testutil.ToFloat64(clockSkew.WithLabelValues(servers[0].URL)); skew < 10 || skew > 20 {
+		t.Errorf("Expected a skew of about 10s for the first backend, got %gs", skew)
+	}
+	if skew := testutil.ToFloat64(clockSkew.WithLabelValues(servers[1].URL)); skew < 300 || skew > 310 {
+		t.Errorf("Expected a skew of about 300s for the second backend, got %gs", skew)
+	}
+}
+
+func TestStopClockSkewProbeTwice(t *testing.T) {
+	c := &Client{readLogger: log.NewNopLogger(), cfg: &config.Config{}}
+	c.startClockSkewProbe(time.Hour)
+	c.stopClockSkewProbe()
+	c.startClockSkewProbe(time.Hour)
+	c.Shutdown()
+	c.stopClockSkewProbe()
+}
+
+func TestStopClockSkewProbeCancelsRender(t *testing.T) {
+	rendering := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case rendering <- struct{}{}:
+		default:
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	c := &Client{
+		readLogger: log.NewNopLogger(),
+		httpClient: http.DefaultClient,
+		cfg: &config.Config{Read: config.ReadConfig{
+			URL:                  config.URLList{server.URL},
+			RenderPath:           "/render/",
+			ClockSkewProbeTarget: "prometheus-prefix.remote_adapter.up",
+		}},
+	}
+	// The render would last up to the interval if it wasn't canceled.
+	c.startClockSkewProbe(200 * time.Millisecond)
+	<-rendering
+	begin := time.Now()
+	c.stopClockSkewProbe()
+	if elapsed := time.Since(begin); elapsed > 100*time.Millisecond {
+		t.Errorf("Expected the ongoing render to be canceled, stopping took %s", elapsed)
+	}
+}
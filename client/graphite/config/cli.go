@@ -10,14 +10,126 @@ func AddCommandLine(app *kingpin.Application, cfg *Config) {
 		"The prefix to prepend to all metrics exported to Graphite.").
 		StringVar(&cfg.DefaultPrefix)
 
+	app.Flag("graphite.separator",
+		"Separator of the nodes of Graphite paths. Default is .").
+		StringVar(&cfg.Separator)
+
+	app.Flag("graphite.normalize-prefix",
+		"Follow the default prefix by exactly one separator, whether or not it ends with one.").
+		BoolVar(&cfg.NormalizePrefix)
+
 	app.Flag("graphite.read.url",
-		"The URL of the remote Graphite Web server to send samples to.").
-		StringVar(&cfg.Read.URL)
+		"The URL of the remote Graphite Web server to read samples from. Can be repeated to merge the series of several servers.").
+		SetValue(&cfg.Read.URL)
 
 	app.Flag("graphite.read.max-point-delta",
 		"If set, interval used to linearly interpolate intermediate points.").
 		DurationVar(&cfg.Read.MaxPointDelta)
 
+	app.Flag("graphite.read.forward-params",
+		"Query parameter of read requests to forward to Graphite render endpoint. Can be repeated.").
+		StringsVar(&cfg.Read.ForwardParams)
+
+	app.Flag("graphite.read.forward-templates",
+		"Name of a Graphite render template variable whose template[name] query parameter of read requests is forwarded. Can be repeated.").
+		StringsVar(&cfg.Read.ForwardTemplates)
+
+	app.Flag("graphite.read.render-path",
+		"Path of the Graphite Web render endpoint. Default is /render/").
+		StringVar(&cfg.Read.RenderPath)
+
+	app.Flag("graphite.read.expand-path",
+		"Path of the Graphite Web expand endpoint. Default is /metrics/expand").
+		StringVar(&cfg.Read.ExpandPath)
+
+	app.Flag("graphite.read.max-total-points",
+		"If set, maximum number of points read for a query, split between its targets.").
+		IntVar(&cfg.Read.MaxTotalPoints)
+
+	app.Flag("graphite.read.max-render-bytes",
+		"If set, maximum size of the Graphite Web responses, larger ones fail the read.").
+		Int64Var(&cfg.Read.MaxRenderBytes)
+
+	app.Flag("graphite.read.counter-interpolation",
+		"Interpolation of counters when graphite.read.max-point-delta is set: linear, step or none. Default is linear").
+		EnumVar(&cfg.Read.CounterInterpolation, InterpolationLinear, InterpolationStep, InterpolationNone)
+
+	app.Flag("graphite.read.value-scale",
+		"If set, read values are multiplied by this factor.").
+		Float64Var(&cfg.Read.ValueScale)
+
+	app.Flag("graphite.read.value-offset",
+		"If set, this offset is added to read values, after scaling.").
+		Float64Var(&cfg.Read.ValueOffset)
+
+	app.Flag("graphite.read.clock-skew-probe-target",
+		"If set, metric written continuously whose latest datapoint is compared with the local time.").
+		StringVar(&cfg.Read.ClockSkewProbeTarget)
+
+	app.Flag("graphite.read.clock-skew-probe-interval",
+		"Interval between renders of graphite.read.clock-skew-probe-target.").
+		DurationVar(&cfg.Read.ClockSkewProbeInterval)
+
+	app.Flag("graphite.read.use-findseries",
+		"If set with tags enabled, series are found with the /tags/findSeries endpoint and rendered by name.").
+		BoolVar(&cfg.Read.UseFindSeries)
+
+	app.Flag("graphite.read.fill-forward",
+		"If set, the last value read is repeated over the null datapoints following it, up to this duration.").
+		DurationVar(&cfg.Read.FillForward)
+
+	app.Flag("graphite.read.retry-on-empty",
+		"If set, delay after which a render of expanded paths returning no datapoints is retried once.").
+		DurationVar(&cfg.Read.RetryOnEmpty)
+
+	app.Flag("graphite.read.window-split",
+		"If set, queries are split into windows of this duration, rendered separately.").
+		DurationVar(&cfg.Read.WindowSplit)
+
+	app.Flag("graphite.read.infer-metric-types",
+		"Add a __type__ label to read series, inferred from the suffix of their name, e.g. _total for counters.").
+		BoolVar(&cfg.Read.InferMetricTypes)
+
+	app.Flag("graphite.read.http-method",
+		"Method of the requests to Graphite Web: GET or POST.").
+		StringVar(&cfg.Read.HTTPMethod)
+
+	app.Flag("graphite.read.render-format",
+		"Format requested to the Graphite Web render endpoint: json or csv.").
+		EnumVar(&cfg.Read.RenderFormat, RenderFormatJSON, RenderFormatCSV)
+
+	app.Flag("graphite.read.retry-count",
+		"Number of retries of the requests to graphite-web failing with a network error or a 5xx response.").
+		IntVar(&cfg.Read.RetryCount)
+
+	app.Flag("graphite.read.retry-backoff",
+		"Delay before the first retry of a request to graphite-web, doubled for each retry. Default is 100ms").
+		DurationVar(&cfg.Read.RetryBackoff)
+
+	app.Flag("graphite.read.max-fetch-workers",
+		"Maximum number of concurrent requests to graphite-web per read. Default is 10").
+		IntVar(&cfg.Read.MaxFetchWorkers)
+
+	app.Flag("graphite.read.render-batch-size",
+		"Maximum number of targets rendered per request to graphite-web. Default is 1").
+		IntVar(&cfg.Read.RenderBatchSize)
+
+	app.Flag("graphite.read.remove-empty-series",
+		"Wrap rendered targets in removeEmptySeries, so that graphite-web leaves out series without values.").
+		BoolVar(&cfg.Read.RemoveEmptySeries)
+
+	app.Flag("graphite.read.expand-leading-labels",
+		"Expand only the paths under the values of the leading labels matched with = by reads without tags.").
+		BoolVar(&cfg.Read.ExpandLeadingLabels)
+
+	app.Flag("graphite.read.relative-time",
+		"Render queries ranging over whole minutes from now with relative times, e.g. -6h, for caches keyed on them.").
+		BoolVar(&cfg.Read.RelativeTime)
+
+	app.Flag("graphite.read.schema-version",
+		"If set, node expected right after the prefix of read paths, as written with graphite.write.schema-version.").
+		StringVar(&cfg.Read.SchemaVersion)
+
 	app.Flag("graphite.write.carbon-address",
 		"The host:port of the Graphite server to send samples to.").
 		StringVar(&cfg.Write.CarbonAddress)
@@ -26,6 +138,38 @@ func AddCommandLine(app *kingpin.Application, cfg *Config) {
 		"Transport protocol to use to communicate with Graphite.").
 		StringVar(&cfg.Write.CarbonTransport)
 
+	app.Flag("graphite.write.carbon-idle-timeout",
+		"If set, the connection to Graphite is closed after being idle for this duration.").
+		DurationVar(&cfg.Write.CarbonIdleTimeout)
+
+	app.Flag("graphite.write.carbon-write-deadline",
+		"If set, writing a batch to Graphite fails after this duration, and the connection is closed.").
+		DurationVar(&cfg.Write.CarbonWriteDeadline)
+
+	app.Flag("graphite.write.line-terminator",
+		"Terminator of the lines written to Graphite: lf or crlf. Default is lf").
+		EnumVar(&cfg.Write.LineTerminator, LineTerminatorLF, LineTerminatorCRLF)
+
+	app.Flag("graphite.write.max-unique-series",
+		"If set, write requests with more unique series than this are rejected.").
+		IntVar(&cfg.Write.MaxUniqueSeries)
+
+	app.Flag("graphite.write.expect-ack",
+		"Wait for Graphite to acknowledge every batch written over TCP with an OK line.").
+		BoolVar(&cfg.Write.ExpectAck)
+
+	app.Flag("graphite.write.tag-escaping",
+		"Escaping of the tag values written to Graphite: path or tag. Default is path").
+		EnumVar(&cfg.Write.TagEscaping, TagEscapingPath, TagEscapingTag)
+
+	app.Flag("graphite.write.unhealthy-threshold",
+		"If set, ratio of failed writes to Graphite above which /-/ready reports the adapter as not ready.").
+		Float64Var(&cfg.Write.UnhealthyThreshold)
+
+	app.Flag("graphite.write.unhealthy-window",
+		"Window of the ratio of failed writes to Graphite. Default is 5m").
+		DurationVar(&cfg.Write.UnhealthyWindow)
+
 	app.Flag("graphite.write.enable-paths-cache",
 		"Enables a cache to graphite paths lists for written metrics.").
 		BoolVar(&cfg.Write.EnablePathsCache)
@@ -38,6 +182,82 @@ func AddCommandLine(app *kingpin.Application, cfg *Config) {
 		"Duration between purges for expired items in the paths cache.").
 		DurationVar(&cfg.Write.PathsCachePurgeInterval)
 
+	app.Flag("graphite.write.template-data-file",
+		"YAML file whose top-level keys override the ones of the template data.").
+		StringVar(&cfg.Write.TemplateDataFile)
+
+	app.Flag("graphite.write.template-data-refresh",
+		"Interval at which the template data file is read again, 0 to only read it on reload.").
+		DurationVar(&cfg.Write.TemplateDataRefresh)
+
+	app.Flag("graphite.write.dead-letter-file",
+		"File to which samples dropped on write are appended as JSON lines.").
+		StringVar(&cfg.Write.DeadLetterFile)
+
+	app.Flag("graphite.write.sanitize-tag-keys",
+		"Replace characters not allowed in tag keys when using tags or OpenMetrics format.").
+		BoolVar(&cfg.Write.SanitizeTagKeys)
+
+	app.Flag("graphite.write.missing-name-placeholder",
+		"Metric name used for samples without one. If unset, such samples are dropped.").
+		StringVar(&cfg.Write.MissingNamePlaceholder)
+
+	app.Flag("graphite.write.min-interval",
+		"If set, only the last sample of each series within this interval is written.").
+		DurationVar(&cfg.Write.MinInterval)
+
+	app.Flag("graphite.write.group-by-path",
+		"Sort the datapoints of a write request by path before sending them to carbon.").
+		BoolVar(&cfg.Write.GroupByPath)
+
+	app.Flag("graphite.write.aggregation-from-label",
+		"If set, label holding the carbon aggregation method of metrics, appended to default paths.").
+		StringVar(&cfg.Write.AggregationFromLabel)
+
+	app.Flag("graphite.write.aggregation-tag",
+		"Tag holding the aggregation method of tagged series. Default is aggregation").
+		StringVar(&cfg.Write.AggregationTag)
+
+	app.Flag("graphite.write.clamp-future-to-now",
+		"Write samples timestamped in the future at the current time.").
+		BoolVar(&cfg.Write.ClampFutureToNow)
+
+	app.Flag("graphite.write.render-workers",
+		"If set, number of goroutines building the datapoints of a write request.").
+		IntVar(&cfg.Write.RenderWorkers)
+
+	app.Flag("graphite.write.heartbeat-interval",
+		"If set, interval at which <prefix>remote_adapter.up is written to carbon.").
+		DurationVar(&cfg.Write.HeartbeatInterval)
+
+	app.Flag("graphite.write.template-timeout",
+		"If set, samples whose rule template rendering takes longer are dropped.").
+		DurationVar(&cfg.Write.TemplateTimeout)
+
+	app.Flag("graphite.write.max-concurrent-dials",
+		"If set, maximum number of concurrent connection attempts to carbon.").
+		IntVar(&cfg.Write.MaxConcurrentDials)
+
+	app.Flag("graphite.write.max-samples-per-second",
+		"If set, maximum number of datapoints written to carbon per second, writes wait up to the write timeout for it.").
+		IntVar(&cfg.Write.MaxSamplesPerSecond)
+
+	app.Flag("graphite.write.udp-max-bytes",
+		"Maximum size of the datagrams written to carbon over UDP.").
+		IntVar(&cfg.Write.UDPMaxBytes)
+
+	app.Flag("graphite.write.carbon-connection-pool-size",
+		"If above 1, number of connections to carbon used by concurrent writes over TCP.").
+		IntVar(&cfg.Write.CarbonConnectionPoolSize)
+
+	app.Flag("graphite.write.schema-version",
+		"If set, node inserted right after the prefix of default paths, e.g. v2.").
+		StringVar(&cfg.Write.SchemaVersion)
+
+	app.Flag("graphite.write.leading-labels",
+		"Label placed before the others in default paths, in the given order. Can be repeated.").
+		StringsVar(&cfg.Write.LeadingLabels)
+
 	app.Flag("graphite.enable-tags",
 		"Use Graphite tags.").
 		BoolVar(&cfg.EnableTags)
@@ -45,4 +265,8 @@ func AddCommandLine(app *kingpin.Application, cfg *Config) {
 	app.Flag("graphite.filtered-tags",
 		"Use Graphite tags only for given tag names; Multiple names must be separated by a comma. Eg: app_name,job_name").
 		StringVar(&cfg.FilteredTags)
+
+	app.Flag("graphite.name-label-tag",
+		"Tag key used to store labels called \"name\" when using tags, as it collides with the Graphite metric name.").
+		StringVar(&cfg.NameLabelTag)
 }
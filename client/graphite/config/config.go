@@ -14,9 +14,15 @@
 package config
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
 	"text/template"
 	"time"
 
@@ -30,12 +36,21 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
+// DefaultMaxFetchWorkers is the default number of concurrent requests to
+// graphite-web per read.
+const DefaultMaxFetchWorkers = 10
+
+// DefaultUDPMaxBytes is the default maximum size of the datagrams written to
+// carbon over UDP.
+const DefaultUDPMaxBytes = 1024
+
 // DefaultConfig is the default graphite configuration.
 var DefaultConfig = Config{
 	DefaultPrefix:        "",
 	EnableTags:           false,
 	FilteredTags:         "",
 	UseOpenMetricsFormat: false,
+	Separator:            ".",
 	Write: WriteConfig{
 		CarbonAddress:           "",
 		CarbonTransport:         "tcp",
@@ -43,10 +58,15 @@ var DefaultConfig = Config{
 		EnablePathsCache:        true,
 		PathsCacheTTL:           1 * time.Hour,
 		PathsCachePurgeInterval: 2 * time.Hour,
+		UDPMaxBytes:             DefaultUDPMaxBytes,
 	},
 	Read: ReadConfig{
-		URL:           "",
-		MaxPointDelta: time.Duration(0),
+		URL:                    nil,
+		MaxPointDelta:          time.Duration(0),
+		RenderPath:             "/render/",
+		ExpandPath:             "/metrics/expand",
+		MaxFetchWorkers:        DefaultMaxFetchWorkers,
+		ClockSkewProbeInterval: 1 * time.Minute,
 	},
 }
 
@@ -58,6 +78,15 @@ type Config struct {
 	EnableTags           bool        `yaml:"enable_tags,omitempty" json:"enable_tags,omitempty"`
 	FilteredTags         string      `yaml:"filtered_tags,omitempty" json:"filtered_tags,omitempty"`
 	UseOpenMetricsFormat bool        `yaml:"openmetrics,omitempty" json:"openmetrics,omitempty"`
+	// NameLabelTag is the tag key used to store labels called "name", which
+	// would otherwise collide with the graphite "name" tag.
+	NameLabelTag string `yaml:"name_label_tag,omitempty" json:"name_label_tag,omitempty"`
+	// Separator separates the nodes of the default paths, on both the write
+	// and the read side. The prefix is expected to end with it.
+	Separator string `yaml:"separator,omitempty" json:"separator,omitempty"`
+	// If set, DefaultPrefix is followed by exactly one Separator in default
+	// paths, whether or not it ends with one.
+	NormalizePrefix bool `yaml:"normalize_prefix,omitempty" json:"normalize_prefix,omitempty"`
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
@@ -78,6 +107,15 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err := unmarshal((*plain)(c)); err != nil {
 		return err
 	}
+	if strings.Contains(c.DefaultPrefix, "{{") {
+		if _, err := ParseTemplate(c.DefaultPrefix); err != nil {
+			return fmt.Errorf("invalid default_prefix %q: %s", c.DefaultPrefix, err)
+		}
+		// Reads have no sample to render the prefix against.
+		if len(c.Read.URL) > 0 {
+			return fmt.Errorf("templated default_prefix %q can't be read, use a literal prefix along with read.url", c.DefaultPrefix)
+		}
+	}
 	return utils.CheckOverflow(c.XXX, "graphite config")
 }
 
@@ -90,12 +128,139 @@ func (c *Config) StoragePrefixFromRequest(r *http.Request) string {
 	return p
 }
 
+// ForwardedParamsFromRequest returns the request's Query parameters allowed to
+// be forwarded to graphite render endpoint.
+func (c *Config) ForwardedParamsFromRequest(r *http.Request) map[string]string {
+	params := make(map[string]string)
+	query := r.URL.Query()
+	for _, name := range c.Read.ForwardParams {
+		if v := query.Get(name); v != "" {
+			params[name] = v
+		}
+	}
+	for _, name := range c.Read.ForwardTemplates {
+		key := "template[" + name + "]"
+		if v := query.Get(key); v != "" {
+			params[key] = v
+		}
+	}
+	return params
+}
+
+// Interpolations of counters between points read from graphite.
+const (
+	InterpolationLinear = "linear"
+	InterpolationStep   = "step"
+	InterpolationNone   = "none"
+)
+
+// Terminators of the lines written to carbon.
+const (
+	LineTerminatorLF   = "lf"
+	LineTerminatorCRLF = "crlf"
+)
+
+// Escapings of the tag values written to carbon.
+const (
+	TagEscapingPath = "path"
+	TagEscapingTag  = "tag"
+)
+
+// Formats of the responses of the render endpoint.
+const (
+	RenderFormatJSON = "json"
+	RenderFormatCSV  = "csv"
+)
+
+// Methods of the requests to graphite-web.
+const (
+	HTTPMethodGET  = "GET"
+	HTTPMethodPOST = "POST"
+)
+
 // ReadConfig is the read graphite configuration.
 type ReadConfig struct {
-	URL string `yaml:"url,omitempty" json:"url,omitempty"`
+	// URL of graphite-web, or URLs of several graphite-web backends, e.g.
+	// the shards of a cluster, whose series are merged.
+	URL URLList `yaml:"url,omitempty" json:"url,omitempty"`
 	// If set, MaxPointDelta is used to linearly interpolate intermediate points.
 	// It helps support prom1.x reading metrics with larger retention than staleness delta.
 	MaxPointDelta time.Duration `yaml:"max_point_delta,omitempty" json:"max_point_delta,omitempty"`
+	// Query parameters of read requests in ForwardParams are forwarded to the render endpoint.
+	ForwardParams []string `yaml:"forward_params,omitempty" json:"forward_params,omitempty"`
+	// template[name] query parameters of read requests, for names in
+	// ForwardTemplates, are forwarded to the render endpoint.
+	ForwardTemplates []string `yaml:"forward_templates,omitempty" json:"forward_templates,omitempty"`
+	// Paths of the render and expand endpoints, relative to URL.
+	RenderPath string `yaml:"render_path,omitempty" json:"render_path,omitempty"`
+	ExpandPath string `yaml:"expand_path,omitempty" json:"expand_path,omitempty"`
+	// If set, MaxTotalPoints is split between the targets of a query to limit
+	// the points returned by graphite-web with maxDataPoints.
+	MaxTotalPoints int `yaml:"max_total_points,omitempty" json:"max_total_points,omitempty"`
+	// If set, reads fail when graphite-web responses are larger than MaxRenderBytes.
+	MaxRenderBytes int64 `yaml:"max_render_bytes,omitempty" json:"max_render_bytes,omitempty"`
+	// If set, SchemaVersion is expected as the first node after the prefix.
+	SchemaVersion string `yaml:"schema_version,omitempty" json:"schema_version,omitempty"`
+	// CounterInterpolation is used instead of linear interpolation for
+	// counters when MaxPointDelta is set: linear, step or none.
+	CounterInterpolation string `yaml:"counter_interpolation,omitempty" json:"counter_interpolation,omitempty"`
+	// Read values are transformed into value * ValueScale + ValueOffset,
+	// e.g. to convert units. A zero ValueScale leaves values unscaled.
+	ValueScale  float64 `yaml:"value_scale,omitempty" json:"value_scale,omitempty"`
+	ValueOffset float64 `yaml:"value_offset,omitempty" json:"value_offset,omitempty"`
+	// Series matching a ValueTransform are transformed by the first one
+	// instead of ValueScale and ValueOffset.
+	ValueTransforms []*ValueTransform `yaml:"value_transforms,omitempty" json:"value_transforms,omitempty"`
+	// If set, null datapoints up to FillForward after a value repeat it.
+	FillForward time.Duration `yaml:"fill_forward,omitempty" json:"fill_forward,omitempty"`
+	// If set, renders without datapoints are retried once after RetryOnEmpty.
+	RetryOnEmpty time.Duration `yaml:"retry_on_empty,omitempty" json:"retry_on_empty,omitempty"`
+	// If set, queries are rendered in windows of at most WindowSplit.
+	WindowSplit time.Duration `yaml:"window_split,omitempty" json:"window_split,omitempty"`
+	// If set, unsplit queries whose range is a whole number of minutes from
+	// now are rendered with relative times, e.g. from=-6h&until=now.
+	RelativeTime bool `yaml:"relative_time,omitempty" json:"relative_time,omitempty"`
+	// RenderFormat is the format requested to the render endpoint, json or
+	// csv for graphite-web compatible servers which only produce CSV.
+	RenderFormat string `yaml:"render_format,omitempty" json:"render_format,omitempty"`
+	// HTTPMethod is the method of the requests to graphite-web, GET or POST
+	// to send the parameters in the body, e.g. when a proxy rejects long URLs.
+	HTTPMethod string `yaml:"http_method,omitempty" json:"http_method,omitempty"`
+	// If set along with tags, the series matching a query are found with the
+	// findSeries endpoint and rendered by name, instead of with seriesByTag.
+	UseFindSeries bool `yaml:"use_findseries,omitempty" json:"use_findseries,omitempty"`
+	// If set, targets are wrapped in removeEmptySeries so that graphite-web
+	// leaves out the series without any value in the rendered range.
+	RemoveEmptySeries bool `yaml:"remove_empty_series,omitempty" json:"remove_empty_series,omitempty"`
+	// If set, reads without tags only expand the paths under the values of
+	// the leading labels matched with "=", instead of all the paths of a name.
+	ExpandLeadingLabels bool `yaml:"expand_leading_labels,omitempty" json:"expand_leading_labels,omitempty"`
+	// If set, up to RenderBatchSize targets are rendered per request.
+	RenderBatchSize int `yaml:"render_batch_size,omitempty" json:"render_batch_size,omitempty"`
+	// Requests to graphite-web failing with a network error or a 5xx
+	// response are retried up to RetryCount times, after an exponential
+	// backoff starting at RetryBackoff.
+	RetryCount   int           `yaml:"retry_count,omitempty" json:"retry_count,omitempty"`
+	RetryBackoff time.Duration `yaml:"retry_backoff,omitempty" json:"retry_backoff,omitempty"`
+	// MaxFetchWorkers bounds the concurrent requests to graphite-web per read.
+	MaxFetchWorkers int `yaml:"max_fetch_workers,omitempty" json:"max_fetch_workers,omitempty"`
+	// Credentials of the requests to graphite-web, either BasicAuth or a
+	// bearer token. Files are read by LoadCredentials.
+	BasicAuth       *BasicAuth `yaml:"basic_auth,omitempty" json:"basic_auth,omitempty"`
+	BearerToken     Secret     `yaml:"bearer_token,omitempty" json:"bearer_token,omitempty"`
+	BearerTokenFile string     `yaml:"bearer_token_file,omitempty" json:"bearer_token_file,omitempty"`
+	// TLS options of the requests to graphite-web.
+	TLSConfig TLSConfig `yaml:"tls_config,omitempty" json:"tls_config,omitempty"`
+	// Read series without a __type__ label get one from MetricTypes, which
+	// maps metric names to types, or else inferred from the suffix of their
+	// name if InferMetricTypes is set, e.g. _total for counters.
+	MetricTypes      map[string]string `yaml:"metric_types,omitempty" json:"metric_types,omitempty"`
+	InferMetricTypes bool              `yaml:"infer_metric_types,omitempty" json:"infer_metric_types,omitempty"`
+	// If set, ClockSkewProbeTarget, a metric written continuously, is
+	// rendered every ClockSkewProbeInterval to compare the timestamp of its
+	// latest datapoint with the local time.
+	ClockSkewProbeTarget   string        `yaml:"clock_skew_probe_target,omitempty" json:"clock_skew_probe_target,omitempty"`
+	ClockSkewProbeInterval time.Duration `yaml:"clock_skew_probe_interval,omitempty" json:"clock_skew_probe_interval,omitempty"`
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
@@ -108,19 +273,338 @@ func (c *ReadConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
+	switch c.HTTPMethod {
+	case "", HTTPMethodGET, HTTPMethodPOST:
+	default:
+		return fmt.Errorf("unsupported http_method %q, expected %s or %s",
+			c.HTTPMethod, HTTPMethodGET, HTTPMethodPOST)
+	}
+
+	switch c.RenderFormat {
+	case "", RenderFormatJSON, RenderFormatCSV:
+	default:
+		return fmt.Errorf("unsupported render_format %q, expected %s or %s",
+			c.RenderFormat, RenderFormatJSON, RenderFormatCSV)
+	}
+
+	switch c.CounterInterpolation {
+	case "", InterpolationLinear, InterpolationStep, InterpolationNone:
+	default:
+		return fmt.Errorf("unsupported counter_interpolation %q, expected %s, %s or %s",
+			c.CounterInterpolation, InterpolationLinear, InterpolationStep, InterpolationNone)
+	}
+
+	if c.ClockSkewProbeTarget != "" && c.ClockSkewProbeInterval <= 0 {
+		return fmt.Errorf("clock_skew_probe_target requires a positive clock_skew_probe_interval")
+	}
+
+	if c.RetryCount < 0 {
+		return fmt.Errorf("retry_count must not be negative, got %d", c.RetryCount)
+	}
+
+	if c.MaxFetchWorkers < 1 {
+		return fmt.Errorf("max_fetch_workers must be at least 1, got %d", c.MaxFetchWorkers)
+	}
+
+	if c.BearerToken != "" && c.BearerTokenFile != "" {
+		return fmt.Errorf("at most one of bearer_token and bearer_token_file must be set")
+	}
+	if c.BasicAuth != nil && (c.BearerToken != "" || c.BearerTokenFile != "") {
+		return fmt.Errorf("at most one of basic_auth, bearer_token and bearer_token_file must be set")
+	}
+
+	for name, metricType := range c.MetricTypes {
+		switch metricType {
+		case "counter", "gauge", "histogram", "summary", "untyped":
+		default:
+			return fmt.Errorf("unsupported type %q of metric %s in metric_types", metricType, name)
+		}
+	}
+
 	return utils.CheckOverflow(c.XXX, "readConfig")
 }
 
+// ValueTransform transforms the values of read series whose metric name
+// fully matches Name into value * Scale + Offset. A zero Scale leaves values
+// unscaled.
+type ValueTransform struct {
+	Name   Regexp  `yaml:"name,omitempty" json:"name,omitempty"`
+	Scale  float64 `yaml:"scale,omitempty" json:"scale,omitempty"`
+	Offset float64 `yaml:"offset,omitempty" json:"offset,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (t *ValueTransform) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ValueTransform
+	if err := unmarshal((*plain)(t)); err != nil {
+		return err
+	}
+
+	if t.Name.Regexp == nil {
+		return fmt.Errorf("value_transforms require a name")
+	}
+
+	return utils.CheckOverflow(t.XXX, "valueTransform")
+}
+
+// LoadCredentials reads the password and bearer token files, and checks that
+// the TLS files can be loaded. Relative files, including the TLS ones, are
+// relative to dir.
+func (c *ReadConfig) LoadCredentials(dir string) error {
+	c.TLSConfig.CAFile = resolvePath(dir, c.TLSConfig.CAFile)
+	c.TLSConfig.CertFile = resolvePath(dir, c.TLSConfig.CertFile)
+	c.TLSConfig.KeyFile = resolvePath(dir, c.TLSConfig.KeyFile)
+	if _, err := NewTLSConfig(&c.TLSConfig); err != nil {
+		return err
+	}
+	if c.BasicAuth != nil && c.BasicAuth.PasswordFile != "" {
+		password, err := readSecretFile(dir, c.BasicAuth.PasswordFile)
+		if err != nil {
+			return err
+		}
+		c.BasicAuth.Password = password
+	}
+	if c.BearerTokenFile != "" {
+		token, err := readSecretFile(dir, c.BearerTokenFile)
+		if err != nil {
+			return err
+		}
+		c.BearerToken = token
+	}
+	return nil
+}
+
+// readSecretFile returns the content of filename, relative to dir, without
+// surrounding whitespaces.
+func readSecretFile(dir string, filename string) (Secret, error) {
+	content, err := ioutil.ReadFile(resolvePath(dir, filename))
+	if err != nil {
+		return "", err
+	}
+	return Secret(strings.TrimSpace(string(content))), nil
+}
+
+// resolvePath returns filename relative to dir if it isn't absolute.
+func resolvePath(dir string, filename string) string {
+	if filename == "" || filepath.IsAbs(filename) {
+		return filename
+	}
+	return filepath.Join(dir, filename)
+}
+
+// TLSConfig configures the TLS connections to a server.
+type TLSConfig struct {
+	// CAFile is used instead of the system roots to verify the server.
+	CAFile string `yaml:"ca_file,omitempty" json:"ca_file,omitempty"`
+	// CertFile and KeyFile are the client certificate.
+	CertFile   string `yaml:"cert_file,omitempty" json:"cert_file,omitempty"`
+	KeyFile    string `yaml:"key_file,omitempty" json:"key_file,omitempty"`
+	ServerName string `yaml:"server_name,omitempty" json:"server_name,omitempty"`
+	// If set, the certificate of the server isn't verified.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify,omitempty" json:"insecure_skip_verify,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *TLSConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain TLSConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("tls_config cert_file and key_file must be set together")
+	}
+
+	return utils.CheckOverflow(c.XXX, "tlsConfig")
+}
+
+// NewTLSConfig returns the TLS configuration described by cfg, reading its
+// files.
+func NewTLSConfig(cfg *TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CAFile != "" {
+		ca, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file %s: %s", cfg.CAFile, err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in CA file %s", cfg.CAFile)
+		}
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate %s: %s", cfg.CertFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// BasicAuth holds the credentials of HTTP basic authentication.
+type BasicAuth struct {
+	Username     string `yaml:"username,omitempty" json:"username,omitempty"`
+	Password     Secret `yaml:"password,omitempty" json:"password,omitempty"`
+	PasswordFile string `yaml:"password_file,omitempty" json:"password_file,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *BasicAuth) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain BasicAuth
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if c.Username == "" {
+		return fmt.Errorf("basic_auth requires a username")
+	}
+	if c.Password != "" && c.PasswordFile != "" {
+		return fmt.Errorf("at most one of basic_auth password and password_file must be set")
+	}
+
+	return utils.CheckOverflow(c.XXX, "basicAuth")
+}
+
+// URLList is a list of URLs, which can be given as a single string.
+type URLList []string
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (l *URLList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var url string
+	if err := unmarshal(&url); err == nil {
+		*l = nil
+		if url != "" {
+			*l = URLList{url}
+		}
+		return nil
+	}
+	var urls []string
+	if err := unmarshal(&urls); err != nil {
+		return err
+	}
+	*l = urls
+	return nil
+}
+
+// Set implements the kingpin.Value interface, the flag can be repeated.
+func (l *URLList) Set(url string) error {
+	*l = append(*l, url)
+	return nil
+}
+
+// String implements the kingpin.Value interface.
+func (l *URLList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// IsCumulative tells kingpin that the flag can be repeated.
+func (l *URLList) IsCumulative() bool {
+	return true
+}
+
+// Secret is a string which isn't shown when the configuration is printed.
+type Secret string
+
+const secretPlaceholder = "<secret>"
+
+// String implements the fmt.Stringer interface.
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return secretPlaceholder
+}
+
+// MarshalYAML implements the yaml.Marshaler interface.
+func (s Secret) MarshalYAML() (interface{}, error) {
+	return s.String(), nil
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
 // WriteConfig is the write graphite configuration.
 type WriteConfig struct {
 	CarbonAddress           string                 `yaml:"carbon_address,omitempty" json:"carbon_address,omitempty"`
 	CarbonTransport         string                 `yaml:"carbon_transport,omitempty" json:"carbon_transport,omitempty"`
 	CarbonReconnectInterval time.Duration          `yaml:"carbon_reconnect_interval,omitempty" json:"carbon_reconnect_interval,omitempty"`
+	CarbonIdleTimeout       time.Duration          `yaml:"carbon_idle_timeout,omitempty" json:"carbon_idle_timeout,omitempty"`
 	EnablePathsCache        bool                   `yaml:"enable_paths_cache,omitempty" json:"enable_paths_cache,omitempty"`
 	PathsCacheTTL           time.Duration          `yaml:"paths_cache_ttl,omitempty" json:"paths_cache_ttl,omitempty"`
 	PathsCachePurgeInterval time.Duration          `yaml:"paths_cache_purge_interval,omitempty" json:"paths_cache_purge_interval,omitempty"`
 	TemplateData            map[string]interface{} `yaml:"template_data,omitempty" json:"template_data,omitempty"`
 	Rules                   []*Rule                `yaml:"rules,omitempty" json:"rules,omitempty"`
+	DeadLetterFile          string                 `yaml:"dead_letter_file,omitempty" json:"dead_letter_file,omitempty"`
+	SanitizeTagKeys         bool                   `yaml:"sanitize_tag_keys,omitempty" json:"sanitize_tag_keys,omitempty"`
+	MissingNamePlaceholder  string                 `yaml:"missing_name_placeholder,omitempty" json:"missing_name_placeholder,omitempty"`
+	NameSplit               NameSplitConfig        `yaml:"name_split,omitempty" json:"name_split,omitempty"`
+	MinInterval             time.Duration          `yaml:"min_interval,omitempty" json:"min_interval,omitempty"`
+	HeartbeatInterval       time.Duration          `yaml:"heartbeat_interval,omitempty" json:"heartbeat_interval,omitempty"`
+	TemplateTimeout         time.Duration          `yaml:"template_timeout,omitempty" json:"template_timeout,omitempty"`
+	MaxConcurrentDials      int                    `yaml:"max_concurrent_dials,omitempty" json:"max_concurrent_dials,omitempty"`
+	SchemaVersion           string                 `yaml:"schema_version,omitempty" json:"schema_version,omitempty"`
+	LeadingLabels           []string               `yaml:"leading_labels,omitempty" json:"leading_labels,omitempty"`
+	LineTerminator          string                 `yaml:"line_terminator,omitempty" json:"line_terminator,omitempty"`
+	Routes                  []*Route               `yaml:"routes,omitempty" json:"routes,omitempty"`
+	RulesFile               string                 `yaml:"rules_file,omitempty" json:"rules_file,omitempty"`
+	UnhealthyThreshold      float64                `yaml:"unhealthy_threshold,omitempty" json:"unhealthy_threshold,omitempty"`
+	UnhealthyWindow         time.Duration          `yaml:"unhealthy_window,omitempty" json:"unhealthy_window,omitempty"`
+	GroupByPath             bool                   `yaml:"group_by_path,omitempty" json:"group_by_path,omitempty"`
+	AggregationFromLabel    string                 `yaml:"aggregation_from_label,omitempty" json:"aggregation_from_label,omitempty"`
+	ClampFutureToNow        bool                   `yaml:"clamp_future_to_now,omitempty" json:"clamp_future_to_now,omitempty"`
+	RenderWorkers           int                    `yaml:"render_workers,omitempty" json:"render_workers,omitempty"`
+	// Samples whose metric name fully matches DropNameRegex are dropped
+	// before rules are evaluated.
+	DropNameRegex *Regexp `yaml:"drop_name_regex,omitempty" json:"drop_name_regex,omitempty"`
+	// ConstantLabels are added to written samples which don't have them,
+	// before paths are built, e.g. the region of the adapter.
+	ConstantLabels LabelSet `yaml:"constant_labels,omitempty" json:"constant_labels,omitempty"`
+	// TagEscaping escapes tag values like path nodes or with the graphite
+	// tag rules, which keep dots and slashes as is.
+	TagEscaping string `yaml:"tag_escaping,omitempty" json:"tag_escaping,omitempty"`
+	// If set, write requests with more unique series are rejected, e.g. to
+	// protect carbon from a cardinality explosion.
+	MaxUniqueSeries int `yaml:"max_unique_series,omitempty" json:"max_unique_series,omitempty"`
+	// If set, writes over TCP wait for the receiver, e.g. a carbon relay, to
+	// acknowledge every batch with an "OK" line, and fail otherwise.
+	ExpectAck bool `yaml:"expect_ack,omitempty" json:"expect_ack,omitempty"`
+	// If set, writing a batch to carbon fails after CarbonWriteDeadline, and
+	// the connection is closed, e.g. when the receiver stopped reading.
+	CarbonWriteDeadline time.Duration `yaml:"carbon_write_deadline,omitempty" json:"carbon_write_deadline,omitempty"`
+	// If above 1, concurrent writes to the carbon address over TCP use up to
+	// CarbonConnectionPoolSize connections instead of waiting for each other.
+	CarbonConnectionPoolSize int `yaml:"carbon_connection_pool_size,omitempty" json:"carbon_connection_pool_size,omitempty"`
+	// UDPMaxBytes bounds the size of the datagrams written over UDP, e.g.
+	// to use larger datagrams on networks with jumbo frames.
+	UDPMaxBytes int `yaml:"udp_max_bytes,omitempty" json:"udp_max_bytes,omitempty"`
+	// If set, writes wait for the datapoints written to carbon not to exceed
+	// MaxSamplesPerSecond, and fail when they would wait for longer than the
+	// write timeout.
+	MaxSamplesPerSecond int `yaml:"max_samples_per_second,omitempty" json:"max_samples_per_second,omitempty"`
+	// AggregationTag is the tag holding the aggregation method read from
+	// AggregationFromLabel with tags, "aggregation" if empty. Samples with a
+	// label written as a tag with the same key are rejected.
+	AggregationTag string `yaml:"aggregation_tag,omitempty" json:"aggregation_tag,omitempty"`
+	// If set, the top-level keys of TemplateDataFile, a YAML map, override
+	// the ones of TemplateData. The file is read again every
+	// TemplateDataRefresh if set.
+	TemplateDataFile    string        `yaml:"template_data_file,omitempty" json:"template_data_file,omitempty"`
+	TemplateDataRefresh time.Duration `yaml:"template_data_refresh,omitempty" json:"template_data_refresh,omitempty"`
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
@@ -133,9 +617,124 @@ func (c *WriteConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
+	switch c.LineTerminator {
+	case "", LineTerminatorLF, LineTerminatorCRLF:
+	default:
+		return fmt.Errorf("unsupported line_terminator %q, expected %s or %s",
+			c.LineTerminator, LineTerminatorLF, LineTerminatorCRLF)
+	}
+
+	switch c.TagEscaping {
+	case "", TagEscapingPath, TagEscapingTag:
+	default:
+		return fmt.Errorf("unsupported tag_escaping %q, expected %s or %s",
+			c.TagEscaping, TagEscapingPath, TagEscapingTag)
+	}
+
+	if c.MaxSamplesPerSecond < 0 {
+		return fmt.Errorf("max_samples_per_second must not be negative, got %d", c.MaxSamplesPerSecond)
+	}
+
+	if c.UDPMaxBytes < 1 {
+		return fmt.Errorf("udp_max_bytes must be at least 1, got %d", c.UDPMaxBytes)
+	}
+
+	if c.CarbonConnectionPoolSize < 0 {
+		return fmt.Errorf("carbon_connection_pool_size must not be negative, got %d", c.CarbonConnectionPoolSize)
+	}
+
+	sortRules(c.Rules)
+
 	return utils.CheckOverflow(c.XXX, "writeConfig")
 }
 
+// sortRules sorts rules by decreasing priority, rules with the same priority
+// keep their order.
+func sortRules(rules []*Rule) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Priority > rules[j].Priority
+	})
+}
+
+// LoadRulesFile appends the rules of RulesFile, a YAML list of rules, after
+// the ones of the configuration. A relative RulesFile is relative to dir.
+func (c *WriteConfig) LoadRulesFile(dir string) error {
+	if c.RulesFile == "" {
+		return nil
+	}
+	filename := c.RulesFile
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(dir, filename)
+	}
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var rules []*Rule
+	if err := yaml.Unmarshal(content, &rules); err != nil {
+		return fmt.Errorf("error parsing rules file %s: %s", filename, err)
+	}
+	c.Rules = append(c.Rules, rules...)
+	sortRules(c.Rules)
+	return nil
+}
+
+// LoadTemplateDataFile checks that the template data file can be read. A
+// relative path is made relative to dir, for the file to be read again later.
+func (c *WriteConfig) LoadTemplateDataFile(dir string) error {
+	c.TemplateDataFile = resolvePath(dir, c.TemplateDataFile)
+	_, err := c.MergedTemplateData()
+	return err
+}
+
+// MergedTemplateData returns TemplateData with the top-level keys of
+// TemplateDataFile, read now, overriding its own.
+func (c *WriteConfig) MergedTemplateData() (map[string]interface{}, error) {
+	if c.TemplateDataFile == "" {
+		return c.TemplateData, nil
+	}
+	content, err := ioutil.ReadFile(c.TemplateDataFile)
+	if err != nil {
+		return nil, err
+	}
+	var fileData map[string]interface{}
+	if err := yaml.Unmarshal(content, &fileData); err != nil {
+		return nil, fmt.Errorf("error parsing template data file %s: %s", c.TemplateDataFile, err)
+	}
+	data := make(map[string]interface{}, len(c.TemplateData)+len(fileData))
+	for k, v := range c.TemplateData {
+		data[k] = v
+	}
+	for k, v := range fileData {
+		data[k] = v
+	}
+	return data, nil
+}
+
+// NameSplitConfig replaces a delimiter in metric names to build nested
+// graphite nodes, e.g. "http_requests_total" -> "http.requests.total".
+type NameSplitConfig struct {
+	Delimiter   string `yaml:"delimiter,omitempty" json:"delimiter,omitempty"`
+	Replacement string `yaml:"replacement,omitempty" json:"replacement,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *NameSplitConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain NameSplitConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if c.Delimiter == "" || c.Replacement == "" {
+		return fmt.Errorf("name_split requires both a delimiter and a replacement")
+	}
+
+	return utils.CheckOverflow(c.XXX, "nameSplitConfig")
+}
+
 // LabelSet pairs a LabelName to a LabelValue.
 type LabelSet map[model.LabelName]model.LabelValue
 
@@ -149,6 +748,19 @@ type Rule struct {
 	Match    LabelSet   `yaml:"match,omitempty" json:"match,omitempty"`
 	MatchRE  LabelSetRE `yaml:"match_re,omitempty" json:"match_re,omitempty"`
 	Continue bool       `yaml:"continue,omitempty" json:"continue,omitempty"`
+	// If set, the default path is written along with the path of the rule,
+	// even when a matching rule stops the evaluation.
+	AlsoDefault bool `yaml:"also_default,omitempty" json:"also_default,omitempty"`
+	// Rules without Match nor MatchRE match every metric, which must be
+	// explicitly asked for with MatchAll.
+	MatchAll bool `yaml:"match_all,omitempty" json:"match_all,omitempty"`
+	// Rules with a higher Priority are evaluated first. Ties keep list order.
+	Priority int `yaml:"priority,omitempty" json:"priority,omitempty"`
+	// If set, Prefix replaces the default prefix in the default path of the
+	// metrics matching the rule. Rules without Tmpl only set the prefix.
+	Prefix string `yaml:"prefix,omitempty" json:"prefix,omitempty"`
+	// PrefixTmpl is Prefix parsed as a template, when it has template actions.
+	PrefixTmpl Template `yaml:"-" json:"-"`
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
@@ -161,9 +773,50 @@ func (r *Rule) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
+	if r.AlsoDefault && (r.Tmpl == Template{}) {
+		return fmt.Errorf("also_default requires a template")
+	}
+	if len(r.Match) == 0 && len(r.MatchRE) == 0 && !r.MatchAll {
+		return fmt.Errorf("rule without match nor match_re would match every metric, set match_all: true if intended")
+	}
+	if r.MatchAll && (len(r.Match) > 0 || len(r.MatchRE) > 0) {
+		return fmt.Errorf("match_all can't be set along with match or match_re")
+	}
+	if strings.Contains(r.Prefix, "{{") {
+		tmpl, err := ParseTemplate(r.Prefix)
+		if err != nil {
+			return fmt.Errorf("invalid rule prefix %q: %s", r.Prefix, err)
+		}
+		r.PrefixTmpl = tmpl
+	}
+
 	return utils.CheckOverflow(r.XXX, "rule")
 }
 
+// Route sends the samples it matches to another carbon address than the
+// default one. The first matching route is used.
+type Route struct {
+	Match         LabelSet   `yaml:"match,omitempty" json:"match,omitempty"`
+	MatchRE       LabelSetRE `yaml:"match_re,omitempty" json:"match_re,omitempty"`
+	CarbonAddress string     `yaml:"carbon_address,omitempty" json:"carbon_address,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (r *Route) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Route
+	if err := unmarshal((*plain)(r)); err != nil {
+		return err
+	}
+	if r.CarbonAddress == "" {
+		return fmt.Errorf("missing carbon_address in route")
+	}
+
+	return utils.CheckOverflow(r.XXX, "route")
+}
+
 // Template is a parsable template.
 type Template struct {
 	*template.Template
@@ -176,20 +829,33 @@ func (tmpl *Template) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err := unmarshal(&s); err != nil {
 		return err
 	}
-	template, err := template.New("").Funcs(utils_tmpl.TmplFuncMap).Funcs(graphite_tmpl.TmplFuncMap).Parse(s)
+	parsed, err := ParseTemplate(s)
 	if err != nil {
 		return err
 	}
-	tmpl.Template = template
-	tmpl.original = s
+	*tmpl = parsed
 	return nil
 }
 
+// ParseTemplate parses s as a template with the templating functions of rules.
+func ParseTemplate(s string) (Template, error) {
+	template, err := template.New("").Funcs(utils_tmpl.TmplFuncMap).Funcs(graphite_tmpl.TmplFuncMap).Parse(s)
+	if err != nil {
+		return Template{}, err
+	}
+	return Template{Template: template, original: s}, nil
+}
+
 // MarshalYAML implements the yaml.Marshaler interface.
 func (tmpl Template) MarshalYAML() (interface{}, error) {
 	return tmpl.original, nil
 }
 
+// String returns the template as it was defined.
+func (tmpl Template) String() string {
+	return tmpl.original
+}
+
 // Regexp encapsulates a regexp.Regexp and makes it YAML marshalable.
 type Regexp struct {
 	*regexp.Regexp
@@ -15,7 +15,11 @@ package config
 
 import (
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"regexp"
+	"strings"
 	"testing"
 	"text/template"
 	"time"
@@ -24,6 +28,7 @@ import (
 
 	graphite_tmpl "github.com/criteo/graphite-remote-adapter/client/graphite/template"
 	utils_tmpl "github.com/criteo/graphite-remote-adapter/utils/template"
+	"github.com/prometheus/common/model"
 )
 
 var (
@@ -31,9 +36,14 @@ var (
 		DefaultPrefix:        "test.prefix.",
 		EnableTags:           true,
 		UseOpenMetricsFormat: true,
+		Separator:            ".",
 		Read: ReadConfig{
-			URL:           "greatGraphiteWebURL",
-			MaxPointDelta: 5 * time.Minute,
+			URL:                    URLList{"greatGraphiteWebURL"},
+			MaxPointDelta:          5 * time.Minute,
+			RenderPath:             "/render/",
+			ExpandPath:             "/metrics/expand",
+			MaxFetchWorkers:        DefaultMaxFetchWorkers,
+			ClockSkewProbeInterval: 1 * time.Minute,
 		},
 		Write: WriteConfig{
 			CarbonAddress:           "greatCarbonAddress",
@@ -42,6 +52,7 @@ var (
 			CarbonReconnectInterval: 2 * time.Minute,
 			PathsCacheTTL:           18 * time.Minute,
 			PathsCachePurgeInterval: 42 * time.Minute,
+			UDPMaxBytes:             DefaultUDPMaxBytes,
 			TemplateData: map[string]interface{}{
 				"site_mapping": map[string]string{"eu-par": "fr_eqx"},
 			},
@@ -99,3 +110,254 @@ func TestUnmarshalConfig(t *testing.T) {
 			"testdata/conf.good.yml", cfg.String(), expectedConf.String())
 	}
 }
+
+func TestRulesPriority(t *testing.T) {
+	content := `
+write:
+  rules:
+  - match:
+      owner: team-A
+    template: 'a'
+  - match:
+      owner: team-B
+    template: 'b'
+    priority: 10
+  - match:
+      owner: team-C
+    template: 'c'
+    priority: -1
+  - match:
+      owner: team-D
+    template: 'd'
+    priority: 10`
+	cfg := &Config{}
+	if err := yaml.Unmarshal([]byte(content), cfg); err != nil {
+		t.Fatalf("Error parsing config: %s", err)
+	}
+
+	expectedOwners := []model.LabelValue{"team-B", "team-D", "team-A", "team-C"}
+	for i, rule := range cfg.Write.Rules {
+		if rule.Match["owner"] != expectedOwners[i] {
+			t.Errorf("Expected rule %d to match %s, got %s", i, expectedOwners[i], rule.Match["owner"])
+		}
+	}
+}
+
+func TestUnmarshalMetricTypes(t *testing.T) {
+	cfg := &Config{}
+	content := `
+read:
+  metric_types:
+    node_load1: gauge`
+	if err := yaml.Unmarshal([]byte(content), cfg); err != nil {
+		t.Fatalf("Error parsing config: %s", err)
+	}
+	if cfg.Read.MetricTypes["node_load1"] != "gauge" {
+		t.Fatalf("Expected node_load1 to be a gauge, got %v", cfg.Read.MetricTypes)
+	}
+
+	content = `
+read:
+  metric_types:
+    node_load1: gage`
+	if err := yaml.Unmarshal([]byte(content), &Config{}); err == nil {
+		t.Fatalf("Expected an error for an unsupported metric type")
+	}
+}
+
+func TestUnmarshalRuleMatchAll(t *testing.T) {
+	content := `
+write:
+  rules:
+  - template: 'everything'`
+	if err := yaml.Unmarshal([]byte(content), &Config{}); err == nil {
+		t.Fatalf("Expected an error for a rule without match criteria")
+	}
+
+	content = `
+write:
+  rules:
+  - template: 'everything'
+    match_all: true`
+	cfg := &Config{}
+	if err := yaml.Unmarshal([]byte(content), cfg); err != nil {
+		t.Fatalf("Error parsing config: %s", err)
+	}
+	if !cfg.Write.Rules[0].MatchAll {
+		t.Fatalf("Expected the rule to match all metrics")
+	}
+
+	content = `
+write:
+  rules:
+  - template: 'everything'
+    match_all: true
+    match:
+      owner: team-X`
+	if err := yaml.Unmarshal([]byte(content), &Config{}); err == nil {
+		t.Fatalf("Expected an error for match_all along with match")
+	}
+}
+
+func TestUnmarshalTemplatedPrefixes(t *testing.T) {
+	if err := yaml.Unmarshal([]byte("default_prefix: '{{.env'"), &Config{}); err == nil {
+		t.Fatalf("Expected an error for an invalid default_prefix template")
+	}
+	content := `
+default_prefix: '{{.labels.tenant}}.'
+read:
+  url: http://localhost:8080`
+	if err := yaml.Unmarshal([]byte(content), &Config{}); err == nil {
+		t.Fatalf("Expected an error for a templated default_prefix along with read.url")
+	}
+
+	content = `
+write:
+  rules:
+  - match:
+      owner: team-X
+    prefix: 'team-x.{{.labels.env}}.'`
+	cfg := &Config{}
+	if err := yaml.Unmarshal([]byte(content), cfg); err != nil {
+		t.Fatalf("Error parsing config: %s", err)
+	}
+	if cfg.Write.Rules[0].PrefixTmpl.String() != "team-x.{{.labels.env}}." {
+		t.Fatalf("Expected the rule prefix to be parsed, got %q", cfg.Write.Rules[0].PrefixTmpl)
+	}
+}
+
+func TestLoadCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "password"), []byte("s3cr3t\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{}
+	content := `
+read:
+  basic_auth:
+    username: prometheus
+    password_file: password`
+	if err := yaml.Unmarshal([]byte(content), cfg); err != nil {
+		t.Fatalf("Error parsing config: %s", err)
+	}
+	if err := cfg.Read.LoadCredentials(dir); err != nil {
+		t.Fatalf("Error loading credentials: %s", err)
+	}
+	if cfg.Read.BasicAuth.Password != "s3cr3t" {
+		t.Fatalf("Expected the password to be read from the file, got %q", string(cfg.Read.BasicAuth.Password))
+	}
+	if strings.Contains(cfg.String(), "s3cr3t") {
+		t.Fatalf("Expected the password to be hidden, got %s", cfg.String())
+	}
+
+	content = `
+read:
+  bearer_token: token
+  bearer_token_file: token`
+	if err := yaml.Unmarshal([]byte(content), &Config{}); err == nil {
+		t.Fatalf("Expected an error for both bearer_token and bearer_token_file")
+	}
+
+	content = `
+read:
+  tls_config:
+    ca_file: missing.pem`
+	cfg = &Config{}
+	if err := yaml.Unmarshal([]byte(content), cfg); err != nil {
+		t.Fatalf("Error parsing config: %s", err)
+	}
+	if err := cfg.Read.LoadCredentials(dir); err == nil {
+		t.Fatalf("Expected an error for a missing CA file")
+	}
+}
+
+func TestUnmarshalMaxFetchWorkers(t *testing.T) {
+	cfg := &Config{}
+	if err := yaml.Unmarshal([]byte("read:\n  max_fetch_workers: 3"), cfg); err != nil {
+		t.Fatalf("Error parsing config: %s", err)
+	}
+	if cfg.Read.MaxFetchWorkers != 3 {
+		t.Fatalf("Expected 3 fetch workers, got %d", cfg.Read.MaxFetchWorkers)
+	}
+
+	if err := yaml.Unmarshal([]byte("read:\n  max_fetch_workers: 0"), &Config{}); err == nil {
+		t.Fatalf("Expected an error for max_fetch_workers lower than 1")
+	}
+}
+
+func TestMergedTemplateData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "template_data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "data.yml"), []byte("site: paris\nregion: eu"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{}
+	content := `
+write:
+  template_data:
+    site: amsterdam
+    shared: yes
+  template_data_file: data.yml`
+	if err := yaml.Unmarshal([]byte(content), cfg); err != nil {
+		t.Fatalf("Error parsing config: %s", err)
+	}
+	if err := cfg.Write.LoadTemplateDataFile(dir); err != nil {
+		t.Fatalf("Error loading template data file: %s", err)
+	}
+	data, err := cfg.Write.MergedTemplateData()
+	if err != nil {
+		t.Fatalf("Error merging template data: %s", err)
+	}
+	if data["site"] != "paris" || data["region"] != "eu" || data["shared"] != true {
+		t.Fatalf("Expected the template data file to override template_data, got %v", data)
+	}
+	if cfg.Write.TemplateData["site"] != "amsterdam" {
+		t.Fatalf("Expected template_data to be left unchanged, got %v", cfg.Write.TemplateData)
+	}
+
+	cfg.Write.TemplateDataFile = filepath.Join(dir, "missing.yml")
+	if _, err := cfg.Write.MergedTemplateData(); err == nil {
+		t.Fatalf("Expected an error for a missing template data file")
+	}
+}
+
+func TestUnmarshalUDPMaxBytes(t *testing.T) {
+	cfg := &Config{}
+	if err := yaml.Unmarshal([]byte("write:\n  udp_max_bytes: 8192"), cfg); err != nil {
+		t.Fatalf("Error parsing config: %s", err)
+	}
+	if cfg.Write.UDPMaxBytes != 8192 {
+		t.Fatalf("Expected datagrams of 8192 bytes, got %d", cfg.Write.UDPMaxBytes)
+	}
+
+	if err := yaml.Unmarshal([]byte("write:\n  udp_max_bytes: 0"), &Config{}); err == nil {
+		t.Fatalf("Expected an error for udp_max_bytes lower than 1")
+	}
+}
+
+func TestUnmarshalURLList(t *testing.T) {
+	cfg := &Config{}
+	if err := yaml.Unmarshal([]byte("read:\n  url: http://graphite-web"), cfg); err != nil {
+		t.Fatalf("Error parsing config: %s", err)
+	}
+	if !reflect.DeepEqual(URLList{"http://graphite-web"}, cfg.Read.URL) {
+		t.Fatalf("Expected a single URL, got %v", cfg.Read.URL)
+	}
+
+	cfg = &Config{}
+	if err := yaml.Unmarshal([]byte("read:\n  url: [http://shard-1, http://shard-2]"), cfg); err != nil {
+		t.Fatalf("Error parsing config: %s", err)
+	}
+	if !reflect.DeepEqual(URLList{"http://shard-1", "http://shard-2"}, cfg.Read.URL) {
+		t.Fatalf("Expected two URLs, got %v", cfg.Read.URL)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2017 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+)
+
+const deadLetterQueueSize = 1024
+
+var discardedDeadLetters = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "remote_adapter_graphite",
+		Name:      "discarded_dead_letters_total",
+		Help:      "The total number of dropped samples not written to the dead-letter file because its queue was full.",
+	},
+)
+
+// deadLetter is a sample dropped on write along with the reason why.
+type deadLetter struct {
+	Sample *model.Sample `json:"sample"`
+	Reason string        `json:"reason"`
+}
+
+// deadLetterWriter appends dropped samples as JSON lines to a file.
+// Writes are queued and flushed asynchronously so they never block the
+// write path: when the queue is full, the dead letter is discarded.
+type deadLetterWriter struct {
+	file   *os.File
+	queue  chan *deadLetter
+	done   chan struct{}
+	logger log.Logger
+}
+
+func newDeadLetterWriter(filename string, logger log.Logger) (*deadLetterWriter, error) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := &deadLetterWriter{
+		file:   file,
+		queue:  make(chan *deadLetter, deadLetterQueueSize),
+		done:   make(chan struct{}),
+		logger: logger,
+	}
+	go w.run()
+	return w, nil
+}
+
+// Write queues a dropped sample. It is a no-op on a nil writer.
+func (w *deadLetterWriter) Write(s *model.Sample, reason string) {
+	if w == nil {
+		return
+	}
+	select {
+	case w.queue <- &deadLetter{Sample: s, Reason: reason}:
+	default:
+		discardedDeadLetters.Inc()
+	}
+}
+
+// Close flushes queued dead letters and closes the file.
+func (w *deadLetterWriter) Close() {
+	if w == nil {
+		return
+	}
+	close(w.queue)
+	<-w.done
+}
+
+func (w *deadLetterWriter) run() {
+	defer close(w.done)
+	defer w.file.Close()
+
+	encoder := json.NewEncoder(w.file)
+	for dl := range w.queue {
+		if err := encoder.Encode(dl); err != nil {
+			level.Warn(w.logger).Log(
+				"file", w.file.Name(), "err", err, "msg", "Error writing dead letter")
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2017 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeadLetterWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "dead.jsonl")
+
+	w, err := newDeadLetterWriter(filename, log.NewNopLogger())
+	require.NoError(t, err)
+	w.Write(&model.Sample{
+		Metric:    model.Metric{model.MetricNameLabel: "test", "owner": "team-X"},
+		Value:     model.SampleValue(math.NaN()),
+		Timestamp: model.Time(300000),
+	}, "invalid sample value")
+	w.Close()
+
+	content, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	expected := `{"sample":{"metric":{"__name__":"test","owner":"team-X"},"value":[300,"NaN"]},"reason":"invalid sample value"}` + "\n"
+	require.Equal(t, expected, string(content))
+}
+
+func TestNilDeadLetterWriter(t *testing.T) {
+	var w *deadLetterWriter
+	w.Write(&model.Sample{}, "ignored")
+	w.Close()
+}
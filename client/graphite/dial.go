@@ -0,0 +1,65 @@
+// Copyright 2017 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Dials to carbon are bounded across clients: writes in flight on a client
+// replaced by a config reload may dial alongside the new client.
+var (
+	dialSemaphoreLock sync.Mutex
+	dialSemaphore     chan struct{}
+)
+
+// setMaxConcurrentDials bounds the number of concurrent dials to carbon, a
+// zero max removes the bound.
+func setMaxConcurrentDials(max int) {
+	dialSemaphoreLock.Lock()
+	defer dialSemaphoreLock.Unlock()
+	if max <= 0 {
+		dialSemaphore = nil
+		return
+	}
+	if dialSemaphore == nil || cap(dialSemaphore) != max {
+		dialSemaphore = make(chan struct{}, max)
+	}
+}
+
+// dialCarbon dials carbon once a dial slot is available. Waiting for a slot
+// counts in the timeout.
+func dialCarbon(network, address string, timeout time.Duration) (net.Conn, error) {
+	dialSemaphoreLock.Lock()
+	semaphore := dialSemaphore
+	dialSemaphoreLock.Unlock()
+
+	if semaphore != nil {
+		begin := time.Now()
+		timer := time.NewTimer(timeout)
+		select {
+		case semaphore <- struct{}{}:
+			timer.Stop()
+		case <-timer.C:
+			return nil, fmt.Errorf("timed out after %s waiting to dial %s", timeout, address)
+		}
+		// Release the slot of the semaphore we acquired, even if it was replaced since.
+		defer func() { <-semaphore }()
+		timeout -= time.Since(begin)
+	}
+	return net.DialTimeout(network, address, timeout)
+}
@@ -0,0 +1,42 @@
+// Copyright 2017 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialCarbonMaxConcurrentDials(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	setMaxConcurrentDials(1)
+	defer setMaxConcurrentDials(0)
+
+	// Take the only dial slot, waiters time out.
+	dialSemaphore <- struct{}{}
+	_, err = dialCarbon("tcp", listener.Addr().String(), 10*time.Millisecond)
+	require.Error(t, err)
+
+	<-dialSemaphore
+	conn, err := dialCarbon("tcp", listener.Addr().String(), time.Second)
+	require.NoError(t, err)
+	conn.Close()
+	require.Len(t, dialSemaphore, 0)
+}
@@ -0,0 +1,105 @@
+// Copyright 2017 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defaultUnhealthyWindow is the window of the write failure ratio when
+// write.unhealthy_window is not set.
+const defaultUnhealthyWindow = 5 * time.Minute
+
+// writeHealth counts the successful and failed writes to carbon per second
+// over a sliding window.
+type writeHealth struct {
+	lock    sync.Mutex
+	window  time.Duration
+	buckets []writeHealthBucket
+}
+
+type writeHealthBucket struct {
+	second    int64
+	successes int
+	failures  int
+}
+
+func newWriteHealth(window time.Duration) *writeHealth {
+	if window <= 0 {
+		window = defaultUnhealthyWindow
+	}
+	return &writeHealth{window: window}
+}
+
+// record counts a write done at now.
+func (h *writeHealth) record(now time.Time, failed bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.prune(now)
+	second := now.Unix()
+	if len(h.buckets) == 0 || h.buckets[len(h.buckets)-1].second != second {
+		h.buckets = append(h.buckets, writeHealthBucket{second: second})
+	}
+	if failed {
+		h.buckets[len(h.buckets)-1].failures++
+	} else {
+		h.buckets[len(h.buckets)-1].successes++
+	}
+}
+
+// failureRatio returns the ratio of failed writes over the window, and the
+// number of writes it is computed from.
+func (h *writeHealth) failureRatio(now time.Time) (float64, int) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.prune(now)
+	successes, failures := 0, 0
+	for _, b := range h.buckets {
+		successes += b.successes
+		failures += b.failures
+	}
+	if successes+failures == 0 {
+		return 0, 0
+	}
+	return float64(failures) / float64(successes+failures), successes + failures
+}
+
+// prune drops the buckets older than the window. h.lock must be held.
+func (h *writeHealth) prune(now time.Time) {
+	oldest := now.Add(-h.window).Unix()
+	i := 0
+	for i < len(h.buckets) && h.buckets[i].second <= oldest {
+		i++
+	}
+	h.buckets = h.buckets[i:]
+}
+
+// Healthy implements the client.HealthChecker interface. The client is
+// unhealthy when the ratio of failed writes to carbon over the unhealthy
+// window exceeds the unhealthy threshold.
+func (c *Client) Healthy() error {
+	if c.cfg.Write.UnhealthyThreshold <= 0 || c.writeHealth == nil {
+		return nil
+	}
+	ratio, writes := c.writeHealth.failureRatio(time.Now())
+	if ratio > c.cfg.Write.UnhealthyThreshold {
+		return fmt.Errorf("%.0f%% of the %d writes to carbon failed over the last %s",
+			ratio*100, writes, c.writeHealth.window)
+	}
+	return nil
+}
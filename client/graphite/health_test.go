@@ -0,0 +1,57 @@
+// Copyright 2017 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"testing"
+	"time"
+
+	"github.com/criteo/graphite-remote-adapter/client/graphite/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteHealth(t *testing.T) {
+	h := newWriteHealth(time.Minute)
+	now := time.Unix(1000, 0)
+
+	ratio, writes := h.failureRatio(now)
+	require.Equal(t, 0.0, ratio)
+	require.Equal(t, 0, writes)
+
+	h.record(now, true)
+	h.record(now.Add(30*time.Second), false)
+	h.record(now.Add(30*time.Second), true)
+	h.record(now.Add(40*time.Second), true)
+	ratio, writes = h.failureRatio(now.Add(40 * time.Second))
+	require.Equal(t, 0.75, ratio)
+	require.Equal(t, 4, writes)
+
+	// The first failure is out of the window.
+	ratio, writes = h.failureRatio(now.Add(time.Minute))
+	require.InDelta(t, 2.0/3, ratio, 1e-9)
+	require.Equal(t, 3, writes)
+}
+
+func TestHealthy(t *testing.T) {
+	c := newTestWriteClient(config.WriteConfig{UnhealthyThreshold: 0.5})
+	c.writeHealth = newWriteHealth(time.Minute)
+	require.NoError(t, c.Healthy())
+
+	c.recordWrite(false)
+	c.recordWrite(true)
+	require.NoError(t, c.Healthy())
+
+	c.recordWrite(true)
+	require.Error(t, c.Healthy())
+}
@@ -0,0 +1,85 @@
+// Copyright 2017 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/criteo/graphite-remote-adapter/client/graphite/paths"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/model"
+
+	"golang.org/x/net/context"
+)
+
+// heartbeatPath is appended to the default prefix to build the path of the
+// heartbeat metric.
+const heartbeatPath = "remote_adapter.up"
+
+// startHeartbeat periodically writes the heartbeat metric to carbon until
+// stopHeartbeat is called.
+func (c *Client) startHeartbeat(interval time.Duration) {
+	c.heartbeatStop = make(chan struct{})
+	c.heartbeatDone = make(chan struct{})
+	go func() {
+		defer close(c.heartbeatDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.heartbeatStop:
+				return
+			case now := <-ticker.C:
+				if err := c.sendHeartbeat(now); err != nil {
+					level.Warn(c.writeLogger).Log(
+						"address", c.cfg.Write.CarbonAddress,
+						"err", err, "msg", "Error sending heartbeat to carbon")
+				}
+			}
+		}
+	}()
+}
+
+// stopHeartbeat stops the heartbeat, if started, and waits for it to return.
+func (c *Client) stopHeartbeat() {
+	if c.heartbeatStop == nil {
+		return
+	}
+	close(c.heartbeatStop)
+	<-c.heartbeatDone
+}
+
+func (c *Client) sendHeartbeat(now time.Time) error {
+	path := strings.Replace(heartbeatPath, paths.DefaultSeparator, c.format.NodeSeparator(), -1)
+	// A templated prefix is rendered without labels.
+	prefix, err := c.defaultPrefix.Render(model.Metric{}, c.templateData())
+	if err != nil {
+		return err
+	}
+	line := fmt.Sprintf("%s%s 1 %d%s", c.format.NormalizePrefix(prefix), path, now.Unix(), c.format.LineEnd())
+
+	// Written like any batch, so that it is acknowledged when expected.
+	buffers := []*bytes.Buffer{bytes.NewBufferString(line)}
+	if _, err := c.writeBuffers(context.Background(), c.cfg.Write.CarbonAddress, buffers); err != nil {
+		return err
+	}
+
+	c.carbonConLock.Lock()
+	defer c.carbonConLock.Unlock()
+	c.touchCarbon()
+	return nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2017 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/criteo/graphite-remote-adapter/client/graphite/config"
+	"github.com/criteo/graphite-remote-adapter/client/graphite/paths"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendHeartbeat(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	c := &Client{
+		writeLogger:  log.NewNopLogger(),
+		writeTimeout: time.Second,
+		cfg: &config.Config{
+			DefaultPrefix: "prometheus-prefix.",
+			Write: config.WriteConfig{
+				CarbonAddress:   listener.Addr().String(),
+				CarbonTransport: "tcp",
+			},
+		},
+		defaultPrefix: paths.LiteralPrefix("prometheus-prefix."),
+	}
+	defer c.Shutdown()
+
+	require.NoError(t, c.sendHeartbeat(time.Unix(1528819131, 0)))
+
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "prometheus-prefix.remote_adapter.up 1 1528819131\n", line)
+}
+
+func TestShutdownTwice(t *testing.T) {
+	c := &Client{writeLogger: log.NewNopLogger(), cfg: &config.Config{}}
+	c.startHeartbeat(time.Hour)
+	c.Shutdown()
+	c.Shutdown()
+}
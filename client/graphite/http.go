@@ -14,17 +14,172 @@
 package graphite
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	graphiteCfg "github.com/criteo/graphite-remote-adapter/client/graphite/config"
 	"github.com/criteo/graphite-remote-adapter/utils"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"golang.org/x/net/context"
 )
 
 // make it mockable in tests
 var (
-	fetchURL   = utils.FetchURL
-	prepareURL = utils.PrepareURL
+	fetchURL         = utils.FetchURL
+	prepareURL       = utils.PrepareURL
+	prepareURLValues = utils.PrepareURLValues
+)
+
+// defaultRetryBackoff is the delay before the first retry of a request to
+// graphite-web when graphite.read.retry_backoff isn't set.
+const defaultRetryBackoff = 100 * time.Millisecond
+
+// maxRetryBackoff bounds the exponential backoff between retries.
+const maxRetryBackoff = time.Minute
+
+var readRetries = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "remote_adapter_graphite",
+		Name:      "read_retries_total",
+		Help:      "The total number of requests to graphite-web retried, by outcome of the retry.",
+	},
+	[]string{"outcome"},
 )
 
+// fetch fetches u from graphite-web with graphite.read.http_method, retrying up to graphite.read.retry_count
+// times on network errors and 5xx responses. Retries are delayed by an
+// exponential backoff with jitter, and stop when the delay would exceed the
+// deadline of ctx.
+func (c *Client) fetch(ctx context.Context, u *url.URL) ([]byte, error) {
+	if c.httpClientErr != nil {
+		return nil, fmt.Errorf("graphite-web client not configured: %s", c.httpClientErr)
+	}
+	method := c.cfg.Read.HTTPMethod
+	body, err := fetchURL(ctx, c.httpClient, c.readLogger, method, u, c.cfg.Read.MaxRenderBytes)
+	backoff := c.cfg.Read.RetryBackoff
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	for retry := 0; retry < c.cfg.Read.RetryCount && isRetryable(err); retry++ {
+		if retry > 0 && backoff < maxRetryBackoff {
+			backoff *= 2
+		}
+		// Random delay between half and the whole backoff.
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			break
+		}
+		level.Debug(c.readLogger).Log(
+			"url", u, "err", err, "delay", delay, "msg", "Retrying request to graphite-web")
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		body, err = fetchURL(ctx, c.httpClient, c.readLogger, method, u, c.cfg.Read.MaxRenderBytes)
+		if err != nil {
+			readRetries.WithLabelValues("failure").Inc()
+		} else {
+			readRetries.WithLabelValues("success").Inc()
+		}
+	}
+	return body, err
+}
+
+// isRetryable tells whether a request to graphite-web which failed with err
+// may succeed when retried: network errors and 5xx responses are transient,
+// 4xx responses aren't.
+func isRetryable(err error) bool {
+	switch e := err.(type) {
+	case nil:
+		return false
+	case *utils.StatusError:
+		return e.StatusCode >= 500
+	case net.Error:
+		return true
+	}
+	return false
+}
+
+// newHTTPClient returns the client of the requests to graphite-web, setting
+// the TLS options and credentials of cfg on them. The TLS files are read
+// every time, so that rebuilding the client picks up rotated certificates.
+func newHTTPClient(cfg *graphiteCfg.ReadConfig) (*http.Client, error) {
+	tlsConfig, err := graphiteCfg.NewTLSConfig(&cfg.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	// Same as http.DefaultTransport, with our own TLS options.
+	var transport http.RoundTripper = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
+	}
+
+	var authorization graphiteCfg.Secret
+	if cfg.BasicAuth != nil {
+		credentials := cfg.BasicAuth.Username + ":" + string(cfg.BasicAuth.Password)
+		authorization = graphiteCfg.Secret("Basic " + base64.StdEncoding.EncodeToString([]byte(credentials)))
+	} else if cfg.BearerToken != "" {
+		authorization = "Bearer " + cfg.BearerToken
+	}
+
+	if authorization != "" {
+		transport = &authRoundTripper{authorization: authorization, next: transport}
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// authRoundTripper sets the Authorization header of requests. The header is
+// a Secret so that it is hidden when the client is dumped on the home page.
+type authRoundTripper struct {
+	authorization graphiteCfg.Secret
+	next          http.RoundTripper
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (rt *authRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Round trippers must not modify the requests they are given.
+	authReq := new(http.Request)
+	*authReq = *req
+	authReq.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		authReq.Header[k] = append([]string(nil), v...)
+	}
+	authReq.Header.Set("Authorization", string(rt.authorization))
+	return rt.next.RoundTrip(authReq)
+}
+
+// CloseIdleConnections lets http.Client.CloseIdleConnections reach the
+// wrapped transport.
+func (rt *authRoundTripper) CloseIdleConnections() {
+	if ci, ok := rt.next.(interface{ CloseIdleConnections() }); ok {
+		ci.CloseIdleConnections()
+	}
+}
+
 // ExpandResponse is a parsed response of graphite expand endpoint.
 type ExpandResponse struct {
 	Results []string `yaml:"results,omitempty" json:"results,omitempty"`
@@ -47,17 +202,92 @@ type Datapoint struct {
 type Tags map[string]string
 
 // UnmarshalJSON unmarshals a Datapoint from json
+// Values which are not numbers, including strings such as "NaN", are treated
+// as null.
 func (d *Datapoint) UnmarshalJSON(b []byte) error {
-	var x []*interface{}
+	var x []interface{}
 	err := json.Unmarshal(b, &x)
 	if err != nil {
 		return err
 	}
-	if x[0] != nil {
-		val := new(float64)
-		*val = (*x[0]).(float64)
-		d.Value = val
+	if len(x) != 2 {
+		return fmt.Errorf("invalid datapoint %s: expected [value, timestamp]", b)
+	}
+
+	if v, ok := x[0].(float64); ok {
+		d.Value = &v
+	}
+
+	timestamp, ok := x[1].(float64)
+	if !ok {
+		return fmt.Errorf("invalid datapoint %s: timestamp is not a number", b)
 	}
-	d.Timestamp = int64((*x[1]).(float64))
+	d.Timestamp = int64(timestamp)
 	return nil
 }
+
+// csvTimeLayout is the layout of the timestamps of the CSV render format.
+const csvTimeLayout = "2006-01-02 15:04:05"
+
+// parseRenderCSV parses a response of the render endpoint in the CSV format,
+// made of target,timestamp,value rows, into one RenderResponse per target in
+// order of appearance. Timestamps are either dates, read as UTC, or Unix
+// timestamps. Empty values are null datapoints. The tags of tagged series are
+// parsed from their name, e.g. name;tag=value.
+func parseRenderCSV(body []byte) ([]RenderResponse, error) {
+	reader := csv.NewReader(bytes.NewReader(body))
+	reader.FieldsPerRecord = 3
+	renderResponses := make([]RenderResponse, 0)
+	indexes := make(map[string]int)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		target, timestamp, value := record[0], record[1], record[2]
+		d := &Datapoint{}
+		if t, err := time.Parse(csvTimeLayout, timestamp); err == nil {
+			d.Timestamp = t.Unix()
+		} else if d.Timestamp, err = strconv.ParseInt(timestamp, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q of target %s", timestamp, target)
+		}
+		if value != "" {
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q of target %s", value, target)
+			}
+			d.Value = &f
+		}
+
+		i, ok := indexes[target]
+		if !ok {
+			i = len(renderResponses)
+			indexes[target] = i
+			renderResponses = append(renderResponses, RenderResponse{Target: target, Tags: tagsFromName(target)})
+		}
+		renderResponses[i].Datapoints = append(renderResponses[i].Datapoints, d)
+	}
+	return renderResponses, nil
+}
+
+// tagsFromName returns the tags of a tagged series name, e.g. name;tag=value,
+// including the name tag like the JSON render format, or nil if untagged.
+func tagsFromName(name string) Tags {
+	nodes := strings.Split(name, ";")
+	if len(nodes) == 1 {
+		return nil
+	}
+	tags := Tags{"name": nodes[0]}
+	for _, node := range nodes[1:] {
+		kv := strings.SplitN(node, "=", 2)
+		if len(kv) != 2 {
+			return nil
+		}
+		tags[kv[0]] = kv[1]
+	}
+	return tags
+}
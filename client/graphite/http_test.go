@@ -0,0 +1,257 @@
+// Copyright 2017 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/criteo/graphite-remote-adapter/client/graphite/config"
+	"github.com/criteo/graphite-remote-adapter/utils"
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"golang.org/x/net/context"
+)
+
+func TestNewHTTPClientAuthorization(t *testing.T) {
+	var tests = []struct {
+		name     string
+		cfg      config.ReadConfig
+		expected string
+	}{
+		{"none", config.ReadConfig{}, ""},
+		{
+			"basic auth",
+			config.ReadConfig{BasicAuth: &config.BasicAuth{Username: "user", Password: "pass"}},
+			"Basic dXNlcjpwYXNz",
+		},
+		{"bearer token", config.ReadConfig{BearerToken: "token"}, "Bearer token"},
+	}
+
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := newHTTPClient(&test.cfg)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		resp.Body.Close()
+		if authorization != test.expected {
+			t.Errorf("%s: expected Authorization %q, got %q", test.name, test.expected, authorization)
+		}
+		if req.Header.Get("Authorization") != "" {
+			t.Errorf("%s: the original request was modified", test.name)
+		}
+	}
+}
+
+func TestFetchPOST(t *testing.T) {
+	var method, query, contentType string
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, query, contentType = r.Method, r.URL.RawQuery, r.Header.Get("Content-Type")
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		form = r.PostForm
+		w.Write([]byte("[]"))
+	}))
+	defer server.Close()
+
+	c := &Client{
+		cfg:        &config.Config{Read: config.ReadConfig{HTTPMethod: config.HTTPMethodPOST}},
+		readLogger: log.NewNopLogger(),
+	}
+	u, _ := utils.PrepareURLValues(server.URL, "/render/", url.Values{"format": {"json"}, "target": {"a", "b"}})
+	body, err := c.fetch(context.Background(), u)
+	if err != nil || string(body) != "[]" {
+		t.Fatalf("Expected an empty render, got %s (err: %v)", body, err)
+	}
+
+	if method != "POST" || query != "" || contentType != "application/x-www-form-urlencoded" {
+		t.Errorf("Expected a form POST without query, got %s %q with %q", method, query, contentType)
+	}
+	expected := url.Values{"format": {"json"}, "target": {"a", "b"}}
+	if !reflect.DeepEqual(expected, form) {
+		t.Errorf("Expected form %v, got %v", expected, form)
+	}
+}
+
+func TestNewHTTPClientTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	get := func(cfg *config.ReadConfig) error {
+		client, err := newHTTPClient(cfg)
+		if err != nil {
+			return err
+		}
+		defer client.CloseIdleConnections()
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	if err := get(&config.ReadConfig{}); err == nil {
+		t.Errorf("Expected the self-signed certificate of the server to be rejected")
+	}
+
+	cfg := &config.ReadConfig{TLSConfig: config.TLSConfig{InsecureSkipVerify: true}}
+	if err := get(cfg); err != nil {
+		t.Errorf("Expected insecure_skip_verify to accept the server, got %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The certificate of httptest servers is valid for example.com.
+	cfg = &config.ReadConfig{TLSConfig: config.TLSConfig{CAFile: caFile, ServerName: "example.com"}}
+	if err := get(cfg); err != nil {
+		t.Errorf("Expected the server to be verified with ca_file, got %s", err)
+	}
+
+	cfg = &config.ReadConfig{TLSConfig: config.TLSConfig{CAFile: filepath.Join(dir, "missing.pem")}}
+	if _, err := newHTTPClient(cfg); err == nil {
+		t.Errorf("Expected an error for a missing CA file")
+	}
+}
+
+func TestFetchRetries(t *testing.T) {
+	defer func() { fetchURL = utils.FetchURL }()
+	var errs []error
+	calls := 0
+	fetchURL = func(ctx context.Context, client *http.Client, l log.Logger, method string, u *url.URL, maxBytes int64) ([]byte, error) {
+		calls++
+		if len(errs) == 0 {
+			return []byte("ok"), nil
+		}
+		err := errs[0]
+		errs = errs[1:]
+		return nil, err
+	}
+	unavailable := &utils.StatusError{StatusCode: 503, Status: "503 Service Unavailable"}
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+
+	c := &Client{
+		cfg:        &config.Config{Read: config.ReadConfig{RetryCount: 2, RetryBackoff: time.Millisecond}},
+		readLogger: log.NewNopLogger(),
+	}
+	u, _ := url.Parse("http://fakeHost:6666/render/")
+
+	succeeded := testutil.ToFloat64(readRetries.WithLabelValues("success"))
+	errs = []error{unavailable, reset}
+	body, err := c.fetch(context.Background(), u)
+	if err != nil || string(body) != "ok" || calls != 3 {
+		t.Errorf("Expected a success after 2 retries, got %q, %v after %d calls", body, err, calls)
+	}
+	if retries := testutil.ToFloat64(readRetries.WithLabelValues("success")) - succeeded; retries != 1 {
+		t.Errorf("Expected 1 successful retry, got %v", retries)
+	}
+
+	// Retries are exhausted.
+	calls = 0
+	errs = []error{unavailable, unavailable, unavailable}
+	if _, err := c.fetch(context.Background(), u); err != unavailable || calls != 3 {
+		t.Errorf("Expected %v after 3 calls, got %v after %d calls", unavailable, err, calls)
+	}
+
+	// 4xx responses are not retried.
+	calls = 0
+	notFound := &utils.StatusError{StatusCode: 404, Status: "404 Not Found"}
+	errs = []error{notFound}
+	if _, err := c.fetch(context.Background(), u); err != notFound || calls != 1 {
+		t.Errorf("Expected %v after 1 call, got %v after %d calls", notFound, err, calls)
+	}
+
+	// Retries don't outlast the deadline of the context.
+	calls = 0
+	c.cfg.Read.RetryBackoff = time.Hour
+	errs = []error{unavailable, unavailable}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := c.fetch(ctx, u); err != unavailable || calls != 1 {
+		t.Errorf("Expected %v after 1 call, got %v after %d calls", unavailable, err, calls)
+	}
+}
+
+func TestFetchWithoutHTTPClient(t *testing.T) {
+	defer func() { fetchURL = utils.FetchURL }()
+	fetchURL = func(ctx context.Context, client *http.Client, l log.Logger, method string, u *url.URL, maxBytes int64) ([]byte, error) {
+		t.Errorf("Expected no request without a configured client, got one to %s", u)
+		return nil, nil
+	}
+
+	c := &Client{
+		cfg:           &config.Config{},
+		readLogger:    log.NewNopLogger(),
+		httpClientErr: errors.New("unable to read CA file"),
+	}
+	u, _ := url.Parse("http://fakeHost:6666/render/")
+	if _, err := c.fetch(context.Background(), u); err == nil {
+		t.Errorf("Expected an error without a configured client")
+	}
+}
+
+func TestFetchWithMaxRenderBytes(t *testing.T) {
+	defer func() { fetchURL = utils.FetchURL }()
+	var fetchedMaxBytes int64
+	fetchURL = func(ctx context.Context, client *http.Client, l log.Logger, method string, u *url.URL, maxBytes int64) ([]byte, error) {
+		fetchedMaxBytes = maxBytes
+		return []byte("ok"), nil
+	}
+
+	c := &Client{
+		cfg:        &config.Config{Read: config.ReadConfig{MaxRenderBytes: 1024}},
+		readLogger: log.NewNopLogger(),
+	}
+	u, _ := url.Parse("http://fakeHost:6666/render/")
+	if _, err := c.fetch(context.Background(), u); err != nil {
+		t.Fatal(err)
+	}
+	if fetchedMaxBytes != 1024 {
+		t.Errorf("Expected responses to be limited to %d bytes, got %d", 1024, fetchedMaxBytes)
+	}
+}
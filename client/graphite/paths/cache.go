@@ -1,9 +1,14 @@
 package paths
 
 import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/patrickmn/go-cache"
+	"github.com/prometheus/common/model"
 )
 
 var (
@@ -16,3 +21,86 @@ func InitPathsCache(pathsCacheTTL time.Duration, pathsCachePurgeInterval time.Du
 	pathsCache = cache.New(pathsCacheTTL, pathsCachePurgeInterval)
 	pathsCacheEnabled = true
 }
+
+// DisablePathsCache disables the cache for the paths.
+func DisablePathsCache() {
+	pathsCache = nil
+	pathsCacheEnabled = false
+}
+
+// FlushPathsCache removes all the entries of the paths cache, e.g. when the
+// template data the paths were rendered with changes.
+func FlushPathsCache() {
+	if c := pathsCache; c != nil {
+		c.Flush()
+	}
+}
+
+// pathsCacheKey returns the key of the paths of a metric in the paths cache.
+// The format and prefix may be set per request, they are part of the key.
+// Templated prefixes are told apart from literal ones holding the same text.
+func pathsCacheKey(formatType FormatType, prefix Prefix, fingerprint model.Fingerprint) string {
+	return fmt.Sprintf("%d;%t;%s;%s", formatType, prefix.Templated(), prefix, fingerprint)
+}
+
+// CachedPaths is an entry of the paths cache.
+type CachedPaths struct {
+	Format      FormatType `json:"format"`
+	Prefix      string     `json:"prefix"`
+	Templated   bool       `json:"templated,omitempty"`
+	Fingerprint string     `json:"fingerprint"`
+	Paths       []string   `json:"paths"`
+	// Expiration is zero for entries which don't expire.
+	Expiration time.Time `json:"expiration"`
+}
+
+// PathsCacheEntries returns the unexpired entries of the paths cache, sorted
+// by fingerprint, prefix and format. It returns nil when the cache is disabled.
+func PathsCacheEntries() []CachedPaths {
+	c := pathsCache
+	if c == nil {
+		return nil
+	}
+
+	entries := []CachedPaths{}
+	for key, item := range c.Items() {
+		// The prefix may hold ";", the other fields can't.
+		fields := strings.SplitN(key, ";", 3)
+		if len(fields) < 3 {
+			continue
+		}
+		last := strings.LastIndex(fields[2], ";")
+		if last < 0 {
+			continue
+		}
+		formatType, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		templated, err := strconv.ParseBool(fields[1])
+		if err != nil {
+			continue
+		}
+		entry := CachedPaths{
+			Format:      FormatType(formatType),
+			Prefix:      fields[2][:last],
+			Templated:   templated,
+			Fingerprint: fields[2][last+1:],
+			Paths:       item.Object.([]string),
+		}
+		if item.Expiration > 0 {
+			entry.Expiration = time.Unix(0, item.Expiration)
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Fingerprint != entries[j].Fingerprint {
+			return entries[i].Fingerprint < entries[j].Fingerprint
+		}
+		if entries[i].Prefix != entries[j].Prefix {
+			return entries[i].Prefix < entries[j].Prefix
+		}
+		return entries[i].Format < entries[j].Format
+	})
+	return entries
+}
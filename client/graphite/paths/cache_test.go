@@ -0,0 +1,51 @@
+package paths
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathsCacheEntries(t *testing.T) {
+	require.Nil(t, PathsCacheEntries())
+
+	InitPathsCache(time.Hour, time.Hour)
+	defer DisablePathsCache()
+	require.Empty(t, PathsCacheEntries())
+
+	m := model.Metric{model.MetricNameLabel: "test", "owner": "team-X"}
+	_, err := pathsFromMetric(m, Format{Type: FormatCarbon}, LiteralPrefix("pre;fix."), nil, nil)
+	require.NoError(t, err)
+
+	entries := PathsCacheEntries()
+	require.Len(t, entries, 1)
+	require.Equal(t, FormatType(FormatCarbon), entries[0].Format)
+	require.Equal(t, "pre;fix.", entries[0].Prefix)
+	require.Equal(t, m.Fingerprint().String(), entries[0].Fingerprint)
+	require.Equal(t, []string{"pre;fix.test.owner.team-X"}, entries[0].Paths)
+	require.True(t, entries[0].Expiration.After(time.Now()))
+}
+
+// Series silenced by a rule are cached as nil paths, which are cache hits too,
+// so that their rules aren't evaluated again until the entry expires.
+func TestPathsCacheSilencedSeries(t *testing.T) {
+	InitPathsCache(time.Hour, time.Hour)
+	defer DisablePathsCache()
+
+	m := model.Metric{model.MetricNameLabel: "test", "owner": "team-Z"}
+	paths, err := pathsFromMetric(m, Format{Type: FormatCarbon}, LiteralPrefix("prefix."), testConfig.Write.Rules, testConfig.Write.TemplateData)
+	require.NoError(t, err)
+	require.Empty(t, paths)
+
+	entries := PathsCacheEntries()
+	require.Len(t, entries, 1)
+	require.Empty(t, entries[0].Paths)
+
+	// The silenced series is a cache hit: without rules, the default path
+	// would be written otherwise.
+	paths, err = pathsFromMetric(m, Format{Type: FormatCarbon}, LiteralPrefix("prefix."), nil, nil)
+	require.NoError(t, err)
+	require.Empty(t, paths)
+}
@@ -1,5 +1,19 @@
 package paths
 
+import (
+	"fmt"
+	"strings"
+
+	graphite_tmpl "github.com/criteo/graphite-remote-adapter/client/graphite/template"
+	"github.com/prometheus/common/model"
+)
+
+// DefaultSeparator separates the nodes of graphite paths.
+const DefaultSeparator = "."
+
+// DefaultLineTerminator ends the lines of the carbon plaintext protocol.
+const DefaultLineTerminator = "\n"
+
 // FormatType describesCarbon format type
 type FormatType int
 
@@ -8,6 +22,165 @@ type FormatType int
 type Format struct {
 	Type         FormatType
 	FilteredTags []string // Only for Graphite Tag (Only used for FormatCarbonTags)
+	// SanitizeTagKeys replaces characters not allowed in tag keys.
+	// Only used for FormatCarbonTags and FormatCarbonOpenMetrics.
+	SanitizeTagKeys bool
+	// NameDelimiter occurrences in metric names are replaced by NameReplacement,
+	// e.g. to build nested nodes out of "http_requests_total".
+	NameDelimiter   string
+	NameReplacement string
+	// NameLabelTag is the tag key used for labels called "name", which
+	// would otherwise override the graphite metric name.
+	// Only used for FormatCarbonTags and FormatCarbonOpenMetrics.
+	NameLabelTag string
+	// SchemaVersion is inserted as a node right after the prefix of default paths.
+	SchemaVersion string
+	// LeadingLabels are placed, in order, before the other labels of default
+	// paths, which are sorted alphabetically.
+	LeadingLabels []string
+	// Separator separates the nodes of default paths, DefaultSeparator if empty.
+	Separator string
+	// LineTerminator ends datapoint lines, DefaultLineTerminator if empty.
+	LineTerminator string
+	// AggregationLabel holds the carbon aggregation method of metrics, e.g.
+	// sum. Its value is appended to default paths as a last node, or as the
+	// aggregation tag when using tags, instead of being written as a label.
+	AggregationLabel string
+	// ClampFutureToNow writes samples timestamped in the future at the
+	// current time, carbon would reject or mishandle them otherwise.
+	ClampFutureToNow bool
+	// GraphiteTagEscaping escapes tag values with the graphite tag rules
+	// instead of the path node ones, see graphite_tmpl.EscapeTagValue.
+	// Only used for FormatCarbonTags and FormatCarbonOpenMetrics.
+	GraphiteTagEscaping bool
+	// PrefixSeparator ensures that the prefix of default paths is followed by
+	// exactly one separator, whether or not it ends with one.
+	PrefixSeparator bool
+	// AggregationTag is the tag holding the aggregation method of tagged
+	// series, defaultAggregationTag if empty.
+	// Only used for FormatCarbonTags and FormatCarbonOpenMetrics.
+	AggregationTag string
+}
+
+// defaultAggregationTag holds the aggregation method of tagged series.
+const defaultAggregationTag = "aggregation"
+
+// aggregationTag returns the tag holding the aggregation method of tagged series.
+func (f Format) aggregationTag() string {
+	if f.AggregationTag == "" {
+		return defaultAggregationTag
+	}
+	return f.AggregationTag
+}
+
+// tagKey returns the key of the tag of label k.
+func (f Format) tagKey(k string) string {
+	if k == graphiteNameTag && f.NameLabelTag != "" {
+		return f.NameLabelTag
+	}
+	if f.SanitizeTagKeys {
+		return sanitizeTagKey(k)
+	}
+	return k
+}
+
+// isTag tells whether label k is written as a tag rather than as path nodes.
+func (f Format) isTag(k string) bool {
+	if f.Type == FormatCarbonTags && len(f.FilteredTags) > 0 {
+		for _, filteredTagName := range f.FilteredTags {
+			if filteredTagName == k {
+				return true
+			}
+		}
+		return false
+	}
+	return f.Type == FormatCarbonTags || f.Type == FormatCarbonOpenMetrics
+}
+
+// checkAggregationTag returns an error when a label of m would be written as
+// a tag with the key of the aggregation tag of m, which graphite would merge.
+func (f Format) checkAggregationTag(m model.Metric) error {
+	if f.AggregationLabel == "" || m[model.LabelName(f.AggregationLabel)] == "" {
+		return nil
+	}
+	tag := f.aggregationTag()
+	for l := range m {
+		k := string(l)
+		if l == model.MetricNameLabel || k == f.AggregationLabel || !f.isTag(k) {
+			continue
+		}
+		if f.tagKey(k) == tag {
+			return fmt.Errorf("label %s collides with the %s aggregation tag", k, tag)
+		}
+	}
+	return nil
+}
+
+// NodeSeparator returns the separator of the nodes of default paths.
+func (f Format) NodeSeparator() string {
+	if f.Separator == "" {
+		return DefaultSeparator
+	}
+	return f.Separator
+}
+
+// NormalizePrefix returns prefix ending with exactly one node separator with
+// PrefixSeparator, whether or not it was configured with a trailing one, or
+// else prefix unchanged. An empty prefix stays empty.
+func (f Format) NormalizePrefix(prefix string) string {
+	if prefix == "" || !f.PrefixSeparator {
+		return prefix
+	}
+	sep := f.NodeSeparator()
+	for strings.HasSuffix(prefix, sep) {
+		prefix = strings.TrimSuffix(prefix, sep)
+	}
+	return prefix + sep
+}
+
+// LineEnd returns the terminator of datapoint lines.
+func (f Format) LineEnd() string {
+	if f.LineTerminator == "" {
+		return DefaultLineTerminator
+	}
+	return f.LineTerminator
+}
+
+// escapeSeparator percent-encodes the node separator in an escaped value, so
+// that the value stays in a single node. Dots are already escaped.
+func (f Format) escapeSeparator(v string) string {
+	sep := f.NodeSeparator()
+	if sep == DefaultSeparator {
+		return v
+	}
+	var escaped strings.Builder
+	for i := 0; i < len(sep); i++ {
+		fmt.Fprintf(&escaped, "%%%X", sep[i])
+	}
+	return strings.Replace(v, sep, escaped.String(), -1)
+}
+
+// LabelNodes returns the nodes of a label in default paths, the escaped name
+// and value each preceded by the node separator.
+func (f Format) LabelNodes(name string, value string) string {
+	sep := f.NodeSeparator()
+	return sep + f.escapeSeparator(name) + sep + f.escapeSeparator(graphite_tmpl.Escape(value))
+}
+
+// SplitName applies the name delimiter replacement to a metric name.
+func (f Format) SplitName(name string) string {
+	if f.NameDelimiter == "" {
+		return name
+	}
+	return strings.Replace(name, f.NameDelimiter, f.NameReplacement, -1)
+}
+
+// JoinName reverts SplitName on a metric name read back from Graphite.
+func (f Format) JoinName(name string) string {
+	if f.NameDelimiter == "" {
+		return name
+	}
+	return strings.Replace(name, f.NameReplacement, f.NameDelimiter, -1)
 }
 
 // Format values.
@@ -16,3 +189,26 @@ const (
 	FormatCarbonTags                   = 2
 	FormatCarbonOpenMetrics            = 3
 )
+
+// escapeTagValue escapes a label value written as a tag. Values escaped as
+// path nodes also get the characters reserved by graphite tags encoded, which
+// are a ';' anywhere and a leading '~'.
+func (f Format) escapeTagValue(v string) string {
+	if f.GraphiteTagEscaping {
+		return graphite_tmpl.EscapeTagValue(v)
+	}
+	escaped := strings.Replace(graphite_tmpl.Escape(v), ";", "%3B", -1)
+	if strings.HasPrefix(escaped, "~") {
+		escaped = "%7E" + escaped[1:]
+	}
+	return escaped
+}
+
+// unescapeTagValue returns the label value of a tag value read from graphite.
+// Values escaped as path nodes are read as is.
+func (f Format) unescapeTagValue(v string) string {
+	if f.GraphiteTagEscaping {
+		return graphite_tmpl.UnescapeTagValue(v)
+	}
+	return v
+}
@@ -0,0 +1,57 @@
+package paths
+
+import (
+	"strings"
+
+	"github.com/criteo/graphite-remote-adapter/client/graphite/config"
+	"github.com/prometheus/common/model"
+)
+
+// Prefix is the prefix of default paths. Prefixes from the configuration may
+// be templates, rendered against the labels of each metric with the same
+// context as rule templates. Prefixes from requests are always used as is.
+type Prefix struct {
+	value string
+	tmpl  config.Template
+}
+
+// LiteralPrefix returns a prefix used as is, even if it holds template actions.
+func LiteralPrefix(prefix string) Prefix {
+	return Prefix{value: prefix}
+}
+
+// ParsePrefix returns prefix parsed as a template when it contains template
+// actions, or as a literal prefix otherwise.
+func ParsePrefix(prefix string) (Prefix, error) {
+	if !strings.Contains(prefix, "{{") {
+		return LiteralPrefix(prefix), nil
+	}
+	tmpl, err := config.ParseTemplate(prefix)
+	if err != nil {
+		return Prefix{}, err
+	}
+	return Prefix{value: prefix, tmpl: tmpl}, nil
+}
+
+// rulePrefix returns the prefix set by rule, parsed when the rule was loaded.
+func rulePrefix(rule *config.Rule) Prefix {
+	return Prefix{value: rule.Prefix, tmpl: rule.PrefixTmpl}
+}
+
+// String returns the prefix as it was defined.
+func (p Prefix) String() string {
+	return p.value
+}
+
+// Templated tells whether the prefix is rendered as a template.
+func (p Prefix) Templated() bool {
+	return p.tmpl != config.Template{}
+}
+
+// Render returns the prefix of the default path of m.
+func (p Prefix) Render(m model.Metric, templateData map[string]interface{}) (string, error) {
+	if !p.Templated() {
+		return p.value, nil
+	}
+	return executeTemplate(p.tmpl, loadContext(templateData, m))
+}
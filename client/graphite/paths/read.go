@@ -10,8 +10,24 @@ import (
 	"github.com/prometheus/prometheus/prompb"
 )
 
-// MetricLabelsFromTags provides labels for given tags.
-func MetricLabelsFromTags(tags map[string]string, prefix string) ([]*prompb.Label, error) {
+// graphiteNameTag is the tag holding the metric name in Graphite.
+const graphiteNameTag = "name"
+
+// TypeLabel holds the type of a metric, e.g. "counter".
+const TypeLabel = "__type__"
+
+// typeSuffixes are the metric name suffixes from which types are inferred.
+var typeSuffixes = []struct {
+	suffix     string
+	metricType string
+}{
+	{"_total", "counter"},
+	{"_bucket", "histogram"},
+}
+
+// MetricLabelsFromTags provides labels for given tags, written with format.
+// If set, the format.NameLabelTag tag is read back as the "name" label.
+func MetricLabelsFromTags(tags map[string]string, prefix string, format Format) ([]*prompb.Label, error) {
 	// It translates Graphite tags directly into label and values.
 	var labels []*prompb.Label
 	var names []string
@@ -24,25 +40,28 @@ func MetricLabelsFromTags(tags map[string]string, prefix string) ([]*prompb.Labe
 
 	for _, k := range names {
 		v := tags[k]
-		if k == "name" {
+		if k == graphiteNameTag {
 			v = strings.TrimPrefix(v, prefix)
 			labels = append(labels, &prompb.Label{Name: model.MetricNameLabel, Value: v})
+		} else if k == format.NameLabelTag {
+			labels = append(labels, &prompb.Label{Name: graphiteNameTag, Value: format.unescapeTagValue(v)})
 		} else {
-			labels = append(labels, &prompb.Label{Name: k, Value: v})
+			labels = append(labels, &prompb.Label{Name: k, Value: format.unescapeTagValue(v)})
 		}
 	}
 
 	return labels, nil
 }
 
-// MetricLabelsFromPath provides labels from given path.
-func MetricLabelsFromPath(path string, prefix string) ([]*prompb.Label, error) {
+// MetricLabelsFromPath provides labels from given path, whose nodes are
+// separated by separator.
+func MetricLabelsFromPath(path string, prefix string, separator string) ([]*prompb.Label, error) {
 	// It uses the "default" write format to read back (See defaultPath function)
 	// <prefix.><__name__.>[<labelName>.<labelValue>. for each label in alphabetic order]
 	var labels []*prompb.Label
 	cleanedPath := strings.TrimPrefix(path, prefix)
-	cleanedPath = strings.Trim(cleanedPath, ".")
-	nodes := strings.Split(cleanedPath, ".")
+	cleanedPath = strings.TrimPrefix(strings.TrimSuffix(cleanedPath, separator), separator)
+	nodes := strings.Split(cleanedPath, separator)
 	labels = append(labels, &prompb.Label{Name: model.MetricNameLabel, Value: nodes[0]})
 	if len(nodes[1:])%2 != 0 {
 		err := fmt.Errorf("Unable to parse labels from path: odd number of nodes in path")
@@ -53,3 +72,32 @@ func MetricLabelsFromPath(path string, prefix string) ([]*prompb.Label, error) {
 	}
 	return labels, nil
 }
+
+// WithMetricType adds the TypeLabel label to labels without one. The type is
+// looked up by metric name in types, or else inferred from the suffix of the
+// name if infer is set. Labels are unchanged when the type is unknown.
+func WithMetricType(labels []*prompb.Label, types map[string]string, infer bool) []*prompb.Label {
+	name := ""
+	for _, l := range labels {
+		switch l.Name {
+		case TypeLabel:
+			return labels
+		case model.MetricNameLabel:
+			name = l.Value
+		}
+	}
+
+	metricType, ok := types[name]
+	if !ok && infer {
+		for _, s := range typeSuffixes {
+			if strings.HasSuffix(name, s.suffix) {
+				metricType = s.metricType
+				break
+			}
+		}
+	}
+	if metricType == "" {
+		return labels
+	}
+	return append(labels, &prompb.Label{Name: TypeLabel, Value: metricType})
+}
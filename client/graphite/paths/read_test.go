@@ -1,6 +1,7 @@
 package paths
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/prometheus/common/model"
@@ -15,7 +16,7 @@ func TestMetricLabelsFromPath(t *testing.T) {
 		&prompb.Label{Name: model.MetricNameLabel, Value: "test"},
 		&prompb.Label{Name: "owner", Value: "team-X"},
 	}
-	actualLabels, _ := MetricLabelsFromPath(path, prefix)
+	actualLabels, _ := MetricLabelsFromPath(path, prefix, DefaultSeparator)
 	require.Equal(t, expectedLabels, actualLabels)
 }
 func TestMetricLabelsFromSpecialPath(t *testing.T) {
@@ -26,6 +27,98 @@ func TestMetricLabelsFromSpecialPath(t *testing.T) {
 		&prompb.Label{Name: "owner", Value: "team-Y"},
 		&prompb.Label{Name: "interface", Value: "Hu0/0/1/3.99"},
 	}
-	actualLabels, _ := MetricLabelsFromPath(path, prefix)
+	actualLabels, _ := MetricLabelsFromPath(path, prefix, DefaultSeparator)
 	require.Equal(t, expectedLabels, actualLabels)
 }
+
+func TestMetricLabelsFromWrittenTags(t *testing.T) {
+	for _, tc := range []struct {
+		metric model.Metric
+		format Format
+	}{
+		{
+			metric: model.Metric{model.MetricNameLabel: "test", "owner": "team-X", "name": "foo"},
+			format: Format{Type: FormatCarbonTags, NameLabelTag: "_prom_name"},
+		},
+		{
+			metric: model.Metric{model.MetricNameLabel: "test", "owner": "~team;X 100%", "url": "http://example.org/a.b"},
+			format: Format{Type: FormatCarbonTags, GraphiteTagEscaping: true},
+		},
+	} {
+		s := &model.Sample{Metric: tc.metric, Value: 1}
+		prefix := "prometheus-prefix."
+		datapoints, err := ToDatapoints(s, tc.format, LiteralPrefix(prefix), nil, nil)
+		require.NoError(t, err)
+		require.Len(t, datapoints, 1)
+
+		// Carbon stores the path root as the name tag, see TaggedSeries.parse.
+		path := strings.Fields(datapoints[0])[0]
+		nodes := strings.Split(path, ";")
+		tags := map[string]string{"name": nodes[0]}
+		for _, tag := range nodes[1:] {
+			kv := strings.SplitN(tag, "=", 2)
+			tags[kv[0]] = kv[1]
+		}
+
+		labels, err := MetricLabelsFromTags(tags, prefix, tc.format)
+		require.NoError(t, err)
+		actual := model.Metric{}
+		for _, l := range labels {
+			actual[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+		}
+		require.Equal(t, s.Metric, actual)
+	}
+}
+
+func TestMetricLabelsFromTagsWithNameLabel(t *testing.T) {
+	tags := map[string]string{
+		"name":       "prometheus-prefix.test",
+		"owner":      "team-X",
+		"_prom_name": "foo",
+	}
+	prefix := "prometheus-prefix."
+	expectedLabels := []*prompb.Label{
+		&prompb.Label{Name: "name", Value: "foo"},
+		&prompb.Label{Name: model.MetricNameLabel, Value: "test"},
+		&prompb.Label{Name: "owner", Value: "team-X"},
+	}
+	actualLabels, _ := MetricLabelsFromTags(tags, prefix, Format{NameLabelTag: "_prom_name"})
+	require.Equal(t, expectedLabels, actualLabels)
+}
+
+func TestMetricLabelsFromPathWithSeparator(t *testing.T) {
+	path := "prometheus-prefix|test:metric|owner|team%2FX|path|a%7Cb"
+	prefix := "prometheus-prefix|"
+	expectedLabels := []*prompb.Label{
+		&prompb.Label{Name: model.MetricNameLabel, Value: "test:metric"},
+		&prompb.Label{Name: "owner", Value: "team/X"},
+		&prompb.Label{Name: "path", Value: "a|b"},
+	}
+	actualLabels, err := MetricLabelsFromPath(path, prefix, "|")
+	require.NoError(t, err)
+	require.Equal(t, expectedLabels, actualLabels)
+}
+
+func TestWithMetricType(t *testing.T) {
+	labels := func(name string, extra ...*prompb.Label) []*prompb.Label {
+		return append([]*prompb.Label{{Name: model.MetricNameLabel, Value: name}}, extra...)
+	}
+	types := map[string]string{"requests_total": "gauge", "temperature": "gauge"}
+	for _, tc := range []struct {
+		labels   []*prompb.Label
+		infer    bool
+		expected []*prompb.Label
+	}{
+		{labels("requests_total"), false, labels("requests_total", &prompb.Label{Name: TypeLabel, Value: "gauge"})},
+		{labels("temperature"), true, labels("temperature", &prompb.Label{Name: TypeLabel, Value: "gauge"})},
+		{labels("http_requests_total"), true, labels("http_requests_total", &prompb.Label{Name: TypeLabel, Value: "counter"})},
+		{labels("latency_bucket"), true, labels("latency_bucket", &prompb.Label{Name: TypeLabel, Value: "histogram"})},
+		{labels("latency_bucket"), false, labels("latency_bucket")},
+		{labels("up"), true, labels("up")},
+		// Types written as labels are kept.
+		{labels("errors_total", &prompb.Label{Name: TypeLabel, Value: "gauge"}), true,
+			labels("errors_total", &prompb.Label{Name: TypeLabel, Value: "gauge"})},
+	} {
+		require.Equal(t, tc.expected, WithMetricType(tc.labels, types, tc.infer))
+	}
+}
@@ -1,10 +1,66 @@
 package paths
 
 import (
+	"bytes"
+	"fmt"
+	"time"
+
 	"github.com/criteo/graphite-remote-adapter/client/graphite/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/common/model"
 )
 
+var (
+	templateTimeout time.Duration
+
+	templateTimeouts = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "remote_adapter_graphite",
+			Name:      "template_timeouts_total",
+			Help:      "The total number of rule templates renderings which timed out.",
+		},
+	)
+)
+
+// SetTemplateTimeout sets the maximum duration of a rule template rendering.
+// A zero timeout disables the limit.
+func SetTemplateTimeout(timeout time.Duration) {
+	templateTimeout = timeout
+}
+
+// executeTemplate renders tmpl, giving up after the template timeout. A
+// rendering which timed out can't be interrupted, it keeps running in the
+// background until it returns but doesn't block the write path anymore.
+func executeTemplate(tmpl config.Template, context map[string]interface{}) (string, error) {
+	if templateTimeout <= 0 {
+		var path bytes.Buffer
+		err := tmpl.Execute(&path, context)
+		return path.String(), err
+	}
+
+	type rendering struct {
+		path string
+		err  error
+	}
+	done := make(chan rendering, 1)
+	go func() {
+		var path bytes.Buffer
+		err := tmpl.Execute(&path, context)
+		done <- rendering{path.String(), err}
+	}()
+
+	timer := time.NewTimer(templateTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.path, r.err
+	case <-timer.C:
+		templateTimeouts.Inc()
+		return "", fmt.Errorf("rendering template %q timed out after %s", tmpl.String(), templateTimeout)
+	}
+}
+
 func loadContext(templateData map[string]interface{}, m model.Metric) map[string]interface{} {
 	ctx := make(map[string]interface{})
 	for k, v := range templateData {
@@ -18,7 +74,9 @@ func loadContext(templateData map[string]interface{}, m model.Metric) map[string
 	return ctx
 }
 
-func match(m model.Metric, match config.LabelSet, matchRE config.LabelSetRE) bool {
+// Match tells whether m has all the labels of match and matches all the
+// regular expressions of matchRE.
+func Match(m model.Metric, match config.LabelSet, matchRE config.LabelSetRE) bool {
 	for ln, lv := range match {
 		if m[ln] != lv {
 			return false
@@ -6,19 +6,57 @@ import (
 	"fmt"
 	"math"
 	"sort"
+	"time"
 
 	"github.com/criteo/graphite-remote-adapter/client/graphite/config"
 	graphite_tmpl "github.com/criteo/graphite-remote-adapter/client/graphite/template"
 	"github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/common/model"
 )
 
+var pathsRenderDuration = promauto.NewHistogram(
+	prometheus.HistogramOpts{
+		Namespace: "remote_adapter_graphite",
+		Name:      "paths_render_duration_seconds",
+		Help:      "Duration of paths rendering for metrics missing from the paths cache.",
+		Buckets:   []float64{.00001, .00005, .0001, .0005, .001, .005, .01},
+	},
+)
+
+var pathsPerSample = promauto.NewHistogram(
+	prometheus.HistogramOpts{
+		Namespace: "remote_adapter_graphite",
+		Name:      "paths_per_sample",
+		Help:      "Number of paths generated per written sample.",
+		Buckets:   []float64{0, 1, 2, 3, 5, 10},
+	},
+)
+
+var clampedSamples = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "remote_adapter_graphite",
+		Name:      "clamped_samples_total",
+		Help:      "Number of written samples timestamped in the future whose timestamp was set to now.",
+	},
+)
+
+// ErrMissingMetricName is returned for samples without a metric name.
+var ErrMissingMetricName = fmt.Errorf("missing %s label", model.MetricNameLabel)
+
+// ExplainedDatapoint is a datapoint along with the rule which built its path.
+type ExplainedDatapoint struct {
+	Datapoint string `json:"datapoint"`
+	// Rule is the position of the rule in evaluation order, -1 for the default path.
+	Rule     int    `json:"rule"`
+	Template string `json:"template,omitempty"`
+}
+
 // ToDatapoints builds points from samples.
-func ToDatapoints(s *model.Sample, format Format, prefix string, rules []*config.Rule, templateData map[string]interface{}) ([]string, error) {
-	t := float64(s.Timestamp.UnixNano()) / 1e9
-	v := float64(s.Value)
-	if math.IsNaN(v) || math.IsInf(v, 0) {
-		return nil, errors.New("invalid sample value")
+func ToDatapoints(s *model.Sample, format Format, prefix Prefix, rules []*config.Rule, templateData map[string]interface{}) ([]string, error) {
+	if err := checkSample(s); err != nil {
+		return nil, err
 	}
 
 	paths, err := pathsFromMetric(s.Metric, format, prefix, rules, templateData)
@@ -28,59 +66,153 @@ func ToDatapoints(s *model.Sample, format Format, prefix string, rules []*config
 
 	datapoints := []string{}
 	for _, path := range paths {
-		datapoints = append(datapoints, fmt.Sprintf("%s %f %.0f\n", path, v, t))
+		datapoints = append(datapoints, formatDatapoint(path, s, format))
+	}
+	return datapoints, nil
+}
+
+// ExplainDatapoints builds points from samples like ToDatapoints, without
+// using the paths cache, and tells which rule built each of them.
+func ExplainDatapoints(s *model.Sample, format Format, prefix Prefix, rules []*config.Rule, templateData map[string]interface{}) ([]ExplainedDatapoint, error) {
+	if err := checkSample(s); err != nil {
+		return nil, err
+	}
+
+	paths, ruleIndexes, err := renderPaths(s.Metric, format, prefix, rules, templateData)
+	if err != nil {
+		return nil, err
+	}
+
+	datapoints := []ExplainedDatapoint{}
+	for i, path := range paths {
+		datapoint := ExplainedDatapoint{
+			Datapoint: formatDatapoint(path, s, format),
+			Rule:      ruleIndexes[i],
+		}
+		if datapoint.Rule >= 0 {
+			datapoint.Template = rules[datapoint.Rule].Tmpl.String()
+		}
+		datapoints = append(datapoints, datapoint)
 	}
 	return datapoints, nil
 }
 
-func pathsFromMetric(m model.Metric, format Format, prefix string, rules []*config.Rule, templateData map[string]interface{}) ([]string, error) {
+func checkSample(s *model.Sample) error {
+	v := float64(s.Value)
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return errors.New("invalid sample value")
+	}
+	if s.Metric[model.MetricNameLabel] == "" {
+		return ErrMissingMetricName
+	}
+	return nil
+}
+
+func formatDatapoint(path string, s *model.Sample, format Format) string {
+	timestamp := s.Timestamp
+	if format.ClampFutureToNow {
+		if now := model.Now(); timestamp.After(now) {
+			clampedSamples.Inc()
+			timestamp = now
+		}
+	}
+	t := float64(timestamp.UnixNano()) / 1e9
+	return fmt.Sprintf("%s %f %.0f%s", path, float64(s.Value), t, format.LineEnd())
+}
+
+func pathsFromMetric(m model.Metric, format Format, prefix Prefix, rules []*config.Rule, templateData map[string]interface{}) ([]string, error) {
 	var err error
+	var cacheKey string
 	if pathsCacheEnabled {
-		cachedPaths, cached := pathsCache.Get(m.Fingerprint().String())
+		cacheKey = pathsCacheKey(format.Type, prefix, m.Fingerprint())
+		cachedPaths, cached := pathsCache.Get(cacheKey)
 		if cached {
+			pathsPerSample.Observe(float64(len(cachedPaths.([]string))))
 			return cachedPaths.([]string), nil
 		}
 	}
-	paths, stop, err := templatedPaths(m, rules, templateData)
+	begin := time.Now()
+	paths, _, err := renderPaths(m, format, prefix, rules, templateData)
+	pathsRenderDuration.Observe(time.Since(begin).Seconds())
+	pathsPerSample.Observe(float64(len(paths)))
+	// Don't cache paths of failed renderings, so that samples keep being dropped.
+	if pathsCacheEnabled && err == nil {
+		pathsCache.Set(cacheKey, paths, cache.DefaultExpiration)
+	}
+	return paths, err
+}
+
+// renderPaths renders the paths of m, along with the index of the rule which
+// built each of them, -1 for the default path.
+func renderPaths(m model.Metric, format Format, prefix Prefix, rules []*config.Rule, templateData map[string]interface{}) ([]string, []int, error) {
+	paths, ruleIndexes, rulePrefix, stop, err := templatedPaths(m, rules, templateData)
 	// if it doesn't match any rule, use default path
-	if !stop {
-		paths = append(paths, defaultPath(m, format, prefix))
+	if stop || err != nil {
+		return paths, ruleIndexes, err
 	}
-	if pathsCacheEnabled {
-		pathsCache.Set(m.Fingerprint().String(), paths, cache.DefaultExpiration)
+	if err := format.checkAggregationTag(m); err != nil {
+		return paths, ruleIndexes, err
 	}
-	return paths, err
+	if rulePrefix == nil {
+		rulePrefix = &prefix
+	}
+	renderedPrefix, err := rulePrefix.Render(m, templateData)
+	if err != nil {
+		return paths, ruleIndexes, err
+	}
+	return append(paths, defaultPath(m, format, renderedPrefix)), append(ruleIndexes, -1), nil
 }
 
-func templatedPaths(m model.Metric, rules []*config.Rule, templateData map[string]interface{}) ([]string, bool, error) {
+// templatedPaths renders the paths of the rules matching m, along with their
+// index, and returns the prefix of the first matching rule setting one. It
+// also tells whether the default path must be left out, i.e. when a rule
+// stops the evaluation and no matching rule has AlsoDefault set.
+func templatedPaths(m model.Metric, rules []*config.Rule, templateData map[string]interface{}) ([]string, []int, *Prefix, bool, error) {
 	var paths []string
+	var ruleIndexes []int
+	var prefix *Prefix
 	var stop = false
+	var alsoDefault = false
 	var err error
-	for _, rule := range rules {
-		match := match(m, rule.Match, rule.MatchRE)
+	for i, rule := range rules {
+		match := Match(m, rule.Match, rule.MatchRE)
 		if !match {
 			continue
 		}
-		// We have a rule to silence this metric
-		if rule.Continue == false && (rule.Tmpl == config.Template{}) {
-			return nil, true, nil
+		if prefix == nil && rule.Prefix != "" {
+			p := rulePrefix(rule)
+			prefix = &p
+		}
+		if (rule.Tmpl == config.Template{}) {
+			// We have a rule to silence this metric
+			if rule.Prefix == "" && rule.Continue == false {
+				return nil, nil, nil, true, nil
+			}
+			// The rule only overrides the prefix of the default path.
+			if rule.Prefix != "" {
+				if rule.Continue == false {
+					break
+				}
+				continue
+			}
 		}
 
 		context := loadContext(templateData, m)
 		stop = !rule.Continue
-		var path bytes.Buffer
-		err = rule.Tmpl.Execute(&path, context)
+		var path string
+		path, err = executeTemplate(rule.Tmpl, context)
 		if err != nil {
 			// We had an error processing the template so we break the loop
 			break
 		}
-		paths = append(paths, path.String())
-
+		paths = append(paths, path)
+		ruleIndexes = append(ruleIndexes, i)
+		alsoDefault = alsoDefault || rule.AlsoDefault
 		if rule.Continue == false {
 			break
 		}
 	}
-	return paths, stop, err
+	return paths, ruleIndexes, prefix, stop && !alsoDefault, err
 }
 
 func defaultPath(m model.Metric, format Format, prefix string) string {
@@ -89,24 +221,38 @@ func defaultPath(m model.Metric, format Format, prefix string) string {
 
 	formatedTags := []string{}
 
-	buffer.WriteString(prefix)
-	buffer.WriteString(graphite_tmpl.Escape(string(m[model.MetricNameLabel])))
+	buffer.WriteString(format.NormalizePrefix(prefix))
+	if format.SchemaVersion != "" {
+		buffer.WriteString(format.SchemaVersion)
+		buffer.WriteString(format.NodeSeparator())
+	}
+	buffer.WriteString(format.SplitName(format.escapeSeparator(graphite_tmpl.Escape(string(m[model.MetricNameLabel])))))
 
-	// We want to sort the labels.
+	// We want to sort the labels, leading labels first.
 	labels := make(model.LabelNames, 0, len(m))
+	leading := make(map[model.LabelName]bool, len(format.LeadingLabels))
+	for _, l := range format.LeadingLabels {
+		if _, ok := m[model.LabelName(l)]; ok && !leading[model.LabelName(l)] {
+			labels = append(labels, model.LabelName(l))
+			leading[model.LabelName(l)] = true
+		}
+	}
+	numLeading := len(labels)
 	for l := range m {
-		labels = append(labels, l)
+		if !leading[l] {
+			labels = append(labels, l)
+		}
 	}
-	sort.Sort(labels)
+	sort.Sort(labels[numLeading:])
 
 	first := true
 	for _, l := range labels {
-		if l == model.MetricNameLabel || len(l) == 0 {
+		if l == model.MetricNameLabel || len(l) == 0 || (format.AggregationLabel != "" && string(l) == format.AggregationLabel) {
 			continue
 		}
 
 		k := string(l)
-		v := graphite_tmpl.Escape(string(m[l]))
+		tagKey := format.tagKey(k)
 
 		// When using carbon tags only for a set of known labels, make sure to filter those
 		// before creating the tag
@@ -126,20 +272,20 @@ func defaultPath(m model.Metric, format Format, prefix string) string {
 			if !first {
 				lbuffer.WriteString(",")
 			}
-			lbuffer.WriteString(fmt.Sprintf("%s=\"%s\"", k, v))
+			lbuffer.WriteString(fmt.Sprintf("%s=\"%s\"", tagKey, format.escapeTagValue(string(m[l]))))
 		} else if format.Type == FormatCarbonTags && len(format.FilteredTags) == 0 {
 			// See http://graphite.readthedocs.io/en/latest/tags.html
-			lbuffer.WriteString(fmt.Sprintf(";%s=%s", k, v))
+			lbuffer.WriteString(fmt.Sprintf(";%s=%s", tagKey, format.escapeTagValue(string(m[l]))))
 		} else if format.Type == FormatCarbonTags && WriteTag == false {
 			// Formated filtered tags: stack in a list, will be unstacked later.
-			formatedTags = append(formatedTags, fmt.Sprintf(";%s=%s", k, v))
+			formatedTags = append(formatedTags, fmt.Sprintf(";%s=%s", tagKey, format.escapeTagValue(string(m[l]))))
 			// else if format.Type == FormatCarbonTags && WriteTag == true, get to default case:
 		} else {
 			// For each label, in order, add ".<label>.<value>".
 			// Since we use '.' instead of '=' to separate label and values
 			// it means that we can't have an '.' in the metric name. Fortunately
 			// this is prohibited in prometheus metrics.
-			lbuffer.WriteString(fmt.Sprintf(".%s.%s", k, v))
+			lbuffer.WriteString(format.LabelNodes(k, string(m[l])))
 		}
 		first = false
 	}
@@ -149,6 +295,22 @@ func defaultPath(m model.Metric, format Format, prefix string) string {
 		lbuffer.WriteString(formatedTag)
 	}
 
+	if aggregation := m[model.LabelName(format.AggregationLabel)]; format.AggregationLabel != "" && aggregation != "" {
+		switch format.Type {
+		case FormatCarbonOpenMetrics:
+			if !first {
+				lbuffer.WriteString(",")
+			}
+			lbuffer.WriteString(fmt.Sprintf("%s=\"%s\"", format.aggregationTag(), format.escapeTagValue(string(aggregation))))
+		case FormatCarbonTags:
+			lbuffer.WriteString(fmt.Sprintf(";%s=%s", format.aggregationTag(), format.escapeTagValue(string(aggregation))))
+		default:
+			// The last node, for carbon aggregation rules to match it.
+			v := graphite_tmpl.Escape(string(aggregation))
+			lbuffer.WriteString(format.NodeSeparator() + format.escapeSeparator(v))
+		}
+	}
+
 	if lbuffer.Len() > 0 {
 		if format.Type == FormatCarbonOpenMetrics {
 			buffer.WriteRune('{')
@@ -160,3 +322,24 @@ func defaultPath(m model.Metric, format Format, prefix string) string {
 	}
 	return buffer.String()
 }
+
+// sanitizeTagKey replaces every character which is not a letter, a digit or
+// an underscore by an underscore, and prepends one if the key starts with a
+// digit. Resulting keys are valid for both graphite tags and OpenMetrics.
+func sanitizeTagKey(k string) string {
+	var buffer bytes.Buffer
+	for i, r := range k {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+			buffer.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				buffer.WriteRune('_')
+			}
+			buffer.WriteRune(r)
+		default:
+			buffer.WriteRune('_')
+		}
+	}
+	return buffer.String()
+}
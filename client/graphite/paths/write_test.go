@@ -1,9 +1,14 @@
 package paths
 
 import (
+	"fmt"
+	"strings"
 	"testing"
+	"text/template"
+	"time"
 
 	"github.com/criteo/graphite-remote-adapter/client/graphite/config"
+	graphite_tmpl "github.com/criteo/graphite-remote-adapter/client/graphite/template"
 	"github.com/prometheus/common/model"
 	"github.com/stretchr/testify/require"
 	yaml "gopkg.in/yaml.v2"
@@ -64,7 +69,7 @@ func TestDefaultPathsFromMetric(t *testing.T) {
 		".many_chars.abc!ABC:012-3!45%C3%B667~89%2E%2F\\(\\)\\{\\}\\,%3D%2E\\\"\\\\" +
 		".owner.team-X" +
 		".testlabel.test:value"
-	actual, err := pathsFromMetric(metric, Format{Type: FormatCarbon}, "prefix.", nil, nil)
+	actual, err := pathsFromMetric(metric, Format{Type: FormatCarbon}, LiteralPrefix("prefix."), nil, nil)
 	require.Equal(t, expected, actual[0])
 	require.Empty(t, err)
 
@@ -74,7 +79,7 @@ func TestDefaultPathsFromMetric(t *testing.T) {
 		";owner=team-X" +
 		";testlabel=test:value"
 
-	actual, err = pathsFromMetric(metric, Format{Type: FormatCarbonTags}, "prefix.", nil, nil)
+	actual, err = pathsFromMetric(metric, Format{Type: FormatCarbonTags}, LiteralPrefix("prefix."), nil, nil)
 	require.Equal(t, expected, actual[0])
 	require.Empty(t, err)
 
@@ -84,7 +89,7 @@ func TestDefaultPathsFromMetric(t *testing.T) {
 		",owner=\"team-X\"" +
 		",testlabel=\"test:value\"" +
 		"}"
-	actual, err = pathsFromMetric(metric, Format{Type: FormatCarbonOpenMetrics}, "prefix.", nil, nil)
+	actual, err = pathsFromMetric(metric, Format{Type: FormatCarbonOpenMetrics}, LiteralPrefix("prefix."), nil, nil)
 	require.Equal(t, expected, actual[0])
 	require.Empty(t, err)
 }
@@ -96,12 +101,12 @@ func TestDefaultPathWithFilteredTags(t *testing.T) {
 		".owner.team-X" +
 		".testlabel.test:value"
 
-	actual, err := pathsFromMetric(metric, Format{Type: FormatCarbon}, "prefix.", nil, nil)
+	actual, err := pathsFromMetric(metric, Format{Type: FormatCarbon}, LiteralPrefix("prefix."), nil, nil)
 	require.Equal(t, expected, actual[0])
 	require.Empty(t, err)
 
 	// With filtered tags, it doesn't change, as format didn't change.
-	actual, err = pathsFromMetric(metric, Format{Type: FormatCarbon, FilteredTags: []string{"owner"}}, "prefix.", nil, nil)
+	actual, err = pathsFromMetric(metric, Format{Type: FormatCarbon, FilteredTags: []string{"owner"}}, LiteralPrefix("prefix."), nil, nil)
 	require.Equal(t, expected, actual[0])
 	require.Empty(t, err)
 
@@ -111,7 +116,7 @@ func TestDefaultPathWithFilteredTags(t *testing.T) {
 		".testlabel.test:value" +
 		";owner=team-X"
 
-	actual, err = pathsFromMetric(metric, Format{Type: FormatCarbonTags, FilteredTags: []string{"owner"}}, "prefix.", nil, nil)
+	actual, err = pathsFromMetric(metric, Format{Type: FormatCarbonTags, FilteredTags: []string{"owner"}}, LiteralPrefix("prefix."), nil, nil)
 	require.Equal(t, expected, actual[0])
 	require.Empty(t, err)
 
@@ -121,7 +126,7 @@ func TestDefaultPathWithFilteredTags(t *testing.T) {
 		";owner=team-X" +
 		";testlabel=test:value"
 
-	actual, err = pathsFromMetric(metric, Format{Type: FormatCarbonTags, FilteredTags: []string{"owner", "testlabel"}}, "prefix.", nil, nil)
+	actual, err = pathsFromMetric(metric, Format{Type: FormatCarbonTags, FilteredTags: []string{"owner", "testlabel"}}, LiteralPrefix("prefix."), nil, nil)
 	require.Equal(t, expected, actual[0])
 	require.Empty(t, err)
 }
@@ -139,7 +144,7 @@ func TestUnmatchedMetricPathsFromMetric(t *testing.T) {
 		".owner.team-K"+
 		".testlabel.test:value"+
 		".testlabel2.test:value2")
-	actual, err := pathsFromMetric(unmatchedMetric, Format{Type: FormatCarbon}, "prefix.", testConfig.Write.Rules, testConfig.Write.TemplateData)
+	actual, err := pathsFromMetric(unmatchedMetric, Format{Type: FormatCarbon}, LiteralPrefix("prefix."), testConfig.Write.Rules, testConfig.Write.TemplateData)
 	require.Equal(t, expected, actual)
 	require.Empty(t, err)
 }
@@ -147,7 +152,7 @@ func TestUnmatchedMetricPathsFromMetric(t *testing.T) {
 func TestTemplatedPathsFromMetric(t *testing.T) {
 	expected := make([]string, 0)
 	expected = append(expected, "tmpl_3.team-Y.data.foo")
-	actual, err := pathsFromMetric(metricY, Format{Type: FormatCarbon}, "", testConfig.Write.Rules, testConfig.Write.TemplateData)
+	actual, err := pathsFromMetric(metricY, Format{Type: FormatCarbon}, LiteralPrefix(""), testConfig.Write.Rules, testConfig.Write.TemplateData)
 	require.Equal(t, expected, actual)
 	require.Empty(t, err)
 }
@@ -160,11 +165,39 @@ func TestTemplatedPathsFromMetricWithDefault(t *testing.T) {
 		".many_chars.abc!ABC:012-3!45%C3%B667~89%2E%2F\\(\\)\\{\\}\\,%3D%2E\\\"\\\\"+
 		".owner.team-X"+
 		".testlabel.test:value")
-	actual, err := pathsFromMetric(metric, Format{Type: FormatCarbon}, "prefix.", testConfig.Write.Rules, testConfig.Write.TemplateData)
+	actual, err := pathsFromMetric(metric, Format{Type: FormatCarbon}, LiteralPrefix("prefix."), testConfig.Write.Rules, testConfig.Write.TemplateData)
 	require.Equal(t, expected, actual)
 	require.Empty(t, err)
 }
 
+func TestTemplatedPathsFromMetricAlsoDefault(t *testing.T) {
+	cfg := loadTestConfig(`
+write:
+  rules:
+  - match:
+      owner: team-Y
+    template: 'tmpl_3.{{.labels.owner}}'
+    also_default: true`)
+	expected := []string{
+		"tmpl_3.team-Y",
+		"prefix." +
+			"test:metric" +
+			".many_chars.abc!ABC:012-3!45%C3%B667~89%2E%2F\\(\\)\\{\\}\\,%3D%2E\\\"\\\\" +
+			".owner.team-Y" +
+			".testlabel.test:value",
+	}
+	actual, err := pathsFromMetric(metricY, Format{Type: FormatCarbon}, LiteralPrefix("prefix."), cfg.Write.Rules, nil)
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+
+	require.Nil(t, loadTestConfig(`
+write:
+  rules:
+  - match:
+      owner: team-Y
+    also_default: true`))
+}
+
 func TestMultiTemplatedPathsFromMetric(t *testing.T) {
 	multiMatchMetric := model.Metric{
 		model.MetricNameLabel: "test:metric",
@@ -175,7 +208,7 @@ func TestMultiTemplatedPathsFromMetric(t *testing.T) {
 	expected := make([]string, 0)
 	expected = append(expected, "tmpl_1.data%2Efoo.team-X")
 	expected = append(expected, "tmpl_2.team-X.data.foo")
-	actual, err := pathsFromMetric(multiMatchMetric, Format{Type: FormatCarbon}, "prefix.", testConfig.Write.Rules, testConfig.Write.TemplateData)
+	actual, err := pathsFromMetric(multiMatchMetric, Format{Type: FormatCarbon}, LiteralPrefix("prefix."), testConfig.Write.Rules, testConfig.Write.TemplateData)
 	require.Equal(t, expected, actual)
 	require.Empty(t, err)
 }
@@ -188,7 +221,7 @@ func TestSkipedTemplatedPathsFromMetric(t *testing.T) {
 		"testlabel2":          "test:value2",
 	}
 	t.Log(testConfig.Write.Rules[2])
-	actual, err := pathsFromMetric(skipedMetric, Format{Type: FormatCarbon}, "", testConfig.Write.Rules, testConfig.Write.TemplateData)
+	actual, err := pathsFromMetric(skipedMetric, Format{Type: FormatCarbon}, LiteralPrefix(""), testConfig.Write.Rules, testConfig.Write.TemplateData)
 	require.Empty(t, actual)
 	require.Empty(t, err)
 }
@@ -205,7 +238,394 @@ write:
 	testConfigNilLabel := loadTestConfig(testConfigNilLabelStr)
 
 	t.Log(testConfigNilLabel.Write.Rules[0])
-	actual, err := pathsFromMetric(metric, Format{Type: FormatCarbon}, "", testConfigNilLabel.Write.Rules, testConfigNilLabel.Write.TemplateData)
+	actual, err := pathsFromMetric(metric, Format{Type: FormatCarbon}, LiteralPrefix(""), testConfigNilLabel.Write.Rules, testConfigNilLabel.Write.TemplateData)
 	require.Empty(t, actual)
 	require.Error(t, err)
 }
+
+func TestDefaultPathWithSanitizedTagKeys(t *testing.T) {
+	dirtyMetric := model.Metric{
+		model.MetricNameLabel: "test:metric",
+		"0owner":              "team-X",
+		"test.label":          "test:value",
+	}
+
+	expected := "prefix." +
+		"test:metric" +
+		";_0owner=team-X" +
+		";test_label=test:value"
+	actual := defaultPath(dirtyMetric, Format{Type: FormatCarbonTags, SanitizeTagKeys: true}, "prefix.")
+	require.Equal(t, expected, actual)
+
+	expected = "prefix." +
+		"test:metric{" +
+		"_0owner=\"team-X\"" +
+		",test_label=\"test:value\"" +
+		"}"
+	actual = defaultPath(dirtyMetric, Format{Type: FormatCarbonOpenMetrics, SanitizeTagKeys: true}, "prefix.")
+	require.Equal(t, expected, actual)
+
+	// Keys are left untouched when sanitization is disabled.
+	expected = "prefix." +
+		"test:metric" +
+		";0owner=team-X" +
+		";test.label=test:value"
+	actual = defaultPath(dirtyMetric, Format{Type: FormatCarbonTags}, "prefix.")
+	require.Equal(t, expected, actual)
+}
+
+func TestToDatapointsWithoutMetricName(t *testing.T) {
+	unnamedSample := &model.Sample{
+		Metric: model.Metric{"owner": "team-X"},
+		Value:  42,
+	}
+	actual, err := ToDatapoints(unnamedSample, Format{Type: FormatCarbon}, LiteralPrefix("prefix."), nil, nil)
+	require.Empty(t, actual)
+	require.Equal(t, ErrMissingMetricName, err)
+}
+
+func TestDefaultPathWithNameSplit(t *testing.T) {
+	splitMetric := model.Metric{
+		model.MetricNameLabel: "http_requests_total",
+		"owner":               "team-X",
+	}
+	format := Format{Type: FormatCarbon, NameDelimiter: "_", NameReplacement: "."}
+
+	expected := "prefix.http.requests.total.owner.team-X"
+	actual := defaultPath(splitMetric, format, "prefix.")
+	require.Equal(t, expected, actual)
+
+	require.Equal(t, "http_requests_total", format.JoinName(format.SplitName("http_requests_total")))
+}
+
+func TestExplainDatapoints(t *testing.T) {
+	sample := &model.Sample{Metric: metric, Value: 42, Timestamp: 300000}
+	expected := []ExplainedDatapoint{
+		{
+			Datapoint: "tmpl_1.data%2Efoo.team-X 42.000000 300\n",
+			Rule:      0,
+			Template:  "tmpl_1.{{.shared | escape}}.{{.labels.owner}}",
+		},
+		{
+			Datapoint: "prefix." +
+				"test:metric" +
+				".many_chars.abc!ABC:012-3!45%C3%B667~89%2E%2F\\(\\)\\{\\}\\,%3D%2E\\\"\\\\" +
+				".owner.team-X" +
+				".testlabel.test:value 42.000000 300\n",
+			Rule: -1,
+		},
+	}
+	actual, err := ExplainDatapoints(sample, Format{Type: FormatCarbon}, LiteralPrefix("prefix."), testConfig.Write.Rules, testConfig.Write.TemplateData)
+	require.Equal(t, expected, actual)
+	require.Empty(t, err)
+}
+
+func TestDefaultPathWithNameLabelTag(t *testing.T) {
+	namedMetric := model.Metric{
+		model.MetricNameLabel: "test:metric",
+		"name":                "foo",
+		"owner":               "team-X",
+	}
+
+	expected := "prefix." +
+		"test:metric" +
+		";_prom_name=foo" +
+		";owner=team-X"
+	actual := defaultPath(namedMetric, Format{Type: FormatCarbonTags, NameLabelTag: "_prom_name"}, "prefix.")
+	require.Equal(t, expected, actual)
+
+	// The name label is part of the path when not using tags.
+	expected = "prefix." +
+		"test:metric" +
+		".name.foo" +
+		".owner.team-X"
+	actual = defaultPath(namedMetric, Format{Type: FormatCarbon, NameLabelTag: "_prom_name"}, "prefix.")
+	require.Equal(t, expected, actual)
+}
+
+func TestTemplatedPathsTimeout(t *testing.T) {
+	slowTmpl := template.Must(template.New("").Funcs(template.FuncMap{
+		"slow": func() string {
+			time.Sleep(100 * time.Millisecond)
+			return "slow"
+		},
+	}).Parse("{{slow}}"))
+	rules := []*config.Rule{{Tmpl: config.Template{Template: slowTmpl}}}
+
+	SetTemplateTimeout(time.Millisecond)
+	defer SetTemplateTimeout(0)
+	_, _, _, _, err := templatedPaths(metric, rules, nil)
+	require.Error(t, err)
+
+	SetTemplateTimeout(time.Second)
+	actual, _, _, _, err := templatedPaths(metric, rules, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"slow"}, actual)
+}
+
+func TestDefaultPathWithSchemaVersion(t *testing.T) {
+	versionedMetric := model.Metric{
+		model.MetricNameLabel: "test:metric",
+		"owner":               "team-X",
+	}
+
+	expected := "prefix.v2.test:metric.owner.team-X"
+	actual := defaultPath(versionedMetric, Format{Type: FormatCarbon, SchemaVersion: "v2"}, "prefix.")
+	require.Equal(t, expected, actual)
+
+	expected = "prefix.v2.test:metric;owner=team-X"
+	actual = defaultPath(versionedMetric, Format{Type: FormatCarbonTags, SchemaVersion: "v2"}, "prefix.")
+	require.Equal(t, expected, actual)
+}
+
+func TestDefaultPathWithLeadingLabels(t *testing.T) {
+	instanceMetric := model.Metric{
+		model.MetricNameLabel: "test:metric",
+		"code":                "200",
+		"instance":            "host-1:9100",
+		"job":                 "node",
+		"owner":               "team-X",
+	}
+	format := Format{Type: FormatCarbon, LeadingLabels: []string{"job", "instance", "missing"}}
+
+	expected := "prefix.test:metric" +
+		".job.node" +
+		".instance.host-1:9100" +
+		".code.200" +
+		".owner.team-X"
+	actual := defaultPath(instanceMetric, format, "prefix.")
+	require.Equal(t, expected, actual)
+
+	// Labels are read back whatever their order.
+	labels, err := MetricLabelsFromPath(actual, "prefix.", DefaultSeparator)
+	require.NoError(t, err)
+	require.Len(t, labels, len(instanceMetric))
+}
+
+func TestDefaultPathWithSeparator(t *testing.T) {
+	instanceMetric := model.Metric{
+		model.MetricNameLabel: "test:metric",
+		"owner":               "team/X",
+		"path":                "a|b",
+	}
+	format := Format{Type: FormatCarbon, Separator: "|", SchemaVersion: "v2"}
+
+	expected := "prefix|v2|test:metric|owner|team%2FX|path|a%7Cb"
+	actual := defaultPath(instanceMetric, format, "prefix|")
+	require.Equal(t, expected, actual)
+}
+
+func TestDefaultPathWithPrefixSeparator(t *testing.T) {
+	m := model.Metric{
+		model.MetricNameLabel: "test:metric",
+		"owner":               "team-X",
+	}
+
+	for _, prefix := range []string{"prefix", "prefix.", "prefix.."} {
+		actual := defaultPath(m, Format{Type: FormatCarbon, PrefixSeparator: true}, prefix)
+		require.Equal(t, "prefix.test:metric.owner.team-X", actual, "prefix %q", prefix)
+	}
+	actual := defaultPath(m, Format{Type: FormatCarbon, PrefixSeparator: true, Separator: "|"}, "prefix")
+	require.Equal(t, "prefix|test:metric|owner|team-X", actual)
+	actual = defaultPath(m, Format{Type: FormatCarbon, PrefixSeparator: true}, "")
+	require.Equal(t, "test:metric.owner.team-X", actual)
+
+	// Prefixes are written as is by default.
+	actual = defaultPath(m, Format{Type: FormatCarbon}, "prom_")
+	require.Equal(t, "prom_test:metric.owner.team-X", actual)
+}
+
+func TestDefaultPathWithAggregationLabel(t *testing.T) {
+	m := model.Metric{
+		model.MetricNameLabel: "test",
+		"owner":               "team-X",
+		"__graphite_agg__":    "sum",
+	}
+	for formatType, expected := range map[FormatType]string{
+		FormatCarbon:            "prefix.test.owner.team-X.sum",
+		FormatCarbonTags:        "prefix.test;owner=team-X;aggregation=sum",
+		FormatCarbonOpenMetrics: "prefix.test{owner=\"team-X\",aggregation=\"sum\"}",
+	} {
+		format := Format{Type: formatType, AggregationLabel: "__graphite_agg__"}
+		require.Equal(t, expected, defaultPath(m, format, "prefix."))
+	}
+
+	// Metrics without the label keep their default path.
+	delete(m, "__graphite_agg__")
+	format := Format{Type: FormatCarbon, AggregationLabel: "__graphite_agg__"}
+	require.Equal(t, "prefix.test.owner.team-X", defaultPath(m, format, "prefix."))
+}
+
+func TestToDatapointsWithAggregationTag(t *testing.T) {
+	s := &model.Sample{
+		Metric: model.Metric{
+			model.MetricNameLabel: "test",
+			"aggregation":         "team-X",
+			"__graphite_agg__":    "sum",
+		},
+		Value: 1,
+	}
+
+	// The aggregation label collides with the aggregation tag.
+	format := Format{Type: FormatCarbonTags, AggregationLabel: "__graphite_agg__"}
+	_, err := ToDatapoints(s, format, LiteralPrefix("prefix."), nil, nil)
+	require.Error(t, err)
+
+	// Labels left in path nodes don't collide.
+	format.FilteredTags = []string{"owner"}
+	datapoints, err := ToDatapoints(s, format, LiteralPrefix("prefix."), nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"prefix.test.aggregation.team-X;aggregation=sum 1.000000 0\n"}, datapoints)
+
+	format = Format{Type: FormatCarbonTags, AggregationLabel: "__graphite_agg__", AggregationTag: "graphite_aggregation"}
+	datapoints, err = ToDatapoints(s, format, LiteralPrefix("prefix."), nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"prefix.test;aggregation=team-X;graphite_aggregation=sum 1.000000 0\n"}, datapoints)
+}
+
+func TestDefaultPathWithTagEscaping(t *testing.T) {
+	m := model.Metric{
+		model.MetricNameLabel: "test",
+		"path":                "/var/lib;rm=1",
+		"tilde":               "~home.dir",
+	}
+
+	expected := "prefix.test;path=%2Fvar%2Flib%3Brm%3D1;tilde=%7Ehome%2Edir"
+	require.Equal(t, expected, defaultPath(m, Format{Type: FormatCarbonTags}, "prefix."))
+
+	format := Format{Type: FormatCarbonTags, GraphiteTagEscaping: true}
+	expected = "prefix.test;path=/var/lib%3Brm=1;tilde=%7Ehome.dir"
+	require.Equal(t, expected, defaultPath(m, format, "prefix."))
+
+	format = Format{Type: FormatCarbonOpenMetrics, GraphiteTagEscaping: true}
+	expected = "prefix.test{path=\"/var/lib%3Brm=1\",tilde=\"%7Ehome.dir\"}"
+	require.Equal(t, expected, defaultPath(m, format, "prefix."))
+
+	// Tags are read back to the original labels with both escapings.
+	for _, format := range []Format{
+		{Type: FormatCarbonTags},
+		{Type: FormatCarbonTags, GraphiteTagEscaping: true},
+	} {
+		tags := strings.Split(defaultPath(m, format, ""), ";")
+		require.Equal(t, "test", tags[0])
+		for _, tag := range tags[1:] {
+			kv := strings.SplitN(tag, "=", 2)
+			unescape := graphite_tmpl.Unescape
+			if format.GraphiteTagEscaping {
+				unescape = graphite_tmpl.UnescapeTagValue
+			}
+			require.Equal(t, string(m[model.LabelName(kv[0])]), unescape(kv[1]))
+		}
+	}
+}
+
+func TestToDatapointsClampFutureToNow(t *testing.T) {
+	future := model.TimeFromUnix(time.Now().Add(time.Hour).Unix())
+	s := &model.Sample{
+		Metric:    model.Metric{model.MetricNameLabel: "test"},
+		Value:     1,
+		Timestamp: future,
+	}
+
+	datapoints, err := ToDatapoints(s, Format{Type: FormatCarbon}, LiteralPrefix(""), nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{fmt.Sprintf("test 1.000000 %d\n", future.Unix())}, datapoints)
+
+	before := model.Now().Unix()
+	datapoints, err = ToDatapoints(s, Format{Type: FormatCarbon, ClampFutureToNow: true}, LiteralPrefix(""), nil, nil)
+	require.NoError(t, err)
+	require.Len(t, datapoints, 1)
+	var timestamp int64
+	_, err = fmt.Sscanf(datapoints[0], "test 1.000000 %d\n", &timestamp)
+	require.NoError(t, err)
+	// Timestamps are rounded to the closest second.
+	require.True(t, timestamp >= before && timestamp <= model.Now().Unix()+1)
+}
+
+func TestToDatapointsWithLineTerminator(t *testing.T) {
+	sample := &model.Sample{
+		Metric:    model.Metric{model.MetricNameLabel: "test"},
+		Value:     42,
+		Timestamp: model.TimeFromUnix(1500000000),
+	}
+	actual, err := ToDatapoints(sample, Format{Type: FormatCarbon}, LiteralPrefix("prefix."), nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"prefix.test 42.000000 1500000000\n"}, actual)
+
+	actual, err = ToDatapoints(sample, Format{Type: FormatCarbon, LineTerminator: "\r\n"}, LiteralPrefix("prefix."), nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"prefix.test 42.000000 1500000000\r\n"}, actual)
+}
+
+func TestPathsFromMetricWithTemplatedPrefix(t *testing.T) {
+	tenantMetric := model.Metric{
+		model.MetricNameLabel: "test:metric",
+		"tenant":              "acme",
+	}
+	templateData := map[string]interface{}{"env": "prod"}
+	prefix, err := ParsePrefix("{{.labels.tenant | escape}}.{{.env}}.metrics.")
+	require.NoError(t, err)
+
+	actual, err := pathsFromMetric(tenantMetric, Format{Type: FormatCarbon}, prefix, nil, templateData)
+	require.NoError(t, err)
+	require.Equal(t, []string{"acme.prod.metrics.test:metric.tenant.acme"}, actual)
+
+	actual, err = pathsFromMetric(tenantMetric, Format{Type: FormatCarbon}, LiteralPrefix("prefix."), nil, templateData)
+	require.NoError(t, err)
+	require.Equal(t, []string{"prefix.test:metric.tenant.acme"}, actual)
+
+	// Literal prefixes, e.g. from requests, are never rendered.
+	actual, err = pathsFromMetric(tenantMetric, Format{Type: FormatCarbon}, LiteralPrefix("{{.env}}."), nil, templateData)
+	require.NoError(t, err)
+	require.Equal(t, []string{"{{.env}}.test:metric.tenant.acme"}, actual)
+
+	_, err = ParsePrefix("{{.labels.tenant")
+	require.Error(t, err)
+}
+
+func TestPathsFromMetricWithRulePrefix(t *testing.T) {
+	cfg := loadTestConfig(`
+write:
+  rules:
+  - match:
+      owner: team-X
+    template: 'tmpl_1.{{.labels.owner}}'
+    prefix: 'team-x.'
+    continue: true
+  - match:
+      owner: team-X
+    prefix: 'ignored.'
+    continue: true
+  - match:
+      owner: team-Y
+    prefix: 'team-y.{{.labels.testlabel | escape}}.'
+    continue: false
+  - match:
+      owner: team-Y
+    template: 'tmpl_2.{{.labels.owner}}'
+    continue: false`)
+	require.NotNil(t, cfg)
+
+	// The first matching prefix is used for the default path.
+	teamX := model.Metric{model.MetricNameLabel: "test", "owner": "team-X"}
+	actual, err := pathsFromMetric(teamX, Format{Type: FormatCarbon}, LiteralPrefix("prefix."), cfg.Write.Rules, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"tmpl_1.team-X", "team-x.test.owner.team-X"}, actual)
+
+	// A rule without template stops the evaluation, and the default path is
+	// still written with its prefix.
+	teamY := model.Metric{model.MetricNameLabel: "test", "owner": "team-Y", "testlabel": "a.b"}
+	actual, err = pathsFromMetric(teamY, Format{Type: FormatCarbon}, LiteralPrefix("prefix."), cfg.Write.Rules, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"team-y.a%2Eb.test.owner.team-Y.testlabel.a%2Eb"}, actual)
+
+	teamZ := model.Metric{model.MetricNameLabel: "test", "owner": "team-Z"}
+	actual, err = pathsFromMetric(teamZ, Format{Type: FormatCarbon}, LiteralPrefix("prefix."), cfg.Write.Rules, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"prefix.test.owner.team-Z"}, actual)
+
+	explained, err := ExplainDatapoints(&model.Sample{Metric: teamX, Value: 1}, Format{Type: FormatCarbon}, LiteralPrefix("prefix."), cfg.Write.Rules, nil)
+	require.NoError(t, err)
+	require.Len(t, explained, 2)
+	require.Equal(t, "team-x.test.owner.team-X 1.000000 0\n", explained[1].Datapoint)
+}
@@ -0,0 +1,84 @@
+// Copyright 2017 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// carbonPool hands out a fixed number of connections to carbon, each used by
+// one write at a time. Connections are opened on first use and reopened every
+// reconnect interval.
+type carbonPool struct {
+	conns  chan *carbonConn
+	lock   sync.Mutex
+	closed bool
+}
+
+func newCarbonPool(size int) *carbonPool {
+	p := &carbonPool{conns: make(chan *carbonConn, size)}
+	for i := 0; i < size; i++ {
+		p.conns <- &carbonConn{}
+	}
+	return p
+}
+
+// get waits for a connection to be available, or for ctx to be done.
+func (p *carbonPool) get(ctx context.Context) (*carbonConn, error) {
+	select {
+	case cc := <-p.conns:
+		return cc, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// put gives cc back to the pool, closing it if the pool was closed while it
+// was in use.
+func (p *carbonPool) put(cc *carbonConn) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		cc.close()
+	}
+	p.conns <- cc
+}
+
+// closeIdle closes the connections not in use.
+func (p *carbonPool) closeIdle() {
+	var idle []*carbonConn
+	for len(idle) < cap(p.conns) {
+		select {
+		case cc := <-p.conns:
+			cc.close()
+			idle = append(idle, cc)
+			continue
+		default:
+		}
+		break
+	}
+	for _, cc := range idle {
+		p.conns <- cc
+	}
+}
+
+// close closes the connections, the ones in use once given back.
+func (p *carbonPool) close() {
+	p.lock.Lock()
+	p.closed = true
+	p.lock.Unlock()
+	p.closeIdle()
+}
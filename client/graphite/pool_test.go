@@ -0,0 +1,91 @@
+// Copyright 2017 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/criteo/graphite-remote-adapter/client/graphite/config"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteConnectionPool(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// The relay only acknowledges writes once two connections are open, which
+	// never happens if writes wait for each other.
+	closed := make(chan struct{}, 2)
+	go func() {
+		var conns []net.Conn
+		for len(conns) < 2 {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+		for _, conn := range conns {
+			go func(conn net.Conn) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					if _, err := reader.ReadString('\n'); err != nil {
+						closed <- struct{}{}
+						return
+					}
+					conn.Write([]byte("OK\n"))
+				}
+			}(conn)
+		}
+	}()
+
+	c := newTestWriteClient(config.WriteConfig{
+		CarbonAddress:           listener.Addr().String(),
+		CarbonTransport:         "tcp",
+		CarbonReconnectInterval: time.Hour,
+		ExpectAck:               true,
+	})
+	c.writeTimeout = time.Second
+	c.carbonPool = newCarbonPool(2)
+
+	fakeRequest, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	samples := model.Samples{{Metric: model.Metric{model.MetricNameLabel: "test"}, Value: 18}}
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := c.Write(samples, fakeRequest, false)
+			errs <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		require.NoError(t, <-errs)
+	}
+
+	// Both connections are closed on shutdown.
+	c.Shutdown()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatal("Expected the pooled connections to be closed on shutdown")
+		}
+	}
+}
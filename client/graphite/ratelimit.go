@@ -0,0 +1,95 @@
+// Copyright 2017 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"golang.org/x/net/context"
+)
+
+var writeThrottledSeconds = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "remote_adapter_graphite",
+		Name:      "write_throttled_seconds_total",
+		Help:      "The total time write requests waited for graphite.write.max_samples_per_second.",
+	},
+)
+
+// rateLimiter is a token bucket refilled with rate tokens per second, up to
+// one second worth of tokens.
+type rateLimiter struct {
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, now time.Time) *rateLimiter {
+	return &rateLimiter{rate: rate, tokens: rate, last: now}
+}
+
+// reserve takes n tokens and returns how long to wait for them to be
+// available. Tokens may be taken in advance, so that a reservation larger
+// than the bucket only waits for the missing ones.
+func (l *rateLimiter) reserve(n float64, now time.Time) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if now.After(l.last) {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+		l.last = now
+	}
+	l.tokens -= n
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// cancel gives back the n tokens of a reservation which isn't used.
+func (l *rateLimiter) cancel(n float64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.tokens += n
+}
+
+// throttle waits for n datapoints to be allowed by the rate limit. Writes
+// which would wait longer than the write timeout fail instead.
+func (c *Client) throttle(ctx context.Context, n float64) error {
+	delay := c.rateLimiter.reserve(n, time.Now())
+	if delay == 0 {
+		return nil
+	}
+	if c.writeTimeout > 0 && delay > c.writeTimeout {
+		c.rateLimiter.cancel(n)
+		return fmt.Errorf("writing %.0f datapoints would wait %s for max_samples_per_second, more than the write timeout",
+			n, delay)
+	}
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		c.rateLimiter.cancel(n)
+		return ctx.Err()
+	}
+	writeThrottledSeconds.Add(delay.Seconds())
+	return nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2017 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/criteo/graphite-remote-adapter/client/graphite/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+
+	"golang.org/x/net/context"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newRateLimiter(10, now)
+
+	if delay := l.reserve(10, now); delay != 0 {
+		t.Errorf("Expected the full bucket to be available, waited %s", delay)
+	}
+	if delay := l.reserve(5, now); delay != 500*time.Millisecond {
+		t.Errorf("Expected to wait 500ms for 5 tokens, got %s", delay)
+	}
+	l.cancel(5)
+	if delay := l.reserve(10, now.Add(time.Second)); delay != 0 {
+		t.Errorf("Expected the bucket to be refilled after 1s, waited %s", delay)
+	}
+	// The bucket doesn't hold more than one second worth of tokens.
+	if delay := l.reserve(20, now.Add(time.Hour)); delay != time.Second {
+		t.Errorf("Expected to wait 1s for 20 tokens, got %s", delay)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	c := newTestWriteClient(config.WriteConfig{})
+	c.writeTimeout = time.Second
+	c.rateLimiter = newRateLimiter(100, time.Now())
+
+	throttled := testutil.ToFloat64(writeThrottledSeconds)
+	start := time.Now()
+	if err := c.throttle(context.Background(), 110); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected to wait about 100ms, waited %s", elapsed)
+	}
+	if testutil.ToFloat64(writeThrottledSeconds) <= throttled {
+		t.Errorf("Expected the throttled time to be recorded")
+	}
+
+	// Waiting for longer than the write timeout fails, and gives the tokens back.
+	if err := c.throttle(context.Background(), 1000); err == nil {
+		t.Errorf("Expected an error when waiting longer than the write timeout")
+	}
+	if delay := c.rateLimiter.reserve(0, time.Now()); delay > 10*time.Millisecond {
+		t.Errorf("Expected the tokens of the failed write to be given back, would wait %s", delay)
+	}
+}
+
+func TestWriteDryRunIsNotThrottled(t *testing.T) {
+	c := newTestWriteClient(config.WriteConfig{CarbonAddress: "localhost:2003"})
+	c.writeTimeout = time.Millisecond
+	c.rateLimiter = newRateLimiter(1, time.Now())
+	c.rateLimiter.reserve(1, time.Now())
+
+	samples := model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "test"}, Value: 1, Timestamp: model.Time(0)},
+	}
+	r, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	if _, err := c.Write(samples, r, true); err != nil {
+		t.Errorf("Expected dry runs to bypass the limiter, got %s", err)
+	}
+}
@@ -18,13 +18,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
 
+	graphiteCfg "github.com/criteo/graphite-remote-adapter/client/graphite/config"
 	"github.com/criteo/graphite-remote-adapter/client/graphite/paths"
 	"github.com/criteo/graphite-remote-adapter/utils"
 	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/common/model"
 	plabels "github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/prompb"
@@ -34,8 +39,29 @@ import (
 	"golang.org/x/net/context"
 )
 
-func (c *Client) queryToTargets(ctx context.Context, query *prompb.Query, graphitePrefix string) ([]string, error) {
-	// Parse metric name from query
+// findSeriesPath is the path of the findSeries endpoint, relative to the URL
+// of graphite-web.
+const findSeriesPath = "/tags/findSeries"
+
+var renderRetries = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "remote_adapter_graphite",
+		Name:      "render_retries_total",
+		Help:      "The total number of renders retried because they returned no datapoints.",
+	},
+)
+
+var failedBackendReads = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "remote_adapter_graphite",
+		Name:      "failed_backend_reads_total",
+		Help:      "The total number of read requests which failed on a graphite-web backend, per graphite-web backend.",
+	},
+	[]string{"graphite_web"},
+)
+
+// metricNameFromQuery returns the metric name matched by the query.
+func metricNameFromQuery(query *prompb.Query) (string, error) {
 	var name string
 
 	for _, m := range query.Matchers {
@@ -46,24 +72,119 @@ func (c *Client) queryToTargets(ctx context.Context, query *prompb.Query, graphi
 
 	if name == "" {
 		err := fmt.Errorf("Invalid remote query: no %s label provided", model.MetricNameLabel)
+		return "", err
+	}
+	return name, nil
+}
+
+func (c *Client) queryToTargets(ctx context.Context, graphiteURL string, query *prompb.Query, graphitePrefix string) ([]string, error) {
+	targets, err := c.queriesToTargets(ctx, graphiteURL, []*prompb.Query{query}, graphitePrefix)
+	if err != nil {
 		return nil, err
 	}
+	return targets[0], nil
+}
+
+// queriesToTargets returns the targets of each query. The paths of all the
+// queried metric names are fetched with a single call to the expand endpoint.
+func (c *Client) queriesToTargets(ctx context.Context, graphiteURL string, queries []*prompb.Query, graphitePrefix string) ([][]string, error) {
+	names := make([]string, len(queries))
+	var patterns []string
+	for i, query := range queries {
+		name, err := metricNameFromQuery(query)
+		if err != nil {
+			return nil, err
+		}
+		names[i] = name
+		patterns = append(patterns, c.expandPatterns(query, name, graphitePrefix)...)
+	}
 
-	// Prepare the url to fetch
-	queryStr := graphitePrefix + name + ".**"
-	expandURL, err := prepareURL(c.cfg.Read.URL, expandEndpoint, map[string]string{"format": "json", "leavesOnly": "1", "query": queryStr})
+	pathsByName, err := c.expand(ctx, graphiteURL, patterns, graphitePrefix)
 	if err != nil {
-		level.Warn(c.logger).Log(
-			"graphite_web", c.cfg.Read.URL, "path", expandEndpoint,
+		return nil, err
+	}
+
+	targets := make([][]string, len(queries))
+	for i, query := range queries {
+		targets[i], err = c.filterTargets(query, pathsByName[names[i]], graphitePrefix)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return targets, nil
+}
+
+// expandPatterns returns the patterns of the paths of name which may match
+// query. With ExpandLeadingLabels, as leading labels are the first nodes of
+// default paths, in order, the ones matched by an EQ matcher are part of the
+// patterns, up to the first one which isn't. The narrowed path itself is
+// expanded too, for series without any other label. Other matchers, e.g. RE
+// ones whose values can't be expressed as globs, are only applied by
+// filterTargets.
+func (c *Client) expandPatterns(query *prompb.Query, name string, graphitePrefix string) []string {
+	pattern := graphitePrefix + name
+	if !c.cfg.Read.ExpandLeadingLabels {
+		return []string{pattern + c.format.NodeSeparator() + "**"}
+	}
+	narrowed := false
+	seen := make(map[string]bool, len(c.format.LeadingLabels))
+	for _, label := range c.format.LeadingLabels {
+		if seen[label] {
+			continue
+		}
+		seen[label] = true
+		if label == model.MetricNameLabel || label == c.format.AggregationLabel {
+			break
+		}
+		value := ""
+		for _, m := range query.Matchers {
+			if m.Name == label && m.Type == prompb.LabelMatcher_EQ {
+				value = m.Value
+				break
+			}
+		}
+		// Series without the label don't have its nodes.
+		if value == "" {
+			break
+		}
+		nodes := c.format.LabelNodes(label, value)
+		if strings.ContainsAny(nodes, "*?[]{}") {
+			break
+		}
+		pattern += nodes
+		narrowed = true
+	}
+	if !narrowed {
+		return []string{pattern + c.format.NodeSeparator() + "**"}
+	}
+	return []string{pattern, pattern + c.format.NodeSeparator() + "**"}
+}
+
+// expand fetches the paths matching each of the patterns and returns them by
+// metric name.
+func (c *Client) expand(ctx context.Context, graphiteURL string, patterns []string, graphitePrefix string) (map[string][]string, error) {
+	// Prepare the url to fetch, expand accepts several queries.
+	params := url.Values{"format": {"json"}, "leavesOnly": {"1"}}
+	queried := make(map[string]bool, len(patterns))
+	for _, pattern := range patterns {
+		if !queried[pattern] {
+			params.Add("query", pattern)
+			queried[pattern] = true
+		}
+	}
+	expandURL, err := prepareURLValues(graphiteURL, c.cfg.Read.ExpandPath, params)
+	if err != nil {
+		level.Warn(c.readLogger).Log(
+			"graphite_web", graphiteURL, "path", c.cfg.Read.ExpandPath,
 			"err", err, "msg", "Error preparing URL")
 		return nil, err
 	}
 
 	// Get the list of targets
 	expandResponse := ExpandResponse{}
-	body, err := fetchURL(ctx, c.logger, expandURL)
+	body, err := c.fetch(ctx, expandURL)
 	if err != nil {
-		level.Warn(c.logger).Log(
+		level.Warn(c.readLogger).Log(
 			"url", expandURL, "body", utils.TruncateString(string(body), 140)+"...",
 			"err", err, "msg", "Error fetching URL")
 		return nil, err
@@ -71,46 +192,129 @@ func (c *Client) queryToTargets(ctx context.Context, query *prompb.Query, graphi
 
 	err = json.Unmarshal(body, &expandResponse)
 	if err != nil {
-		level.Warn(c.logger).Log(
+		level.Warn(c.readLogger).Log(
 			"url", expandURL, "body", utils.TruncateString(string(body), 140)+"...",
 			"err", err, "msg", "Error parsing expand endpoint response body")
 		return nil, err
 	}
 
-	targets, err := c.filterTargets(query, expandResponse.Results, graphitePrefix)
-	return targets, err
+	// Metric names can't contain dots, the first node after the prefix
+	// tells which name a path was expanded from. Paths matching several
+	// patterns of the same name are kept once.
+	pathsByName := make(map[string][]string, len(queried))
+	expanded := make(map[string]bool, len(expandResponse.Results))
+	for _, path := range expandResponse.Results {
+		if expanded[path] {
+			continue
+		}
+		expanded[path] = true
+		name := strings.SplitN(strings.TrimPrefix(path, graphitePrefix), c.format.NodeSeparator(), 2)[0]
+		pathsByName[name] = append(pathsByName[name], path)
+	}
+	return pathsByName, nil
 }
 
-func (c *Client) queryToTargetsWithTags(ctx context.Context, query *prompb.Query, graphitePrefix string) ([]string, error) {
-	tagSet := []string{}
+func (c *Client) queryToTargetsWithTags(ctx context.Context, graphiteURL string, query *prompb.Query, graphitePrefix string) ([]string, error) {
+	exprs, err := c.tagExpressions(query, graphitePrefix)
+	if err != nil {
+		return nil, err
+	}
+	if c.cfg.Read.UseFindSeries {
+		return c.findSeries(ctx, graphiteURL, exprs)
+	}
 
+	tagSet := make([]string, 0, len(exprs))
+	for _, expr := range exprs {
+		quoted, err := quoteTagExpression(expr)
+		if err != nil {
+			return nil, err
+		}
+		tagSet = append(tagSet, quoted)
+	}
+
+	targets := []string{"seriesByTag(" + strings.Join(tagSet, ",") + ")"}
+	return targets, nil
+}
+
+// tagExpressions returns the graphite tag expressions of the matchers of query.
+func (c *Client) tagExpressions(query *prompb.Query, graphitePrefix string) ([]string, error) {
+	exprs := make([]string, 0, len(query.Matchers))
 	for _, m := range query.Matchers {
 		var name string
 		var value string
 		if m.Name == model.MetricNameLabel {
 			name = "name"
-			value = graphitePrefix + m.Value
+			value = graphitePrefix + c.format.SplitName(m.Value)
+		} else if m.Name == "name" && c.format.NameLabelTag != "" {
+			name = c.format.NameLabelTag
+			value = m.Value
 		} else {
 			name = m.Name
 			value = m.Value
 		}
 
+		var expr string
 		switch m.Type {
 		case prompb.LabelMatcher_EQ:
-			tagSet = append(tagSet, "\""+name+"="+value+"\"")
+			expr = name + "=" + value
 		case prompb.LabelMatcher_NEQ:
-			tagSet = append(tagSet, "\""+name+"!="+value+"\"")
+			expr = name + "!=" + value
 		case prompb.LabelMatcher_RE:
-			tagSet = append(tagSet, "\""+name+"=~^("+value+")$\"")
+			expr = name + "=~^(" + value + ")$"
 		case prompb.LabelMatcher_NRE:
-			tagSet = append(tagSet, "\""+name+"!=~^("+value+")$\"")
+			expr = name + "!=~^(" + value + ")$"
 		default:
 			return nil, fmt.Errorf("unknown match type %v", m.Type)
 		}
+		exprs = append(exprs, expr)
 	}
+	return exprs, nil
+}
 
-	targets := []string{"seriesByTag(" + strings.Join(tagSet, ",") + ")"}
-	return targets, nil
+// findSeries returns the names of the tagged series matching all of exprs,
+// as returned by the findSeries endpoint.
+func (c *Client) findSeries(ctx context.Context, graphiteURL string, exprs []string) ([]string, error) {
+	findURL, err := prepareURLValues(graphiteURL, findSeriesPath, url.Values{"expr": exprs})
+	if err != nil {
+		level.Warn(c.readLogger).Log(
+			"graphite_web", graphiteURL, "path", findSeriesPath,
+			"err", err, "msg", "Error preparing URL")
+		return nil, err
+	}
+
+	body, err := c.fetch(ctx, findURL)
+	if err != nil {
+		level.Warn(c.readLogger).Log(
+			"url", findURL, "body", utils.TruncateString(string(body), 140)+"...",
+			"err", err, "msg", "Error fetching URL")
+		return nil, err
+	}
+
+	series := []string{}
+	if err := json.Unmarshal(body, &series); err != nil {
+		level.Warn(c.readLogger).Log(
+			"url", findURL, "body", utils.TruncateString(string(body), 140)+"...",
+			"err", err, "msg", "Error parsing findSeries endpoint response body")
+		return nil, err
+	}
+	return series, nil
+}
+
+// quoteTagExpression quotes a seriesByTag tag expression as a graphite string
+// literal. graphite-web strips the quotes of string literals without
+// unescaping them, so expressions containing double quotes are single quoted
+// instead. Commas and parentheses need no escaping within quotes.
+func quoteTagExpression(expr string) (string, error) {
+	if strings.ContainsAny(expr, "\r\n") || strings.HasSuffix(expr, "\\") {
+		return "", fmt.Errorf("cannot quote tag expression %q: line breaks and trailing backslashes are not supported", expr)
+	}
+	if !strings.Contains(expr, "\"") {
+		return "\"" + expr + "\"", nil
+	}
+	if !strings.Contains(expr, "'") {
+		return "'" + expr + "'", nil
+	}
+	return "", fmt.Errorf("cannot quote tag expression %q: it contains both single and double quotes", expr)
 }
 
 func (c *Client) filterTargets(query *prompb.Query, targets []string, graphitePrefix string) ([]string, error) {
@@ -118,9 +322,9 @@ func (c *Client) filterTargets(query *prompb.Query, targets []string, graphitePr
 	var results []string
 	for _, target := range targets {
 		// Put labels in a map.
-		prompbLabels, err := paths.MetricLabelsFromPath(target, graphitePrefix)
+		prompbLabels, err := paths.MetricLabelsFromPath(target, graphitePrefix, c.format.NodeSeparator())
 		if err != nil {
-			level.Warn(c.logger).Log(
+			level.Warn(c.readLogger).Log(
 				"path", target, "prefix", graphitePrefix, "err", err)
 			continue
 		}
@@ -130,7 +334,7 @@ func (c *Client) filterTargets(query *prompb.Query, targets []string, graphitePr
 			labelMap[label.Name] = label.Value
 		}
 
-		level.Debug(c.logger).Log(
+		level.Debug(c.readLogger).Log(
 			"target", target, "prefix", graphitePrefix,
 			"labels", labelMap, "msg", "Filtering target")
 
@@ -157,69 +361,204 @@ func (c *Client) filterTargets(query *prompb.Query, targets []string, graphitePr
 	return results, nil
 }
 
-func (c *Client) targetToTimeseries(ctx context.Context, target string, from string, until string, graphitePrefix string) ([]*prompb.TimeSeries, error) {
-	renderURL, err := prepareURL(c.cfg.Read.URL, renderEndpoint, map[string]string{"format": "json", "from": from, "until": until, "target": target})
-	if err != nil {
-		level.Warn(c.logger).Log(
-			"graphite_web", c.cfg.Read.URL, "path", renderEndpoint,
-			"err", err, "msg", "Error preparing URL")
-		return nil, err
-	}
-
+// render fetches and parses the response of the render endpoint.
+func (c *Client) render(ctx context.Context, renderURL *url.URL) ([]RenderResponse, error) {
 	renderResponses := make([]RenderResponse, 0)
-	body, err := fetchURL(ctx, c.logger, renderURL)
+	body, err := c.fetch(ctx, renderURL)
 	if err != nil {
-		level.Warn(c.logger).Log(
+		level.Warn(c.readLogger).Log(
 			"url", renderURL, "body", utils.TruncateString(string(body), 140)+"...",
 			"err", err, "ctx", ctx, "msg", "Error fetching URL")
 		return nil, err
 	}
 
-	err = json.Unmarshal(body, &renderResponses)
+	if c.cfg.Read.RenderFormat == graphiteCfg.RenderFormatCSV {
+		renderResponses, err = parseRenderCSV(body)
+	} else {
+		err = json.Unmarshal(body, &renderResponses)
+	}
 	if err != nil {
-		level.Warn(c.logger).Log(
+		level.Warn(c.readLogger).Log(
 			"url", renderURL, "body", utils.TruncateString(string(body), 140)+"...",
 			"err", err, "msg", "Error parsing render endpoint response body")
 		return nil, err
 	}
+	return renderResponses, nil
+}
+
+// hasDatapoints tells whether any of renderResponses has a non null datapoint.
+func hasDatapoints(renderResponses []RenderResponse) bool {
+	for _, r := range renderResponses {
+		for _, d := range r.Datapoints {
+			if d.Value != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *Client) targetToTimeseries(ctx context.Context, graphiteURL string, target string, from string, until string, graphitePrefix string, forwardedParams map[string]string) ([]*prompb.TimeSeries, error) {
+	return c.targetsToTimeseries(ctx, graphiteURL, []string{target}, from, until, graphitePrefix, forwardedParams)
+}
+
+// targetsToTimeseries renders targets with a single request to graphite-web.
+func (c *Client) targetsToTimeseries(ctx context.Context, graphiteURL string, targets []string, from string, until string, graphitePrefix string, forwardedParams map[string]string) ([]*prompb.TimeSeries, error) {
+	params := make(url.Values, len(forwardedParams)+4)
+	for k, v := range forwardedParams {
+		params.Set(k, v)
+	}
+	if c.cfg.Read.RenderFormat == graphiteCfg.RenderFormatCSV {
+		params.Set("format", graphiteCfg.RenderFormatCSV)
+		// CSV timestamps are dates in the timezone of graphite-web.
+		params.Set("tz", "UTC")
+	} else {
+		params.Set("format", graphiteCfg.RenderFormatJSON)
+	}
+	params.Set("from", from)
+	params.Set("until", until)
+	for _, target := range targets {
+		params.Add("target", c.renderTarget(target))
+	}
+
+	renderURL, err := prepareURLValues(graphiteURL, c.cfg.Read.RenderPath, params)
+	if err != nil {
+		level.Warn(c.readLogger).Log(
+			"graphite_web", graphiteURL, "path", c.cfg.Read.RenderPath,
+			"err", err, "msg", "Error preparing URL")
+		return nil, err
+	}
+
+	renderResponses, err := c.render(ctx, renderURL)
+	if err != nil {
+		return nil, err
+	}
+	// Targets without tags come from the expand endpoint, so the series
+	// exist and an empty render is likely a transient graphite-web miss.
+	if c.cfg.Read.RetryOnEmpty > 0 && !c.cfg.EnableTags && !hasDatapoints(renderResponses) {
+		level.Debug(c.readLogger).Log(
+			"url", renderURL, "delay", c.cfg.Read.RetryOnEmpty, "msg", "Retrying empty render")
+		select {
+		case <-time.After(c.cfg.Read.RetryOnEmpty):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		renderRetries.Inc()
+		renderResponses, err = c.render(ctx, renderURL)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	ret := make([]*prompb.TimeSeries, len(renderResponses))
 	for i, renderResponse := range renderResponses {
 		ts := &prompb.TimeSeries{}
 
 		if c.cfg.EnableTags {
-			ts.Labels, err = paths.MetricLabelsFromTags(renderResponse.Tags, graphitePrefix)
+			ts.Labels, err = paths.MetricLabelsFromTags(renderResponse.Tags, graphitePrefix, c.format)
+			for _, l := range ts.Labels {
+				if l.Name == model.MetricNameLabel {
+					l.Value = c.format.JoinName(l.Value)
+				}
+			}
 		} else {
-			ts.Labels, err = paths.MetricLabelsFromPath(renderResponse.Target, graphitePrefix)
+			ts.Labels, err = paths.MetricLabelsFromPath(renderResponse.Target, graphitePrefix, c.format.NodeSeparator())
 		}
 
 		if err != nil {
-			level.Warn(c.logger).Log(
+			level.Warn(c.readLogger).Log(
 				"path", renderResponse.Target, "prefix", graphitePrefix, "err", err)
 			return nil, err
 		}
 
-		ts.Samples = samplesFromDatapoints(renderResponse.Datapoints, c.cfg.Read.MaxPointDelta)
+		interpolation := graphiteCfg.InterpolationLinear
+		if c.cfg.Read.InferMetricTypes || len(c.cfg.Read.MetricTypes) > 0 {
+			ts.Labels = paths.WithMetricType(ts.Labels, c.cfg.Read.MetricTypes, c.cfg.Read.InferMetricTypes)
+		}
+
+		if c.cfg.Read.CounterInterpolation != "" && isCounter(ts.Labels) {
+			interpolation = c.cfg.Read.CounterInterpolation
+		}
+		ts.Samples = samplesFromDatapoints(renderResponse.Datapoints, c.cfg.Read.MaxPointDelta, interpolation, c.cfg.Read.FillForward)
+		scale, offset := c.valueTransform(ts.Labels)
+		transformValues(ts.Samples, scale, offset)
 
 		ret[i] = ts
 	}
 	return ret, nil
 }
 
-func samplesFromDatapoints(datapoints []*Datapoint, maxPointDelta time.Duration) []prompb.Sample {
+// renderTarget returns the target rendered for target, aliased so that its
+// labels can be parsed from its name and without empty series if asked.
+func (c *Client) renderTarget(target string) string {
+	// Labels are read from the tags of the returned series, whatever its
+	// name, so tagged targets aren't wrapped in aliasByTags: its alias only
+	// holds the values of the given tags, losing the others.
+	if !c.cfg.EnableTags {
+		target = aliasTarget(target)
+	}
+	if c.cfg.Read.RemoveEmptySeries {
+		target = "removeEmptySeries(" + target + ")"
+	}
+	return target
+}
+
+// aliasTarget makes graphite-web return target as the name of the series, so
+// that labels can still be parsed from it when functions are applied.
+func aliasTarget(target string) string {
+	return fmt.Sprintf("alias(%s,\"%s\")", target, target)
+}
+
+// isCounter tells whether labels are the ones of a counter, from their
+// __type__ label or from the _total suffix of their name.
+func isCounter(labels []*prompb.Label) bool {
+	name := ""
+	for _, l := range labels {
+		switch l.Name {
+		case paths.TypeLabel:
+			return l.Value == "counter"
+		case model.MetricNameLabel:
+			name = l.Value
+		}
+	}
+	return strings.HasSuffix(name, "_total")
+}
+
+// samplesFromDatapoints converts datapoints to samples sorted by timestamp,
+// as Prometheus requires. Graphite functions don't always return datapoints
+// in order, and of datapoints with the same timestamp only the last is kept.
+// Intermediate samples are added every maxPointDelta using interpolation.
+// Null datapoints less than fillForward after a value are filled with it.
+func samplesFromDatapoints(datapoints []*Datapoint, maxPointDelta time.Duration, interpolation string, fillForward time.Duration) []prompb.Sample {
+	sort.SliceStable(datapoints, func(i, j int) bool {
+		return datapoints[i].Timestamp < datapoints[j].Timestamp
+	})
+
 	samples := []prompb.Sample{}
+	var last *Datapoint
 	for i, datapoint := range datapoints {
 		timestampMs := datapoint.Timestamp * 1000
 		if datapoint.Value == nil {
+			// Repeat the last value across gaps shorter than fillForward.
+			if last != nil && fillForward > 0 && timestampMs > samples[len(samples)-1].Timestamp &&
+				time.Duration(datapoint.Timestamp-last.Timestamp)*time.Second <= fillForward {
+				samples = append(samples, prompb.Sample{
+					Value:     *last.Value,
+					Timestamp: timestampMs})
+			}
 			continue
 		}
+		last = datapoint
+		if len(samples) > 0 && samples[len(samples)-1].Timestamp == timestampMs {
+			samples = samples[:len(samples)-1]
+		}
 		samples = append(samples, prompb.Sample{
 			Value:     *datapoint.Value,
 			Timestamp: timestampMs})
 
 		// If not last point and interpolation is enabled,
-		// then linearly interpolate intermediate samples.
-		if (i+1) < len(datapoints) && maxPointDelta != time.Duration(0) {
+		// then interpolate intermediate samples.
+		if (i+1) < len(datapoints) && maxPointDelta != time.Duration(0) && interpolation != graphiteCfg.InterpolationNone {
 			intervalSecond := int64(maxPointDelta.Seconds())
 			nextDatapoint := datapoints[i+1]
 			if nextDatapoint.Value == nil {
@@ -227,7 +566,14 @@ func samplesFromDatapoints(datapoints []*Datapoint, maxPointDelta time.Duration)
 			}
 
 			deltaSecond := nextDatapoint.Timestamp - datapoint.Timestamp
+			if deltaSecond == 0 {
+				continue
+			}
 			variation := (*nextDatapoint.Value - *datapoint.Value) / float64(deltaSecond)
+			if interpolation == graphiteCfg.InterpolationStep {
+				// Repeat the last value.
+				variation = 0
+			}
 
 			for j := int64(1); j < deltaSecond/intervalSecond; j++ {
 				timestamp := datapoint.Timestamp + j*intervalSecond
@@ -241,6 +587,42 @@ func samplesFromDatapoints(datapoints []*Datapoint, maxPointDelta time.Duration)
 	return samples
 }
 
+// valueTransform returns the scale and offset of the values of the series
+// with labels: the ones of the first value transform matching its name, or
+// else the global ones.
+func (c *Client) valueTransform(labels []*prompb.Label) (float64, float64) {
+	if len(c.cfg.Read.ValueTransforms) == 0 {
+		return c.cfg.Read.ValueScale, c.cfg.Read.ValueOffset
+	}
+	name := ""
+	for _, l := range labels {
+		if l.Name == model.MetricNameLabel {
+			name = l.Value
+			break
+		}
+	}
+	for _, t := range c.cfg.Read.ValueTransforms {
+		if t.Name.MatchString(name) {
+			return t.Scale, t.Offset
+		}
+	}
+	return c.cfg.Read.ValueScale, c.cfg.Read.ValueOffset
+}
+
+// transformValues replaces the values of samples by value * scale + offset.
+// A zero scale leaves values unscaled.
+func transformValues(samples []prompb.Sample, scale float64, offset float64) {
+	if scale == 0 {
+		scale = 1
+	}
+	if scale == 1 && offset == 0 {
+		return
+	}
+	for i := range samples {
+		samples[i].Value = samples[i].Value*scale + offset
+	}
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -248,7 +630,7 @@ func min(a, b int) int {
 	return b
 }
 
-func (c *Client) handleReadQuery(ctx context.Context, query *prompb.Query, graphitePrefix string) (*prompb.QueryResult, error) {
+func (c *Client) handleReadQuery(ctx context.Context, graphiteURL string, query *prompb.Query, targets []string, graphitePrefix string, forwardedParams map[string]string) (*prompb.QueryResult, error) {
 	queryResult := &prompb.QueryResult{}
 
 	now := int(time.Now().Unix())
@@ -258,65 +640,220 @@ func (c *Client) handleReadQuery(ctx context.Context, query *prompb.Query, graph
 	until = min(now-delta, until)
 
 	if until < from {
-		level.Debug(c.logger).Log("msg", "Skipping query with empty time range")
+		level.Debug(c.readLogger).Log("msg", "Skipping query with empty time range")
 		return queryResult, nil
 	}
-	fromStr := strconv.Itoa(from)
-	untilStr := strconv.Itoa(until)
+	windows := splitWindows(from, until, int(c.cfg.Read.WindowSplit.Seconds()))
+	if c.cfg.Read.RelativeTime && len(windows) == 1 {
+		windows[0] = relativeWindow(windows[0], now-from, now-until)
+	}
 
-	targets := []string{}
-	var err error
+	if c.cfg.Read.MaxTotalPoints > 0 && len(targets) > 0 {
+		forwardedParams = withMaxDataPoints(forwardedParams, c.cfg.Read.MaxTotalPoints/(len(targets)*len(windows)))
+	}
 
-	if c.cfg.EnableTags {
-		targets, err = c.queryToTargetsWithTags(ctx, query, graphitePrefix)
-	} else {
-		// If we don't have tags we try to emulate then with normal paths.
-		targets, err = c.queryToTargets(ctx, query, graphitePrefix)
+	level.Debug(c.readLogger).Log(
+		"targets", targets, "from", from, "until", until, "windows", len(windows), "msg", "Fetching data")
+	c.fetchData(ctx, graphiteURL, queryResult, targets, windows, graphitePrefix, forwardedParams)
+	if len(windows) > 1 {
+		queryResult.Timeseries = mergeTimeseries(queryResult.Timeseries, false)
 	}
-	if err != nil {
-		return nil, err
+	return queryResult, nil
+
+}
+
+// readWindow is a time range rendered at once, as graphite from and until.
+type readWindow struct {
+	from  string
+	until string
+}
+
+// splitWindows splits [from, until] into consecutive windows of at most
+// split seconds. A zero split returns a single window.
+func splitWindows(from int, until int, split int) []readWindow {
+	if split <= 0 {
+		return []readWindow{{strconv.Itoa(from), strconv.Itoa(until)}}
+	}
+	var windows []readWindow
+	for start := from; ; start += split {
+		end := min(start+split, until)
+		windows = append(windows, readWindow{strconv.Itoa(start), strconv.Itoa(end)})
+		if end >= until {
+			return windows
+		}
 	}
+}
 
-	level.Debug(c.logger).Log(
-		"targets", targets, "from", fromStr, "until", untilStr, "msg", "Fetching data")
-	c.fetchData(ctx, queryResult, targets, fromStr, untilStr, graphitePrefix)
-	return queryResult, nil
+// relativeTimeTolerance is the maximum difference, in seconds, between a time
+// offset and the whole number of minutes it is rounded to, e.g. the latency
+// between a dashboard computing "now" and the adapter doing so.
+const relativeTimeTolerance = 5
 
+// relativeTime returns the graphite relative time of offset seconds before
+// now, e.g. -6h, if offset is close to a whole number of minutes.
+func relativeTime(offset int) (string, bool) {
+	if offset < -relativeTimeTolerance {
+		return "", false
+	}
+	minutes := (offset + 30) / 60
+	if diff := offset - minutes*60; diff > relativeTimeTolerance || diff < -relativeTimeTolerance {
+		return "", false
+	}
+	switch {
+	case minutes == 0:
+		return "now", true
+	case minutes%(24*60) == 0:
+		return fmt.Sprintf("-%dd", minutes/(24*60)), true
+	case minutes%60 == 0:
+		return fmt.Sprintf("-%dh", minutes/60), true
+	default:
+		return fmt.Sprintf("-%dmin", minutes), true
+	}
+}
+
+// relativeWindow returns window with relative from and until, given their
+// offset from now in seconds, so that caches in front of graphite-web keyed on
+// them are hit by the same dashboard ranges. window is returned as is unless
+// both offsets are close to whole numbers of minutes.
+func relativeWindow(window readWindow, fromOffset int, untilOffset int) readWindow {
+	from, ok := relativeTime(fromOffset)
+	if !ok {
+		return window
+	}
+	until, ok := relativeTime(untilOffset)
+	if !ok {
+		return window
+	}
+	return readWindow{from, until}
+}
+
+// mergeTimeseries concatenates the samples of the series with the same
+// labels, read over several windows or from several backends. Samples at the
+// boundary of two windows may be read twice, only the last one is kept.
+// Backends may return different samples at a timestamp, the first one is
+// kept if keepFirst is set.
+func mergeTimeseries(series []*prompb.TimeSeries, keepFirst bool) []*prompb.TimeSeries {
+	var merged []*prompb.TimeSeries
+	byLabels := make(map[string]*prompb.TimeSeries)
+	for _, ts := range series {
+		key := labelsKey(ts.Labels)
+		if m, ok := byLabels[key]; ok {
+			m.Samples = append(m.Samples, ts.Samples...)
+			continue
+		}
+		byLabels[key] = ts
+		merged = append(merged, ts)
+	}
+
+	for _, ts := range merged {
+		sort.SliceStable(ts.Samples, func(i, j int) bool {
+			return ts.Samples[i].Timestamp < ts.Samples[j].Timestamp
+		})
+		samples := ts.Samples[:0]
+		for _, s := range ts.Samples {
+			if len(samples) > 0 && samples[len(samples)-1].Timestamp == s.Timestamp {
+				if keepFirst {
+					continue
+				}
+				samples = samples[:len(samples)-1]
+			}
+			samples = append(samples, s)
+		}
+		ts.Samples = samples
+	}
+	return merged
 }
 
-func (c *Client) fetchData(ctx context.Context, queryResult *prompb.QueryResult, targets []string, fromStr string, untilStr string, graphitePrefix string) {
-	input := make(chan string, len(targets))
+func labelsKey(labels []*prompb.Label) string {
+	var key strings.Builder
+	for _, l := range labels {
+		key.WriteString(l.Name)
+		key.WriteByte(0xff)
+		key.WriteString(l.Value)
+		key.WriteByte(0xff)
+	}
+	return key.String()
+}
+
+// withMaxDataPoints returns a copy of params limiting the points returned per
+// target to maxDataPoints, unless a lower limit was already forwarded.
+func withMaxDataPoints(params map[string]string, maxDataPoints int) map[string]string {
+	if maxDataPoints < 1 {
+		maxDataPoints = 1
+	}
+	if forwarded, err := strconv.Atoi(params["maxDataPoints"]); err == nil && forwarded < maxDataPoints {
+		return params
+	}
+	limited := make(map[string]string, len(params)+1)
+	for k, v := range params {
+		limited[k] = v
+	}
+	limited["maxDataPoints"] = strconv.Itoa(maxDataPoints)
+	return limited
+}
+
+// fetchTargets renders targets over window, ignoring the targets which fail as
+// it is better to return "some" data than nothing. When the render of a batch
+// of targets fails, they are rendered one by one to find the failing ones.
+func (c *Client) fetchTargets(ctx context.Context, graphiteURL string, targets []string, window readWindow, graphitePrefix string, forwardedParams map[string]string) []*prompb.TimeSeries {
+	ts, err := c.targetsToTimeseries(ctx, graphiteURL, targets, window.from, window.until, graphitePrefix, forwardedParams)
+	if err == nil {
+		return ts
+	}
+	if len(targets) == 1 {
+		level.Warn(c.readLogger).Log("target", targets[0], "from", window.from, "until", window.until,
+			"err", err, "msg", "Error fetching and parsing target datapoints")
+		return nil
+	}
+
+	level.Warn(c.readLogger).Log("targets", len(targets), "from", window.from, "until", window.until,
+		"err", err, "msg", "Error fetching and parsing a batch of targets, fetching them one by one")
+	ts = nil
+	for _, target := range targets {
+		ts = append(ts, c.fetchTargets(ctx, graphiteURL, []string{target}, window, graphitePrefix, forwardedParams)...)
+	}
+	return ts
+}
+
+func (c *Client) fetchData(ctx context.Context, graphiteURL string, queryResult *prompb.QueryResult, targets []string, windows []readWindow, graphitePrefix string, forwardedParams map[string]string) {
+	type job struct {
+		targets []string
+		window  readWindow
+	}
+	batchSize := c.cfg.Read.RenderBatchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	input := make(chan job, (len(targets)/batchSize+1)*len(windows))
 	output := make(chan *prompb.TimeSeries, len(targets)+1)
 
 	wg := sync.WaitGroup{}
 
-	// TODO: Send multiple targets per query, Graphite supports that.
 	// Start only a few workers to avoid killing graphite.
-	for i := 0; i < maxFetchWorkers; i++ {
+	workers := c.maxFetchWorkers
+	if workers < 1 {
+		workers = graphiteCfg.DefaultMaxFetchWorkers
+	}
+	for i := 0; i < workers; i++ {
 		wg.Add(1)
 
-		go func(fromStr string, untilStr string, ctx context.Context) {
+		go func(ctx context.Context) {
 			defer wg.Done()
 
-			for target := range input {
-				// We simply ignore errors here as it is better to return "some" data
-				// than nothing.
-				ts, err := c.targetToTimeseries(ctx, target, fromStr, untilStr, graphitePrefix)
-				if err != nil {
-					level.Warn(c.logger).Log("target", target, "err", err, "msg", "Error fetching and parsing target datapoints")
-				} else {
-					level.Debug(c.logger).Log("reading responses")
-					for _, t := range ts {
-						output <- t
-					}
+			for j := range input {
+				for _, t := range c.fetchTargets(ctx, graphiteURL, j.targets, j.window, graphitePrefix, forwardedParams) {
+					output <- t
 				}
 			}
-		}(fromStr, untilStr, ctx)
+		}(ctx)
 	}
 
-	// Feed the input.
-	for _, target := range targets {
-		input <- target
+	// Feed the input, batchSize targets per render.
+	for start := 0; start < len(targets); start += batchSize {
+		batch := targets[start:min(start+batchSize, len(targets))]
+		for _, window := range windows {
+			input <- job{batch, window}
+		}
 	}
 	close(input)
 
@@ -347,24 +884,122 @@ func (c *Client) fetchData(ctx context.Context, queryResult *prompb.QueryResult,
 
 // Read implements the client.Reader interface.
 func (c *Client) Read(req *prompb.ReadRequest, r *http.Request) (*prompb.ReadResponse, error) {
-	level.Debug(c.logger).Log("req", req, "msg", "Remote read")
+	level.Debug(c.readLogger).Log("req", req, "msg", "Remote read")
 
-	if c.cfg.Read.URL == "" {
+	if len(c.cfg.Read.URL) == 0 {
 		return nil, nil
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), c.readTimeout)
 	defer cancel()
 
-	graphitePrefix := c.cfg.StoragePrefixFromRequest(r)
+	if len(c.cfg.Read.URL) == 1 {
+		resp, err := c.readBackend(ctx, c.cfg.Read.URL[0], req, r)
+		if err != nil {
+			failedBackendReads.WithLabelValues(c.cfg.Read.URL[0]).Inc()
+		}
+		return resp, err
+	}
+
+	// Backends are read concurrently, their series merged in the order of
+	// the backends so that the first one wins on conflicting samples. The
+	// series of failed backends are left out, the read only fails when all
+	// of them do.
+	responses := make([]*prompb.ReadResponse, len(c.cfg.Read.URL))
+	errs := make([]error, len(c.cfg.Read.URL))
+	wg := sync.WaitGroup{}
+	for i, u := range c.cfg.Read.URL {
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			responses[i], errs[i] = c.readBackend(ctx, u, req, r)
+		}(i, u)
+	}
+	wg.Wait()
+	failed := 0
+	for i, err := range errs {
+		if err != nil {
+			level.Warn(c.readLogger).Log(
+				"graphite_web", c.cfg.Read.URL[i],
+				"err", err, "msg", "Error reading from graphite-web, its series are left out")
+			failedBackendReads.WithLabelValues(c.cfg.Read.URL[i]).Inc()
+			failed++
+		}
+	}
+	if failed == len(c.cfg.Read.URL) {
+		return nil, fmt.Errorf("error reading from every graphite-web backend, %s: %s", c.cfg.Read.URL[0], errs[0])
+	}
+
+	resp := &prompb.ReadResponse{Results: make([]*prompb.QueryResult, len(req.Queries))}
+	for i := range req.Queries {
+		var series []*prompb.TimeSeries
+		for j, backendResp := range responses {
+			if errs[j] != nil || backendResp == nil {
+				continue
+			}
+			series = append(series, backendResp.Results[i].Timeseries...)
+		}
+		resp.Results[i] = &prompb.QueryResult{Timeseries: mergeTimeseries(series, true)}
+	}
+	return resp, nil
+}
+
+// readBackend reads the queries of req from a single graphite-web backend.
+func (c *Client) readBackend(ctx context.Context, graphiteURL string, req *prompb.ReadRequest, r *http.Request) (*prompb.ReadResponse, error) {
+	graphitePrefix := c.format.NormalizePrefix(c.cfg.StoragePrefixFromRequest(r))
+	if c.cfg.Read.SchemaVersion != "" {
+		// The schema version node is read as part of the prefix.
+		graphitePrefix += c.cfg.Read.SchemaVersion + c.format.NodeSeparator()
+	}
+	forwardedParams := c.cfg.ForwardedParamsFromRequest(r)
+
+	var targets [][]string
+	var err error
+	if c.cfg.EnableTags {
+		targets = make([][]string, len(req.Queries))
+		for i, query := range req.Queries {
+			targets[i], err = c.queryToTargetsWithTags(ctx, graphiteURL, query, graphitePrefix)
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		// If we don't have tags we try to emulate then with normal paths.
+		targets, err = c.queriesToTargets(ctx, graphiteURL, req.Queries, graphitePrefix)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	resp := &prompb.ReadResponse{}
-	for _, query := range req.Queries {
-		queryResult, err := c.handleReadQuery(ctx, query, graphitePrefix)
+	for i, query := range req.Queries {
+		queryResult, err := c.handleReadQuery(ctx, graphiteURL, query, targets[i], graphitePrefix, forwardedParams)
 		if err != nil {
 			return nil, err
 		}
 		resp.Results = append(resp.Results, queryResult)
 	}
+	if c.sourceLabel != "" {
+		setSourceLabel(resp, c.sourceLabel, graphiteURL)
+	}
 	return resp, nil
 }
+
+// setSourceLabel sets the name label to value on every series of resp,
+// overriding any label of the same name read from graphite.
+func setSourceLabel(resp *prompb.ReadResponse, name string, value string) {
+	for _, result := range resp.Results {
+		for _, ts := range result.Timeseries {
+			found := false
+			for _, l := range ts.Labels {
+				if l.Name == name {
+					l.Value = value
+					found = true
+				}
+			}
+			if !found {
+				ts.Labels = append(ts.Labels, &prompb.Label{Name: name, Value: value})
+			}
+		}
+	}
+}
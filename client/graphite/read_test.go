@@ -15,14 +15,25 @@ package graphite
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/url"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	graphiteCfg "github.com/criteo/graphite-remote-adapter/client/graphite/config"
+	"github.com/criteo/graphite-remote-adapter/client/graphite/paths"
+	"github.com/criteo/graphite-remote-adapter/utils"
 	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/prompb"
+	yaml "gopkg.in/yaml.v2"
 
 	"golang.org/x/net/context"
 )
@@ -38,7 +49,7 @@ var (
 	}
 )
 
-func fakeFetchExpandURL(ctx context.Context, l log.Logger, u *url.URL) ([]byte, error) {
+func fakeFetchExpandURL(ctx context.Context, client *http.Client, l log.Logger, method string, u *url.URL, maxBytes int64) ([]byte, error) {
 	var body bytes.Buffer
 	if u.String() == "http://fakeHost:6666/metrics/expand?format=json&leavesOnly=1&query=prometheus-prefix.test.%2A%2A" {
 		body.WriteString("{\"results\": [\"prometheus-prefix.test.owner.team-X\", \"prometheus-prefix.test.owner.team-Y\"]}")
@@ -46,9 +57,9 @@ func fakeFetchExpandURL(ctx context.Context, l log.Logger, u *url.URL) ([]byte,
 	return body.Bytes(), nil
 }
 
-func fakeFetchRenderURL(ctx context.Context, l log.Logger, u *url.URL) ([]byte, error) {
+func fakeFetchRenderURL(ctx context.Context, client *http.Client, l log.Logger, method string, u *url.URL, maxBytes int64) ([]byte, error) {
 	var body bytes.Buffer
-	if u.String() == "http://fakeHost:6666/render/?format=json&from=0&target=prometheus-prefix.test.owner.team-X&until=300" {
+	if u.String() == "http://fakeHost:6666/render/?format=json&from=0&target=alias%28prometheus-prefix.test.owner.team-X%2C%22prometheus-prefix.test.owner.team-X%22%29&until=300" {
 		body.WriteString("[{\"target\": \"prometheus-prefix.test.owner.team-X\", \"datapoints\": [[18,0], [42,300]]}]")
 	} else if u.String() == "http://fakeHost:6666/render/?format=json&from=0&target=seriesByTag%28%22name%3Dprometheus-prefix.test%22%2C%22owner%3Dteam-x%22%29&until=300" {
 		body.WriteString("[")
@@ -77,7 +88,48 @@ func TestQueryToTargets(t *testing.T) {
 		Matchers:         labelMatchers,
 	}
 
-	actualTargets, _ := testClient.queryToTargets(nil, query, testClient.cfg.DefaultPrefix)
+	actualTargets, _ := testClient.queryToTargets(nil, testClient.cfg.Read.URL[0], query, testClient.cfg.DefaultPrefix)
+	if !reflect.DeepEqual(expectedTargets, actualTargets) {
+		t.Errorf("Expected %s, got %s", expectedTargets, actualTargets)
+	}
+}
+
+func TestQueriesToTargets(t *testing.T) {
+	fetchURL = func(ctx context.Context, client *http.Client, l log.Logger, method string, u *url.URL, maxBytes int64) ([]byte, error) {
+		var body bytes.Buffer
+		if u.String() == "http://fakeHost:6666/metrics/expand?format=json&leavesOnly=1&query=prometheus-prefix.test.%2A%2A&query=prometheus-prefix.other.%2A%2A" {
+			body.WriteString("{\"results\": [\"prometheus-prefix.test.owner.team-X\", \"prometheus-prefix.other.owner.team-X\", \"prometheus-prefix.test.owner.team-Y\"]}")
+		}
+		return body.Bytes(), nil
+	}
+	queries := []*prompb.Query{
+		&prompb.Query{
+			Matchers: []*prompb.LabelMatcher{
+				&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "test"},
+			},
+		},
+		&prompb.Query{
+			Matchers: []*prompb.LabelMatcher{
+				&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "other"},
+			},
+		},
+		&prompb.Query{
+			Matchers: []*prompb.LabelMatcher{
+				&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "test"},
+				&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "owner", Value: "team-Y"},
+			},
+		},
+	}
+	expectedTargets := [][]string{
+		{"prometheus-prefix.test.owner.team-X", "prometheus-prefix.test.owner.team-Y"},
+		{"prometheus-prefix.other.owner.team-X"},
+		{"prometheus-prefix.test.owner.team-Y"},
+	}
+
+	actualTargets, err := testClient.queriesToTargets(nil, testClient.cfg.Read.URL[0], queries, testClient.cfg.DefaultPrefix)
+	if err != nil {
+		t.Errorf("Unexpected err: %s", err)
+	}
 	if !reflect.DeepEqual(expectedTargets, actualTargets) {
 		t.Errorf("Expected %s, got %s", expectedTargets, actualTargets)
 	}
@@ -95,7 +147,7 @@ func TestInvalidQueryToTargets(t *testing.T) {
 		Matchers:         labelMatchers,
 	}
 
-	_, err := testClient.queryToTargets(nil, invalidQuery, testClient.cfg.DefaultPrefix)
+	_, err := testClient.queryToTargets(nil, testClient.cfg.Read.URL[0], invalidQuery, testClient.cfg.DefaultPrefix)
 	if !reflect.DeepEqual(err, expectedErr) {
 		t.Errorf("Error from queryToTargets not returned.  Expected %v, got %v", expectedErr, err)
 	}
@@ -108,7 +160,7 @@ func TestTargetToTimeseries(t *testing.T) {
 		Samples: expectedSamples,
 	}
 
-	actualTs, err := testClient.targetToTimeseries(nil, "prometheus-prefix.test.owner.team-X", "0", "300", testClient.cfg.DefaultPrefix)
+	actualTs, err := testClient.targetToTimeseries(nil, testClient.cfg.Read.URL[0], "prometheus-prefix.test.owner.team-X", "0", "300", testClient.cfg.DefaultPrefix, nil)
 	if !reflect.DeepEqual(err, nil) {
 		t.Errorf("Expected no err, got %s", err)
 	}
@@ -117,6 +169,572 @@ func TestTargetToTimeseries(t *testing.T) {
 	}
 }
 
+func TestTargetToTimeseriesWithMetricTypes(t *testing.T) {
+	fetchURL = fakeFetchRenderURL
+	testClient.cfg.Read.MetricTypes = map[string]string{"test": "gauge"}
+	defer func() { testClient.cfg.Read.MetricTypes = nil }()
+
+	actualTs, err := testClient.targetToTimeseries(nil, testClient.cfg.Read.URL[0], "prometheus-prefix.test.owner.team-X", "0", "300", testClient.cfg.DefaultPrefix, nil)
+	if err != nil {
+		t.Fatalf("Unexpected err: %s", err)
+	}
+	expectedTypedLabels := append(append([]*prompb.Label{}, expectedLabels...), &prompb.Label{Name: paths.TypeLabel, Value: "gauge"})
+	if !reflect.DeepEqual(expectedTypedLabels, actualTs[0].Labels) {
+		t.Errorf("Expected %s, got %s", expectedTypedLabels, actualTs[0].Labels)
+	}
+}
+
+func TestTargetToTimeseriesWithTags(t *testing.T) {
+	fetchURL = func(ctx context.Context, client *http.Client, l log.Logger, method string, u *url.URL, maxBytes int64) ([]byte, error) {
+		// The name of the series doesn't hold its tags once functions are applied.
+		return []byte(`[{"target": "scale(prometheus-prefix.test,2)",
+			"tags": {"owner": "team-X", "name": "prometheus-prefix.test", "instance": "host-1"},
+			"datapoints": [[1,0]]}]`), nil
+	}
+	testClient.cfg.EnableTags = true
+	defer func() { testClient.cfg.EnableTags = false }()
+
+	actualTs, err := testClient.targetToTimeseries(nil, testClient.cfg.Read.URL[0], "seriesByTag(\"name=prometheus-prefix.test\")", "0", "300", testClient.cfg.DefaultPrefix, nil)
+	if err != nil {
+		t.Fatalf("Unexpected err: %s", err)
+	}
+	expectedTagLabels := []*prompb.Label{
+		{Name: "instance", Value: "host-1"},
+		{Name: model.MetricNameLabel, Value: "test"},
+		{Name: "owner", Value: "team-X"},
+	}
+	if !reflect.DeepEqual(expectedTagLabels, actualTs[0].Labels) {
+		t.Errorf("Expected %s, got %s", expectedTagLabels, actualTs[0].Labels)
+	}
+}
+
+func TestTargetToTimeseriesWithRenderPath(t *testing.T) {
+	var fetchedURL string
+	fetchURL = func(ctx context.Context, client *http.Client, l log.Logger, method string, u *url.URL, maxBytes int64) ([]byte, error) {
+		fetchedURL = u.String()
+		return []byte("[]"), nil
+	}
+	testClient.cfg.Read.RenderPath = "/render"
+	_, err := testClient.targetToTimeseries(nil, testClient.cfg.Read.URL[0], "prometheus-prefix.test.owner.team-X", "0", "300", testClient.cfg.DefaultPrefix, nil)
+	testClient.cfg.Read.RenderPath = "/render/"
+	if err != nil {
+		t.Errorf("Unexpected err: %s", err)
+	}
+
+	expectedURL := "http://fakeHost:6666/render?format=json&from=0&target=alias%28prometheus-prefix.test.owner.team-X%2C%22prometheus-prefix.test.owner.team-X%22%29&until=300"
+	if expectedURL != fetchedURL {
+		t.Errorf("Expected %s, got %s", expectedURL, fetchedURL)
+	}
+}
+
+func TestTargetToTimeseriesWithCSV(t *testing.T) {
+	var fetchedURL string
+	fetchURL = func(ctx context.Context, client *http.Client, l log.Logger, method string, u *url.URL, maxBytes int64) ([]byte, error) {
+		fetchedURL = u.String()
+		return []byte("prometheus-prefix.test.owner.team-X,1970-01-01 00:00:00,18\r\n" +
+			"prometheus-prefix.test.owner.team-X,1970-01-01 00:02:30,\r\n" +
+			"prometheus-prefix.test.owner.team-X,300,42.0\r\n"), nil
+	}
+	testClient.cfg.Read.RenderFormat = graphiteCfg.RenderFormatCSV
+	defer func() { testClient.cfg.Read.RenderFormat = "" }()
+
+	actualTs, err := testClient.targetToTimeseries(nil, testClient.cfg.Read.URL[0], "prometheus-prefix.test.owner.team-X", "0", "300", testClient.cfg.DefaultPrefix, nil)
+	if err != nil {
+		t.Fatalf("Unexpected err: %s", err)
+	}
+	expectedURL := "http://fakeHost:6666/render/?format=csv&from=0&target=alias%28prometheus-prefix.test.owner.team-X%2C%22prometheus-prefix.test.owner.team-X%22%29&tz=UTC&until=300"
+	if expectedURL != fetchedURL {
+		t.Errorf("Expected %s, got %s", expectedURL, fetchedURL)
+	}
+	expectedTs := &prompb.TimeSeries{Labels: expectedLabels, Samples: expectedSamples}
+	if len(actualTs) != 1 || !reflect.DeepEqual(expectedTs, actualTs[0]) {
+		t.Errorf("Expected %s, got %s", expectedTs, actualTs)
+	}
+}
+
+func TestParseRenderCSV(t *testing.T) {
+	body := "\"a;owner=team-X\",1970-01-01 00:01:00,1\nb,60,2\na;owner=team-X,120,\n"
+	renderResponses, err := parseRenderCSV([]byte(body))
+	if err != nil {
+		t.Fatalf("Unexpected err: %s", err)
+	}
+	if len(renderResponses) != 2 {
+		t.Fatalf("Expected 2 series, got %d", len(renderResponses))
+	}
+	expectedTags := Tags{"name": "a", "owner": "team-X"}
+	if renderResponses[0].Target != "a;owner=team-X" || !reflect.DeepEqual(expectedTags, renderResponses[0].Tags) {
+		t.Errorf("Expected target a;owner=team-X with tags %v, got %+v", expectedTags, renderResponses[0])
+	}
+	if len(renderResponses[0].Datapoints) != 2 || renderResponses[0].Datapoints[1].Value != nil {
+		t.Errorf("Expected a value and a null datapoint, got %+v", renderResponses[0].Datapoints)
+	}
+	if renderResponses[1].Tags != nil || renderResponses[1].Datapoints[0].Timestamp != 60 {
+		t.Errorf("Expected an untagged series at 60, got %+v", renderResponses[1])
+	}
+
+	for _, invalid := range []string{"a,60\n", "a,yesterday,1\n", "a,60,one\n"} {
+		if _, err := parseRenderCSV([]byte(invalid)); err == nil {
+			t.Errorf("Expected an error parsing %q", invalid)
+		}
+	}
+}
+
+func TestTargetToTimeseriesRetryOnEmpty(t *testing.T) {
+	renders := 0
+	fetchURL = func(ctx context.Context, client *http.Client, l log.Logger, method string, u *url.URL, maxBytes int64) ([]byte, error) {
+		renders++
+		if renders == 1 {
+			return []byte("[{\"target\": \"prometheus-prefix.test.owner.team-X\", \"datapoints\": [[null,0]]}]"), nil
+		}
+		return fakeFetchRenderURL(ctx, client, l, method, u, maxBytes)
+	}
+	testClient.cfg.Read.RetryOnEmpty = time.Millisecond
+	defer func() { testClient.cfg.Read.RetryOnEmpty = 0 }()
+
+	actualTs, err := testClient.targetToTimeseries(context.Background(), testClient.cfg.Read.URL[0], "prometheus-prefix.test.owner.team-X", "0", "300", testClient.cfg.DefaultPrefix, nil)
+	if err != nil {
+		t.Fatalf("Unexpected err: %s", err)
+	}
+	if renders != 2 {
+		t.Errorf("Expected 2 renders, got %d", renders)
+	}
+	if !reflect.DeepEqual(expectedSamples, actualTs[0].Samples) {
+		t.Errorf("Expected %v, got %v", expectedSamples, actualTs[0].Samples)
+	}
+}
+
+func TestSplitWindows(t *testing.T) {
+	expected := []readWindow{{"0", "100"}, {"100", "200"}, {"200", "250"}}
+	if actual := splitWindows(0, 250, 100); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+	expected = []readWindow{{"0", "250"}}
+	if actual := splitWindows(0, 250, 0); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+}
+
+func TestRelativeTime(t *testing.T) {
+	for offset, expected := range map[int]string{
+		0:     "now",
+		-2:    "now",
+		3:     "now",
+		3600:  "-1h",
+		21602: "-6h",
+		86398: "-1d",
+		90000: "-25h",
+		300:   "-5min",
+	} {
+		actual, ok := relativeTime(offset)
+		if !ok || actual != expected {
+			t.Errorf("Expected %s for %d, got %s", expected, offset, actual)
+		}
+	}
+	for _, offset := range []int{10, 3630, -60} {
+		if actual, ok := relativeTime(offset); ok {
+			t.Errorf("Expected no relative time for %d, got %s", offset, actual)
+		}
+	}
+
+	window := readWindow{"1000", "2000"}
+	if actual := relativeWindow(window, 3601, 0); !reflect.DeepEqual(readWindow{"-1h", "now"}, actual) {
+		t.Errorf("Expected a relative window, got %v", actual)
+	}
+	if actual := relativeWindow(window, 3601, 30); !reflect.DeepEqual(window, actual) {
+		t.Errorf("Expected %v, got %v", window, actual)
+	}
+}
+
+func TestHandleReadQueryWithWindowSplit(t *testing.T) {
+	var lock sync.Mutex
+	var windows []string
+	fetchURL = func(ctx context.Context, client *http.Client, l log.Logger, method string, u *url.URL, maxBytes int64) ([]byte, error) {
+		from, until := u.Query().Get("from"), u.Query().Get("until")
+		lock.Lock()
+		windows = append(windows, from+"-"+until)
+		lock.Unlock()
+		// Graphite returns the datapoints at both ends of the window.
+		return []byte(fmt.Sprintf(
+			"[{\"target\": \"prometheus-prefix.test.owner.team-X\", \"datapoints\": [[%s,%s], [%s,%s]]}]",
+			from, from, until, until)), nil
+	}
+	testClient.cfg.Read.WindowSplit = 300 * time.Second
+	defer func() { testClient.cfg.Read.WindowSplit = 0 }()
+
+	query := &prompb.Query{StartTimestampMs: 0, EndTimestampMs: 600000}
+	result, err := testClient.handleReadQuery(context.Background(), testClient.cfg.Read.URL[0], query, []string{"prometheus-prefix.test.owner.team-X"}, testClient.cfg.DefaultPrefix, nil)
+	if err != nil {
+		t.Fatalf("Unexpected err: %s", err)
+	}
+
+	sort.Strings(windows)
+	if expected := []string{"0-300", "300-600"}; !reflect.DeepEqual(expected, windows) {
+		t.Errorf("Expected %v, got %v", expected, windows)
+	}
+	expected := []*prompb.TimeSeries{{
+		Labels: expectedLabels,
+		Samples: []prompb.Sample{
+			{Value: 0, Timestamp: 0},
+			{Value: 300, Timestamp: 300000},
+			{Value: 600, Timestamp: 600000},
+		},
+	}}
+	if !reflect.DeepEqual(expected, result.Timeseries) {
+		t.Errorf("Expected %v, got %v", expected, result.Timeseries)
+	}
+}
+
+func TestReadFromSeveralBackends(t *testing.T) {
+	fetchURL = func(ctx context.Context, client *http.Client, l log.Logger, method string, u *url.URL, maxBytes int64) ([]byte, error) {
+		if u.Path == "/metrics/expand" {
+			if u.Host == "shard-1" {
+				return []byte(`{"results": ["prometheus-prefix.test.owner.team-X"]}`), nil
+			}
+			return []byte(`{"results": ["prometheus-prefix.test.owner.team-X", "prometheus-prefix.test.owner.team-Y"]}`), nil
+		}
+		path := strings.SplitN(strings.TrimPrefix(u.Query().Get("target"), "alias("), ",", 2)[0]
+		datapoints := "[[17,0], [42,300]]"
+		if u.Host == "shard-1" {
+			// The first backend wins on conflicting samples, not on null ones.
+			datapoints = "[[18,0], [null,300]]"
+		}
+		return []byte(fmt.Sprintf(`[{"target": "%s", "datapoints": %s}]`, path, datapoints)), nil
+	}
+	c := &Client{
+		readLogger:  log.NewNopLogger(),
+		readTimeout: time.Second,
+		cfg: &graphiteCfg.Config{
+			DefaultPrefix: "prometheus-prefix.",
+			Read: graphiteCfg.ReadConfig{
+				URL:        graphiteCfg.URLList{"http://shard-1", "http://shard-2"},
+				RenderPath: "/render/",
+				ExpandPath: "/metrics/expand",
+			},
+		},
+	}
+
+	req := &prompb.ReadRequest{Queries: []*prompb.Query{{
+		StartTimestampMs: 0,
+		EndTimestampMs:   300000,
+		Matchers: []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "test"},
+		},
+	}}}
+	r, _ := http.NewRequest("POST", "http://fakeHost:6666/read", nil)
+	resp, err := c.Read(req, r)
+	if err != nil {
+		t.Fatalf("Unexpected err: %s", err)
+	}
+
+	series := resp.Results[0].Timeseries
+	sort.Slice(series, func(i, j int) bool { return labelsKey(series[i].Labels) < labelsKey(series[j].Labels) })
+	expected := []*prompb.TimeSeries{
+		{Labels: expectedLabels, Samples: expectedSamples},
+		{
+			Labels: []*prompb.Label{
+				{Name: model.MetricNameLabel, Value: "test"},
+				{Name: "owner", Value: "team-Y"},
+			},
+			Samples: []prompb.Sample{{Value: 17, Timestamp: 0}, {Value: 42, Timestamp: 300000}},
+		},
+	}
+	if !reflect.DeepEqual(expected, series) {
+		t.Errorf("Expected %v, got %v", expected, series)
+	}
+}
+
+func TestReadWithSourceLabel(t *testing.T) {
+	fetchURL = func(ctx context.Context, client *http.Client, l log.Logger, method string, u *url.URL, maxBytes int64) ([]byte, error) {
+		if u.Path == "/metrics/expand" {
+			return []byte(`{"results": ["prometheus-prefix.test.owner.team-X"]}`), nil
+		}
+		path := strings.SplitN(strings.TrimPrefix(u.Query().Get("target"), "alias("), ",", 2)[0]
+		datapoints := "[[17,0], [42,300]]"
+		if u.Host == "shard-1" {
+			datapoints = "[[18,0], [42,300]]"
+		}
+		return []byte(fmt.Sprintf(`[{"target": "%s", "datapoints": %s}]`, path, datapoints)), nil
+	}
+	c := &Client{
+		readLogger:  log.NewNopLogger(),
+		readTimeout: time.Second,
+		sourceLabel: "source",
+		cfg: &graphiteCfg.Config{
+			DefaultPrefix: "prometheus-prefix.",
+			Read: graphiteCfg.ReadConfig{
+				URL:        graphiteCfg.URLList{"http://shard-1", "http://shard-2"},
+				RenderPath: "/render/",
+				ExpandPath: "/metrics/expand",
+			},
+		},
+	}
+
+	req := &prompb.ReadRequest{Queries: []*prompb.Query{{
+		StartTimestampMs: 0,
+		EndTimestampMs:   300000,
+		Matchers: []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "test"},
+		},
+	}}}
+	r, _ := http.NewRequest("POST", "http://fakeHost:6666/read", nil)
+	resp, err := c.Read(req, r)
+	if err != nil {
+		t.Fatalf("Unexpected err: %s", err)
+	}
+
+	// Each series keeps the URL of its backend instead of being merged.
+	series := resp.Results[0].Timeseries
+	sort.Slice(series, func(i, j int) bool { return labelsKey(series[i].Labels) < labelsKey(series[j].Labels) })
+	expected := []*prompb.TimeSeries{
+		{
+			Labels:  append(append([]*prompb.Label{}, expectedLabels...), &prompb.Label{Name: "source", Value: "http://shard-1"}),
+			Samples: expectedSamples,
+		},
+		{
+			Labels:  append(append([]*prompb.Label{}, expectedLabels...), &prompb.Label{Name: "source", Value: "http://shard-2"}),
+			Samples: []prompb.Sample{{Value: 17, Timestamp: 0}, {Value: 42, Timestamp: 300000}},
+		},
+	}
+	if !reflect.DeepEqual(expected, series) {
+		t.Errorf("Expected %v, got %v", expected, series)
+	}
+}
+
+func TestSetSourceLabel(t *testing.T) {
+	resp := &prompb.ReadResponse{
+		Results: []*prompb.QueryResult{{
+			Timeseries: []*prompb.TimeSeries{
+				{Labels: []*prompb.Label{{Name: model.MetricNameLabel, Value: "test"}}},
+				{Labels: []*prompb.Label{{Name: model.MetricNameLabel, Value: "test"}, {Name: "source", Value: "other"}}},
+			},
+		}},
+	}
+
+	setSourceLabel(resp, "source", "http://graphite")
+
+	expected := []*prompb.TimeSeries{
+		{Labels: []*prompb.Label{{Name: model.MetricNameLabel, Value: "test"}, {Name: "source", Value: "http://graphite"}}},
+		{Labels: []*prompb.Label{{Name: model.MetricNameLabel, Value: "test"}, {Name: "source", Value: "http://graphite"}}},
+	}
+	if !reflect.DeepEqual(expected, resp.Results[0].Timeseries) {
+		t.Errorf("Expected %v, got %v", expected, resp.Results[0].Timeseries)
+	}
+}
+
+func TestReadWithFailedBackend(t *testing.T) {
+	var failing map[string]bool
+	fetchURL = func(ctx context.Context, client *http.Client, l log.Logger, method string, u *url.URL, maxBytes int64) ([]byte, error) {
+		if failing[u.Host] {
+			return nil, fmt.Errorf("%s is down", u.Host)
+		}
+		if u.Path == "/metrics/expand" {
+			return []byte(`{"results": ["prometheus-prefix.test.owner.team-X"]}`), nil
+		}
+		path := strings.SplitN(strings.TrimPrefix(u.Query().Get("target"), "alias("), ",", 2)[0]
+		return []byte(fmt.Sprintf(`[{"target": "%s", "datapoints": [[18,0], [42,300]]}]`, path)), nil
+	}
+	c := &Client{
+		readLogger:  log.NewNopLogger(),
+		readTimeout: time.Second,
+		cfg: &graphiteCfg.Config{
+			DefaultPrefix: "prometheus-prefix.",
+			Read: graphiteCfg.ReadConfig{
+				URL:        graphiteCfg.URLList{"http://shard-1", "http://shard-2"},
+				RenderPath: "/render/",
+				ExpandPath: "/metrics/expand",
+			},
+		},
+	}
+
+	req := &prompb.ReadRequest{Queries: []*prompb.Query{{
+		StartTimestampMs: 0,
+		EndTimestampMs:   300000,
+		Matchers: []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "test"},
+		},
+	}}}
+	r, _ := http.NewRequest("POST", "http://fakeHost:6666/read", nil)
+
+	// The series of the other backend are still returned.
+	failing = map[string]bool{"shard-1": true}
+	failedBefore := testutil.ToFloat64(failedBackendReads.WithLabelValues("http://shard-1"))
+	resp, err := c.Read(req, r)
+	if err != nil {
+		t.Fatalf("Unexpected err: %s", err)
+	}
+	expected := []*prompb.TimeSeries{{Labels: expectedLabels, Samples: expectedSamples}}
+	if !reflect.DeepEqual(expected, resp.Results[0].Timeseries) {
+		t.Errorf("Expected %v, got %v", expected, resp.Results[0].Timeseries)
+	}
+	if failed := testutil.ToFloat64(failedBackendReads.WithLabelValues("http://shard-1")) - failedBefore; failed != 1 {
+		t.Errorf("Expected 1 failed backend read, got %v", failed)
+	}
+
+	failing = map[string]bool{"shard-1": true, "shard-2": true}
+	if _, err := c.Read(req, r); err == nil {
+		t.Error("Expected err when every backend fails")
+	}
+}
+
+func TestFetchDataWithRenderBatchSize(t *testing.T) {
+	var lock sync.Mutex
+	var requests []string
+	fetchURL = func(ctx context.Context, client *http.Client, l log.Logger, method string, u *url.URL, maxBytes int64) ([]byte, error) {
+		var names []string
+		var responses []string
+		for _, target := range u.Query()["target"] {
+			// Targets are aliased as alias(<path>,"<path>").
+			path := strings.SplitN(strings.TrimPrefix(target, "alias("), ",", 2)[0]
+			names = append(names, strings.TrimPrefix(path, "prometheus-prefix.test.owner."))
+			responses = append(responses, fmt.Sprintf("{\"target\": \"%s\", \"datapoints\": [[18,0]]}", path))
+		}
+		lock.Lock()
+		requests = append(requests, strings.Join(names, ","))
+		lock.Unlock()
+		for _, name := range names {
+			if name == "team-C" {
+				return nil, fmt.Errorf("failed to render %s", name)
+			}
+		}
+		return []byte("[" + strings.Join(responses, ",") + "]"), nil
+	}
+	testClient.cfg.Read.RenderBatchSize = 2
+	defer func() { testClient.cfg.Read.RenderBatchSize = 0 }()
+
+	var targets []string
+	for _, team := range []string{"A", "B", "C", "D", "E"} {
+		targets = append(targets, "prometheus-prefix.test.owner.team-"+team)
+	}
+	result := &prompb.QueryResult{}
+	windows := []readWindow{{"0", "300"}}
+	testClient.fetchData(context.Background(), testClient.cfg.Read.URL[0], result, targets, windows, testClient.cfg.DefaultPrefix, nil)
+
+	// The batch of the failing target is rendered again one target at a time.
+	sort.Strings(requests)
+	expected := []string{"team-A,team-B", "team-C", "team-C,team-D", "team-D", "team-E"}
+	if !reflect.DeepEqual(expected, requests) {
+		t.Errorf("Expected requests %v, got %v", expected, requests)
+	}
+	var owners []string
+	for _, ts := range result.Timeseries {
+		for _, l := range ts.Labels {
+			if l.Name == "owner" {
+				owners = append(owners, l.Value)
+			}
+		}
+	}
+	sort.Strings(owners)
+	if expected := []string{"team-A", "team-B", "team-D", "team-E"}; !reflect.DeepEqual(expected, owners) {
+		t.Errorf("Expected series of %v, got %v", expected, owners)
+	}
+}
+
+func TestQueriesToTargetsWithLeadingLabels(t *testing.T) {
+	defer func() { fetchURL = utils.FetchURL }()
+	var patterns []string
+	fetchURL = func(ctx context.Context, client *http.Client, l log.Logger, method string, u *url.URL, maxBytes int64) ([]byte, error) {
+		patterns = u.Query()["query"]
+		return []byte(`{"results": [
+			"prometheus-prefix.test.job.node.instance.host-1.owner.team-X",
+			"prometheus-prefix.test.job.node.instance.host-2.owner.team-Y",
+			"prometheus-prefix.test.job.node.instance.host-2.owner.team-Y"
+		]}`), nil
+	}
+	cfg := *testClient.cfg
+	c := &Client{
+		readLogger: log.NewNopLogger(),
+		cfg:        &cfg,
+		format:     paths.Format{Type: paths.FormatCarbon, LeadingLabels: []string{"job", "instance", "owner"}},
+	}
+
+	eq := func(name, value string) *prompb.LabelMatcher {
+		return &prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: name, Value: value}
+	}
+	re := func(name, value string) *prompb.LabelMatcher {
+		return &prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: name, Value: value}
+	}
+	queries := []*prompb.Query{
+		// EQ matchers of leading labels are part of the pattern, in order.
+		{Matchers: []*prompb.LabelMatcher{eq(model.MetricNameLabel, "test"), eq("instance", "host-1"), eq("job", "node")}},
+		// RE matchers stop the pattern, and are applied to the expanded paths.
+		{Matchers: []*prompb.LabelMatcher{eq(model.MetricNameLabel, "test"), eq("job", "node"), re("instance", "host-2|host-3"), eq("owner", "team-Y")}},
+		// Values are escaped like in written paths, globs aren't used.
+		{Matchers: []*prompb.LabelMatcher{eq(model.MetricNameLabel, "test"), eq("job", "a.b"), eq("instance", "*")}},
+		// Leaves whose only labels are the matched ones are found too.
+		{Matchers: []*prompb.LabelMatcher{eq(model.MetricNameLabel, "test"), eq("job", "node"), eq("instance", "host-1"), eq("owner", "team-X")}},
+	}
+
+	// Without expand_leading_labels, all the paths of the name are expanded.
+	targets, err := c.queriesToTargets(nil, c.cfg.Read.URL[0], queries, c.cfg.DefaultPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"prometheus-prefix.test.**"}; !reflect.DeepEqual(expected, patterns) {
+		t.Errorf("Expected patterns %q, got %q", expected, patterns)
+	}
+	if len(targets[3]) != 1 {
+		t.Errorf("Expected a single target, got %q", targets[3])
+	}
+
+	cfg.Read.ExpandLeadingLabels = true
+	targets, err = c.queriesToTargets(nil, c.cfg.Read.URL[0], queries, c.cfg.DefaultPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedPatterns := []string{
+		"prometheus-prefix.test.job.node.instance.host-1",
+		"prometheus-prefix.test.job.node.instance.host-1.**",
+		"prometheus-prefix.test.job.node",
+		"prometheus-prefix.test.job.node.**",
+		"prometheus-prefix.test.job.a%2Eb",
+		"prometheus-prefix.test.job.a%2Eb.**",
+		"prometheus-prefix.test.job.node.instance.host-1.owner.team-X",
+		"prometheus-prefix.test.job.node.instance.host-1.owner.team-X.**",
+	}
+	if !reflect.DeepEqual(expectedPatterns, patterns) {
+		t.Errorf("Expected patterns %q, got %q", expectedPatterns, patterns)
+	}
+	expectedTargets := [][]string{
+		{"prometheus-prefix.test.job.node.instance.host-1.owner.team-X"},
+		{"prometheus-prefix.test.job.node.instance.host-2.owner.team-Y"},
+		nil,
+		{"prometheus-prefix.test.job.node.instance.host-1.owner.team-X"},
+	}
+	if !reflect.DeepEqual(expectedTargets, targets) {
+		t.Errorf("Expected targets %q, got %q", expectedTargets, targets)
+	}
+}
+
+func TestAliasTarget(t *testing.T) {
+	target := "prometheus-prefix.test.owner.team-X.interface.Hu0%2F0%2F1"
+	expected := "alias(prometheus-prefix.test.owner.team-X.interface.Hu0%2F0%2F1,\"prometheus-prefix.test.owner.team-X.interface.Hu0%2F0%2F1\")"
+	if actual := aliasTarget(target); expected != actual {
+		t.Errorf("Expected %s, got %s", expected, actual)
+	}
+}
+
+func TestRenderTarget(t *testing.T) {
+	c := &Client{cfg: &graphiteCfg.Config{}}
+	var tests = []struct {
+		enableTags        bool
+		removeEmptySeries bool
+		target            string
+		expected          string
+	}{
+		{false, false, "prefix.test", "alias(prefix.test,\"prefix.test\")"},
+		{false, true, "prefix.test", "removeEmptySeries(alias(prefix.test,\"prefix.test\"))"},
+		{true, false, "seriesByTag(\"name=prefix.test\")", "seriesByTag(\"name=prefix.test\")"},
+		{true, true, "seriesByTag(\"name=prefix.test\")", "removeEmptySeries(seriesByTag(\"name=prefix.test\"))"},
+	}
+	for _, test := range tests {
+		c.cfg.EnableTags = test.enableTags
+		c.cfg.Read.RemoveEmptySeries = test.removeEmptySeries
+		if actual := c.renderTarget(test.target); actual != test.expected {
+			t.Errorf("Expected %s, got %s", test.expected, actual)
+		}
+	}
+}
+
 func TestQueryTargetsWithTags(t *testing.T) {
 	fetchURL = fakeFetchRenderURL
 
@@ -150,7 +768,7 @@ func TestQueryTargetsWithTags(t *testing.T) {
 	}
 
 	testClient.cfg.EnableTags = true
-	targets, err := testClient.queryToTargetsWithTags(nil, query, testClient.cfg.DefaultPrefix)
+	targets, err := testClient.queryToTargetsWithTags(nil, testClient.cfg.Read.URL[0], query, testClient.cfg.DefaultPrefix)
 	if err != nil {
 		t.Errorf("Unexpected err: %s", err)
 	}
@@ -158,7 +776,7 @@ func TestQueryTargetsWithTags(t *testing.T) {
 		t.Errorf("Expected %s, got %s", expectedTargets, targets)
 	}
 
-	actualTs, err := testClient.targetToTimeseries(nil, targets[0], "0", "300", testClient.cfg.DefaultPrefix)
+	actualTs, err := testClient.targetToTimeseries(nil, testClient.cfg.Read.URL[0], targets[0], "0", "300", testClient.cfg.DefaultPrefix, nil)
 	testClient.cfg.EnableTags = false
 	if err != nil {
 		t.Errorf("Unexpected err: %s", err)
@@ -167,3 +785,262 @@ func TestQueryTargetsWithTags(t *testing.T) {
 		t.Errorf("Expected %s, got %s", expectedTs, actualTs)
 	}
 }
+
+func TestDatapointUnmarshalJSON(t *testing.T) {
+	var datapoints []*Datapoint
+	body := `[[18, 0], [null, 60], ["NaN", 120], ["-Infinity", 180], ["foo", 240], [{"foo": "bar"}, 300]]`
+	if err := json.Unmarshal([]byte(body), &datapoints); err != nil {
+		t.Fatalf("Unexpected err: %s", err)
+	}
+
+	if *datapoints[0].Value != 18 || datapoints[0].Timestamp != 0 {
+		t.Errorf("Expected [18, 0], got [%v, %d]", *datapoints[0].Value, datapoints[0].Timestamp)
+	}
+	for _, i := range []int{1, 2, 3, 4, 5} {
+		if datapoints[i].Value != nil {
+			t.Errorf("Expected nil value for datapoint %d, got %v", i, *datapoints[i].Value)
+		}
+	}
+
+	for _, invalid := range []string{`[[18]]`, `[[18, "foo"]]`} {
+		if err := json.Unmarshal([]byte(invalid), &datapoints); err == nil {
+			t.Errorf("Expected err unmarshalling %s", invalid)
+		}
+	}
+}
+
+func TestSamplesFromUnorderedDatapoints(t *testing.T) {
+	value := func(v float64) *float64 { return &v }
+	datapoints := []*Datapoint{
+		&Datapoint{Timestamp: 600, Value: value(3)},
+		&Datapoint{Timestamp: 0, Value: value(1)},
+		&Datapoint{Timestamp: 300, Value: value(2)},
+		&Datapoint{Timestamp: 300, Value: value(4)},
+		&Datapoint{Timestamp: 900, Value: nil},
+	}
+	expected := []prompb.Sample{
+		prompb.Sample{Value: 1, Timestamp: 0},
+		prompb.Sample{Value: 4, Timestamp: 300000},
+		prompb.Sample{Value: 3, Timestamp: 600000},
+	}
+
+	actual := samplesFromDatapoints(datapoints, 0, graphiteCfg.InterpolationLinear, 0)
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+}
+
+func TestWithMaxDataPoints(t *testing.T) {
+	params := map[string]string{"cacheTimeout": "60"}
+	expected := map[string]string{"cacheTimeout": "60", "maxDataPoints": "100"}
+	if actual := withMaxDataPoints(params, 100); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Expected %s, got %s", expected, actual)
+	}
+	if _, ok := params["maxDataPoints"]; ok {
+		t.Errorf("Expected params to be left untouched, got %s", params)
+	}
+
+	// A lower forwarded limit is kept.
+	params = map[string]string{"maxDataPoints": "10"}
+	if actual := withMaxDataPoints(params, 100); !reflect.DeepEqual(params, actual) {
+		t.Errorf("Expected %s, got %s", params, actual)
+	}
+
+	// At least one point is read per target.
+	expected = map[string]string{"maxDataPoints": "1"}
+	if actual := withMaxDataPoints(nil, 0); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Expected %s, got %s", expected, actual)
+	}
+}
+
+func TestSamplesFromDatapointsInterpolation(t *testing.T) {
+	value := func(v float64) *float64 { return &v }
+	datapoints := []*Datapoint{
+		&Datapoint{Timestamp: 0, Value: value(0)},
+		&Datapoint{Timestamp: 300, Value: value(30)},
+	}
+	expected := map[string][]prompb.Sample{
+		graphiteCfg.InterpolationLinear: {
+			prompb.Sample{Value: 0, Timestamp: 0},
+			prompb.Sample{Value: 10, Timestamp: 100000},
+			prompb.Sample{Value: 20, Timestamp: 200000},
+			prompb.Sample{Value: 30, Timestamp: 300000},
+		},
+		graphiteCfg.InterpolationStep: {
+			prompb.Sample{Value: 0, Timestamp: 0},
+			prompb.Sample{Value: 0, Timestamp: 100000},
+			prompb.Sample{Value: 0, Timestamp: 200000},
+			prompb.Sample{Value: 30, Timestamp: 300000},
+		},
+		graphiteCfg.InterpolationNone: {
+			prompb.Sample{Value: 0, Timestamp: 0},
+			prompb.Sample{Value: 30, Timestamp: 300000},
+		},
+	}
+
+	for interpolation, expectedSamples := range expected {
+		actual := samplesFromDatapoints(datapoints, 100*time.Second, interpolation, 0)
+		if !reflect.DeepEqual(expectedSamples, actual) {
+			t.Errorf("%s: expected %v, got %v", interpolation, expectedSamples, actual)
+		}
+	}
+}
+
+func TestSamplesFromDatapointsFillForward(t *testing.T) {
+	value := func(v float64) *float64 { return &v }
+	datapoints := []*Datapoint{
+		&Datapoint{Timestamp: 0, Value: value(1)},
+		&Datapoint{Timestamp: 60, Value: nil},
+		&Datapoint{Timestamp: 120, Value: nil},
+		&Datapoint{Timestamp: 180, Value: nil},
+		&Datapoint{Timestamp: 240, Value: value(2)},
+		&Datapoint{Timestamp: 300, Value: nil},
+	}
+	expected := []prompb.Sample{
+		prompb.Sample{Value: 1, Timestamp: 0},
+		prompb.Sample{Value: 1, Timestamp: 60000},
+		prompb.Sample{Value: 1, Timestamp: 120000},
+		prompb.Sample{Value: 2, Timestamp: 240000},
+		prompb.Sample{Value: 2, Timestamp: 300000},
+	}
+
+	actual := samplesFromDatapoints(datapoints, 0, graphiteCfg.InterpolationLinear, 2*time.Minute)
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+}
+
+func TestIsCounter(t *testing.T) {
+	for _, tc := range []struct {
+		labels   []*prompb.Label
+		expected bool
+	}{
+		{[]*prompb.Label{{Name: model.MetricNameLabel, Value: "http_requests_total"}}, true},
+		{[]*prompb.Label{{Name: model.MetricNameLabel, Value: "temperature"}}, false},
+		{[]*prompb.Label{{Name: model.MetricNameLabel, Value: "requests"}, {Name: paths.TypeLabel, Value: "counter"}}, true},
+		{[]*prompb.Label{{Name: model.MetricNameLabel, Value: "free_total"}, {Name: paths.TypeLabel, Value: "gauge"}}, false},
+	} {
+		if actual := isCounter(tc.labels); actual != tc.expected {
+			t.Errorf("Expected %v for %v, got %v", tc.expected, tc.labels, actual)
+		}
+	}
+}
+
+func TestQueryToTargetsWithTagsSpecialValues(t *testing.T) {
+	query := &prompb.Query{
+		Matchers: []*prompb.LabelMatcher{
+			&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "test"},
+			&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "path", Value: "a,b(c)"},
+			&prompb.LabelMatcher{Type: prompb.LabelMatcher_NEQ, Name: "owner", Value: "team \"x\""},
+			&prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "job", Value: "it's|(foo|bar)"},
+		},
+	}
+	expectedTargets := []string{
+		"seriesByTag(\"name=prometheus-prefix.test\",\"path=a,b(c)\",'owner!=team \"x\"',\"job=~^(it's|(foo|bar))$\")",
+	}
+
+	targets, err := testClient.queryToTargetsWithTags(nil, testClient.cfg.Read.URL[0], query, testClient.cfg.DefaultPrefix)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(expectedTargets, targets) {
+		t.Errorf("Expected %s, got %s", expectedTargets, targets)
+	}
+
+	query.Matchers = append(query.Matchers,
+		&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "quotes", Value: "\"it's\""})
+	if _, err := testClient.queryToTargetsWithTags(nil, testClient.cfg.Read.URL[0], query, testClient.cfg.DefaultPrefix); err == nil {
+		t.Errorf("Expected an error for a value with both single and double quotes")
+	}
+}
+
+func TestQueryToTargetsWithFindSeries(t *testing.T) {
+	defer func() { fetchURL = utils.FetchURL }()
+	var exprs []string
+	fetchURL = func(ctx context.Context, client *http.Client, l log.Logger, method string, u *url.URL, maxBytes int64) ([]byte, error) {
+		if u.Path != "/tags/findSeries" {
+			return nil, fmt.Errorf("unexpected URL %s", u)
+		}
+		exprs = u.Query()["expr"]
+		return []byte(`["prometheus-prefix.test;owner=team \"x\"", "prometheus-prefix.test;owner=team-Y"]`), nil
+	}
+	query := &prompb.Query{
+		Matchers: []*prompb.LabelMatcher{
+			&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "test"},
+			&prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "owner", Value: "\"it's\"|team.*"},
+		},
+	}
+
+	testClient.cfg.Read.UseFindSeries = true
+	defer func() { testClient.cfg.Read.UseFindSeries = false }()
+	targets, err := testClient.queryToTargetsWithTags(nil, testClient.cfg.Read.URL[0], query, testClient.cfg.DefaultPrefix)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// Expressions are sent unquoted, even with both single and double quotes.
+	expectedExprs := []string{"name=prometheus-prefix.test", "owner=~^(\"it's\"|team.*)$"}
+	if !reflect.DeepEqual(expectedExprs, exprs) {
+		t.Errorf("Expected expressions %q, got %q", expectedExprs, exprs)
+	}
+	expectedTargets := []string{"prometheus-prefix.test;owner=team \"x\"", "prometheus-prefix.test;owner=team-Y"}
+	if !reflect.DeepEqual(expectedTargets, targets) {
+		t.Errorf("Expected %s, got %s", expectedTargets, targets)
+	}
+}
+
+func TestTransformValues(t *testing.T) {
+	samples := []prompb.Sample{{Value: 1, Timestamp: 0}, {Value: 2.5, Timestamp: 1000}}
+
+	transformValues(samples, 0, 0)
+	expected := []prompb.Sample{{Value: 1, Timestamp: 0}, {Value: 2.5, Timestamp: 1000}}
+	if !reflect.DeepEqual(expected, samples) {
+		t.Errorf("Expected %v, got %v", expected, samples)
+	}
+
+	transformValues(samples, 8, -1)
+	expected = []prompb.Sample{{Value: 7, Timestamp: 0}, {Value: 19, Timestamp: 1000}}
+	if !reflect.DeepEqual(expected, samples) {
+		t.Errorf("Expected %v, got %v", expected, samples)
+	}
+}
+
+func TestValueTransform(t *testing.T) {
+	var cfg graphiteCfg.ReadConfig
+	err := yaml.Unmarshal([]byte(`
+max_fetch_workers: 1
+value_scale: 2
+value_transforms:
+  - name: 'legacy_.*_bytes'
+    scale: 1024
+  - name: 'legacy_.*'
+    offset: -273.15
+`), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{cfg: &graphiteCfg.Config{Read: cfg}}
+
+	var tests = []struct {
+		name   string
+		scale  float64
+		offset float64
+	}{
+		{"legacy_disk_bytes", 1024, 0},
+		{"legacy_temperature", 0, -273.15},
+		{"disk_bytes", 2, 0},
+		// Names must fully match.
+		{"not_legacy_disk_bytes", 2, 0},
+	}
+	for _, test := range tests {
+		labels := []*prompb.Label{{Name: model.MetricNameLabel, Value: test.name}}
+		if scale, offset := c.valueTransform(labels); scale != test.scale || offset != test.offset {
+			t.Errorf("%s: expected scale %v and offset %v, got %v and %v",
+				test.name, test.scale, test.offset, scale, offset)
+		}
+	}
+
+	if err := yaml.Unmarshal([]byte("value_transforms: [{scale: 2}]"), &cfg); err == nil {
+		t.Errorf("Expected an error for a value transform without name")
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2017 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"net/http"
+
+	gpaths "github.com/criteo/graphite-remote-adapter/client/graphite/paths"
+	"github.com/prometheus/common/model"
+)
+
+// SimulatedSample describes how a sample would be written to Graphite.
+type SimulatedSample struct {
+	Sample     *model.Sample               `json:"sample"`
+	Datapoints []gpaths.ExplainedDatapoint `json:"datapoints"`
+	Error      string                      `json:"error,omitempty"`
+}
+
+// Simulate implements the client.Simulator interface. Samples are prepared
+// like written ones, those dropped by the write options are left out.
+func (c *Client) Simulate(samples model.Samples, r *http.Request) (interface{}, error) {
+	samples, err := c.prepareSamples(samples)
+	if err != nil {
+		return nil, err
+	}
+	graphitePrefix := c.prefixFromRequest(r)
+	format, err := c.formatFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	simulated := make([]*SimulatedSample, 0, len(samples))
+	for _, s := range samples {
+		s = c.prepareSample(s)
+		datapoints, err := gpaths.ExplainDatapoints(s, format, graphitePrefix, c.cfg.Write.Rules, c.templateData())
+		simulatedSample := &SimulatedSample{Sample: s, Datapoints: datapoints}
+		if err != nil {
+			simulatedSample.Error = err.Error()
+		}
+		simulated = append(simulated, simulatedSample)
+	}
+	return simulated, nil
+}
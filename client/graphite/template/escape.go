@@ -124,3 +124,46 @@ func Unescape(tv string) string {
 	}
 	return result.String()
 }
+
+// EscapeTagValue escapes a model.LabelValue into a Graphite tag value. Tags
+// have their own reserved characters, distinct from the ones of path nodes:
+// ';' separates tags and tag values can't start with '~'. Dots, slashes and
+// the other printable characters are fine in tag values and kept as is.
+//
+// ';', '~', '%', '"', '\' and all the bytes which aren't printable are
+// percent-encoded, '"' and '\' so that values can be quoted with the
+// OpenMetrics format.
+//
+// Examples:
+//
+// "http://example.org:8080" -> "http://example.org:8080"
+//
+// "a;b=c" -> "a%3Bb=c"
+//
+// "~foo bar" -> "%7Efoo%20bar"
+func EscapeTagValue(tv string) string {
+	length := len(tv)
+	result := bytes.NewBuffer(make([]byte, 0, length))
+	for i := 0; i < length; i++ {
+		b := tv[i]
+		switch {
+		case b == ';' || b == '~' || b == '%' || b == '"' || b == '\\':
+			fmt.Fprintf(result, "%%%X", b)
+		case strings.IndexByte(printables, b) != -1:
+			result.WriteByte(b)
+		default:
+			fmt.Fprintf(result, "%%%X", b)
+		}
+	}
+	return result.String()
+}
+
+// UnescapeTagValue returns the original value of a tag value escaped by
+// EscapeTagValue.
+func UnescapeTagValue(tv string) string {
+	value, err := url.PathUnescape(tv)
+	if err != nil {
+		return tv
+	}
+	return value
+}
@@ -52,3 +52,27 @@ func TestUnescape(t *testing.T) {
 		t.Errorf("Expected %s, got %s", expected, actual)
 	}
 }
+
+func TestEscapeTagValue(t *testing.T) {
+	var tests = []struct {
+		value    string
+		expected string
+	}{
+		{"foo-bar-42", "foo-bar-42"},
+		{"http://example.org:8080", "http://example.org:8080"},
+		{"a;b=c", "a%3Bb=c"},
+		{"~foo bar", "%7Efoo%20bar"},
+		{"100%", "100%25"},
+		{"say \"hi\\\"", "say%20%22hi%5C%22"},
+		{"é", "%C3%A9"},
+	}
+	for _, test := range tests {
+		actual := EscapeTagValue(test.value)
+		if actual != test.expected {
+			t.Errorf("Expected %s, got %s", test.expected, actual)
+		}
+		if value := UnescapeTagValue(actual); value != test.value {
+			t.Errorf("Expected %s to round-trip, got %s", test.value, value)
+		}
+	}
+}
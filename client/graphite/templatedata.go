@@ -0,0 +1,89 @@
+// Copyright 2017 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/criteo/graphite-remote-adapter/client/graphite/paths"
+	"github.com/go-kit/kit/log/level"
+)
+
+// templateData returns the data given to the templates of rules and of the
+// prefix, which includes the template data file if set.
+func (c *Client) templateData() map[string]interface{} {
+	c.templateDataLock.RLock()
+	defer c.templateDataLock.RUnlock()
+	if c.mergedTemplateData == nil {
+		return c.cfg.Write.TemplateData
+	}
+	return c.mergedTemplateData
+}
+
+// loadTemplateData reads the template data file. The paths cache is flushed
+// when the data changes, as cached paths were rendered with the former one.
+func (c *Client) loadTemplateData() error {
+	data, err := c.cfg.Write.MergedTemplateData()
+	if err != nil {
+		return err
+	}
+
+	c.templateDataLock.Lock()
+	changed := c.mergedTemplateData != nil && !reflect.DeepEqual(c.mergedTemplateData, data)
+	c.mergedTemplateData = data
+	c.templateDataLock.Unlock()
+
+	if changed {
+		level.Info(c.writeLogger).Log(
+			"file", c.cfg.Write.TemplateDataFile, "msg", "Template data changed, flushing the paths cache")
+		paths.FlushPathsCache()
+	}
+	return nil
+}
+
+// startTemplateDataRefresh periodically reads the template data file again
+// until stopTemplateDataRefresh is called. The former data is kept when the
+// file can't be read.
+func (c *Client) startTemplateDataRefresh(interval time.Duration) {
+	c.templateDataStop = make(chan struct{})
+	c.templateDataDone = make(chan struct{})
+	go func() {
+		defer close(c.templateDataDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.templateDataStop:
+				return
+			case <-ticker.C:
+				if err := c.loadTemplateData(); err != nil {
+					level.Warn(c.writeLogger).Log(
+						"file", c.cfg.Write.TemplateDataFile,
+						"err", err, "msg", "Error reading template data file, keeping the former data")
+				}
+			}
+		}
+	}()
+}
+
+// stopTemplateDataRefresh stops the refresh, if started, and waits for it to
+// return.
+func (c *Client) stopTemplateDataRefresh() {
+	if c.templateDataStop == nil {
+		return
+	}
+	close(c.templateDataStop)
+	<-c.templateDataDone
+}
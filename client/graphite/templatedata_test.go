@@ -0,0 +1,62 @@
+// Copyright 2017 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/criteo/graphite-remote-adapter/client/graphite/config"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTemplateDataRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "template_data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "data.yml")
+	require.NoError(t, ioutil.WriteFile(file, []byte("site: paris"), 0600))
+
+	c := &Client{
+		writeLogger: log.NewNopLogger(),
+		cfg: &config.Config{
+			Write: config.WriteConfig{
+				TemplateData:     map[string]interface{}{"site": "amsterdam", "env": "prod"},
+				TemplateDataFile: file,
+			},
+		},
+	}
+	defer c.Shutdown()
+
+	// Without the file loaded, template_data is used as is.
+	require.Equal(t, "amsterdam", c.templateData()["site"])
+
+	require.NoError(t, c.loadTemplateData())
+	require.Equal(t, map[string]interface{}{"site": "paris", "env": "prod"}, c.templateData())
+
+	c.startTemplateDataRefresh(10 * time.Millisecond)
+	require.NoError(t, ioutil.WriteFile(file, []byte("site: london"), 0600))
+	require.Eventually(t, func() bool {
+		return c.templateData()["site"] == "london"
+	}, time.Second, 10*time.Millisecond)
+
+	// The former data is kept when the file can't be read.
+	require.NoError(t, os.Remove(file))
+	require.Error(t, c.loadTemplateData())
+	require.Equal(t, "london", c.templateData()["site"])
+}
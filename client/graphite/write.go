@@ -17,16 +17,81 @@ package graphite
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	graphiteCfg "github.com/criteo/graphite-remote-adapter/client/graphite/config"
 	gpaths "github.com/criteo/graphite-remote-adapter/client/graphite/paths"
 	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/common/model"
+
+	"golang.org/x/net/context"
+)
+
+var downsampledSamples = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "remote_adapter_graphite",
+		Name:      "downsampled_samples_total",
+		Help:      "The total number of samples not sent to Graphite because a later sample of the same series was sent within min_interval.",
+	},
+)
+
+// formatTypes maps the values of the graphite.format query parameter to the
+// format used to write points.
+var formatTypes = map[string]gpaths.FormatType{
+	"carbon":      gpaths.FormatCarbon,
+	"tags":        gpaths.FormatCarbonTags,
+	"openmetrics": gpaths.FormatCarbonOpenMetrics,
+}
+
+var sentDatapoints = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "remote_adapter_graphite",
+		Name:      "sent_datapoints_total",
+		Help:      "The total number of datapoints written to carbon, per carbon address.",
+	},
+	[]string{"destination"},
 )
 
-const udpMaxBytes = 1024
+var failedDatapoints = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "remote_adapter_graphite",
+		Name:      "failed_datapoints_total",
+		Help:      "The total number of datapoints which failed to be written to carbon, per carbon address.",
+	},
+	[]string{"destination"},
+)
+
+var nameDroppedSamples = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "remote_adapter_graphite",
+		Name:      "name_dropped_samples_total",
+		Help:      "The total number of samples not sent to Graphite because their metric name matches graphite.write.drop_name_regex.",
+	},
+)
+
+var cardinalityRejectedRequests = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "remote_adapter_graphite",
+		Name:      "cardinality_rejected_requests_total",
+		Help:      "The total number of write requests rejected because they have more unique series than graphite.write.max_unique_series.",
+	},
+)
+
+var unnamedSamples = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "remote_adapter_graphite",
+		Name:      "unnamed_samples_total",
+		Help:      "The total number of samples not sent to Graphite because they have no metric name.",
+	},
+)
 
 func (c *Client) connectToCarbon() (net.Conn, error) {
 	if c.carbonCon != nil {
@@ -34,28 +99,61 @@ func (c *Client) connectToCarbon() (net.Conn, error) {
 			// Last reconnect is not too long ago, re-use the connection.
 			return c.carbonCon, nil
 		}
-		level.Debug(c.logger).Log(
+		level.Debug(c.writeLogger).Log(
 			"last", c.carbonLastReconnectTime,
 			"msg", "Reinitializing the connection to carbon")
 		c.disconnectFromCarbon()
 	}
 
-	level.Debug(c.logger).Log(
+	level.Debug(c.writeLogger).Log(
 		"transport", c.cfg.Write.CarbonTransport,
 		"address", c.cfg.Write.CarbonAddress,
 		"timeout", c.writeTimeout,
 		"msg", "Connecting to carbon")
-	conn, err := net.DialTimeout(c.cfg.Write.CarbonTransport, c.cfg.Write.CarbonAddress, c.writeTimeout)
+	conn, err := dialCarbon(c.cfg.Write.CarbonTransport, c.cfg.Write.CarbonAddress, c.writeTimeout)
 	if err != nil {
 		c.carbonCon = nil
 	} else {
 		c.carbonLastReconnectTime = time.Now()
 		c.carbonCon = conn
+		c.detectHTTPServer(conn, c.cfg.Write.CarbonAddress)
 	}
 
 	return c.carbonCon, err
 }
 
+// touchCarbon records a write to carbon, so that the connection is closed
+// once idle for the idle timeout. carbonConLock must be held.
+func (c *Client) touchCarbon() {
+	timeout := c.cfg.Write.CarbonIdleTimeout
+	if timeout <= 0 {
+		return
+	}
+	c.carbonLastWriteTime = time.Now()
+	if c.carbonIdleTimer == nil {
+		c.carbonIdleTimer = time.AfterFunc(timeout, c.closeIdleCarbon)
+	} else {
+		c.carbonIdleTimer.Reset(timeout)
+	}
+}
+
+func (c *Client) closeIdleCarbon() {
+	c.carbonConLock.Lock()
+	defer c.carbonConLock.Unlock()
+	// A write may have happened while the timer was firing.
+	if time.Since(c.carbonLastWriteTime) < c.cfg.Write.CarbonIdleTimeout {
+		return
+	}
+	level.Debug(c.writeLogger).Log(
+		"last_write", c.carbonLastWriteTime,
+		"msg", "Closing idle connection to carbon")
+	c.disconnectFromCarbon()
+	c.disconnectFromRoutes()
+	if c.carbonPool != nil {
+		c.carbonPool.closeIdle()
+	}
+}
+
 func (c *Client) disconnectFromCarbon() {
 	if c.carbonCon != nil {
 		c.carbonCon.Close()
@@ -63,31 +161,341 @@ func (c *Client) disconnectFromCarbon() {
 	c.carbonCon = nil
 }
 
-func (c *Client) prepareWrite(samples model.Samples, r *http.Request) ([]*bytes.Buffer, error) {
-	level.Debug(c.logger).Log(
+// carbonConn is a connection to carbon, either to the carbon address of a
+// route or one of the connection pool.
+type carbonConn struct {
+	con               net.Conn
+	lastReconnectTime time.Time
+}
+
+// close closes the connection, if open.
+func (cc *carbonConn) close() {
+	if cc.con != nil {
+		cc.con.Close()
+		cc.con = nil
+	}
+}
+
+// connect returns the connection of cc to address, which is reopened every
+// reconnect interval like the default one.
+func (c *Client) connect(cc *carbonConn, address string) (net.Conn, error) {
+	if cc.con != nil {
+		if time.Since(cc.lastReconnectTime) < c.cfg.Write.CarbonReconnectInterval {
+			return cc.con, nil
+		}
+		cc.close()
+	}
+
+	level.Debug(c.writeLogger).Log(
+		"transport", c.cfg.Write.CarbonTransport,
+		"address", address,
+		"timeout", c.writeTimeout,
+		"msg", "Connecting to carbon")
+	conn, err := dialCarbon(c.cfg.Write.CarbonTransport, address, c.writeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	cc.con = conn
+	cc.lastReconnectTime = time.Now()
+	c.detectHTTPServer(conn, address)
+	return conn, nil
+}
+
+// connectToRoute returns the connection to address. carbonConLock must be held.
+func (c *Client) connectToRoute(address string) (net.Conn, error) {
+	if c.carbonRoutes == nil {
+		c.carbonRoutes = make(map[string]*carbonConn)
+	}
+	route, ok := c.carbonRoutes[address]
+	if !ok {
+		route = &carbonConn{}
+		c.carbonRoutes[address] = route
+	}
+	return c.connect(route, address)
+}
+
+// httpResponsePrefix starts the responses of HTTP servers.
+var httpResponsePrefix = []byte("HTTP/")
+
+// detectHTTPServer reads, in the background and until conn is closed, what is
+// sent back on a TCP connection to carbon. Carbon never answers on its
+// plaintext port, while an HTTP server, e.g. graphite-web, answers written
+// lines with an error response: this is logged as a misconfiguration.
+func (c *Client) detectHTTPServer(conn net.Conn, address string) {
+	// Acknowledgements are read by writes, an HTTP response is a negative one.
+	if c.cfg.Write.CarbonTransport != "tcp" || c.cfg.Write.ExpectAck {
+		return
+	}
+	go func() {
+		response := make([]byte, len(httpResponsePrefix))
+		if _, err := io.ReadFull(conn, response); err != nil {
+			return
+		}
+		if bytes.Equal(response, httpResponsePrefix) {
+			level.Error(c.writeLogger).Log(
+				"address", address,
+				"msg", "carbon_address appears to be an HTTP server, e.g. graphite-web, instead of the carbon plaintext port")
+		}
+	}()
+}
+
+// disconnectFromRoute closes the connection to address. carbonConLock must be held.
+func (c *Client) disconnectFromRoute(address string) {
+	if route, ok := c.carbonRoutes[address]; ok {
+		route.close()
+	}
+}
+
+// disconnectFromRoutes closes the connections to all the routes.
+// carbonConLock must be held.
+func (c *Client) disconnectFromRoutes() {
+	for address := range c.carbonRoutes {
+		c.disconnectFromRoute(address)
+	}
+}
+
+// carbonAddress returns the carbon address the samples of m are written to:
+// the one of the first matching route, the default one otherwise.
+func (c *Client) carbonAddress(m model.Metric) string {
+	for _, route := range c.cfg.Write.Routes {
+		if gpaths.Match(m, route.Match, route.MatchRE) {
+			return route.CarbonAddress
+		}
+	}
+	return c.cfg.Write.CarbonAddress
+}
+
+// carbonAddresses returns the default carbon address followed by the ones of
+// the routes, without duplicates.
+func (c *Client) carbonAddresses() []string {
+	addresses := []string{c.cfg.Write.CarbonAddress}
+	seen := map[string]bool{c.cfg.Write.CarbonAddress: true}
+	for _, route := range c.cfg.Write.Routes {
+		if !seen[route.CarbonAddress] {
+			addresses = append(addresses, route.CarbonAddress)
+			seen[route.CarbonAddress] = true
+		}
+	}
+	return addresses
+}
+
+// formatFromRequest returns the format from either the config or the request's Query.
+func (c *Client) formatFromRequest(r *http.Request) (gpaths.Format, error) {
+	name := r.URL.Query().Get("graphite.format")
+	if name == "" {
+		return c.format, nil
+	}
+	formatType, ok := formatTypes[name]
+	if !ok {
+		return gpaths.Format{}, fmt.Errorf("unsupported graphite.format %q", name)
+	}
+	return newFormat(formatType, c.cfg), nil
+}
+
+// prefixFromRequest returns the prefix from either the request's Query, used
+// as is, or the config.
+func (c *Client) prefixFromRequest(r *http.Request) gpaths.Prefix {
+	if p := r.URL.Query().Get("graphite.default-prefix"); p != "" {
+		return gpaths.LiteralPrefix(p)
+	}
+	return c.defaultPrefix
+}
+
+// prepareWrite formats samples into buffers by carbon address. Samples which
+// can't be rendered are returned apart, along with the reason why.
+func (c *Client) prepareWrite(samples model.Samples, r *http.Request) (map[string][]*bytes.Buffer, []renderedSample, error) {
+	level.Debug(c.writeLogger).Log(
 		"num_samples", len(samples), "storage", c.Name(), "msg", "Remote write")
 
-	graphitePrefix := c.cfg.StoragePrefixFromRequest(r)
+	samples, err := c.prepareSamples(samples)
+	if err != nil {
+		return nil, nil, err
+	}
+	graphitePrefix := c.prefixFromRequest(r)
+	format, err := c.formatFromRequest(r)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	currentBuf := bytes.NewBufferString("")
-	bytesBuffers := []*bytes.Buffer{currentBuf}
-	for _, s := range samples {
-		datapoints, err := gpaths.ToDatapoints(s, c.format, graphitePrefix, c.cfg.Write.Rules, c.cfg.Write.TemplateData)
-		if err != nil {
-			level.Debug(c.logger).Log("sample", s, "err", err)
+	lines := make(map[string][]string)
+	var ignored []renderedSample
+	for _, rendered := range c.renderSamples(samples, format, graphitePrefix) {
+		s := rendered.sample
+		if rendered.err != nil {
+			level.Debug(c.writeLogger).Log("sample", s, "err", rendered.err)
+			if rendered.err == gpaths.ErrMissingMetricName {
+				unnamedSamples.Inc()
+			}
 			c.ignoredSamples.Inc()
+			ignored = append(ignored, rendered)
 			continue
 		}
-		for _, str := range datapoints {
+		address := c.carbonAddress(s.Metric)
+		lines[address] = append(lines[address], rendered.datapoints...)
+	}
+
+	udpMaxBytes := c.cfg.Write.UDPMaxBytes
+	if udpMaxBytes < 1 {
+		udpMaxBytes = graphiteCfg.DefaultUDPMaxBytes
+	}
+	bytesBuffers := make(map[string][]*bytes.Buffer)
+	for address, addressLines := range lines {
+		if c.cfg.Write.GroupByPath {
+			groupByPath(addressLines)
+		}
+		buffers := []*bytes.Buffer{bytes.NewBufferString("")}
+		for _, str := range addressLines {
+			currentBuf := buffers[len(buffers)-1]
 			if c.cfg.Write.CarbonTransport == "udp" && (currentBuf.Len()+len(str)) > udpMaxBytes {
 				currentBuf = bytes.NewBufferString("")
-				bytesBuffers = append(bytesBuffers, currentBuf)
+				buffers = append(buffers, currentBuf)
 			}
 			fmt.Fprint(currentBuf, str)
-			level.Debug(c.logger).Log("line", str, "msg", "Sending")
+			level.Debug(c.writeLogger).Log("line", str, "msg", "Sending")
 		}
+		bytesBuffers[address] = buffers
 	}
-	return bytesBuffers, nil
+	return bytesBuffers, ignored, nil
+}
+
+// prepareSamples applies the write options dropping samples before they are
+// rendered, i.e. drop_name_regex, max_unique_series and min_interval, and
+// returns the remaining samples in timestamp order.
+func (c *Client) prepareSamples(samples model.Samples) (model.Samples, error) {
+	if c.cfg.Write.DropNameRegex != nil {
+		numSamples := len(samples)
+		samples = dropByName(samples, c.cfg.Write.DropNameRegex)
+		nameDroppedSamples.Add(float64(numSamples - len(samples)))
+	}
+
+	if maxSeries := c.cfg.Write.MaxUniqueSeries; maxSeries > 0 && hasMoreSeries(samples, maxSeries) {
+		cardinalityRejectedRequests.Inc()
+		level.Warn(c.writeLogger).Log(
+			"num_samples", len(samples), "max_unique_series", maxSeries,
+			"msg", "Rejecting write request with too many unique series")
+		return nil, fmt.Errorf("write request has more than %d unique series", maxSeries)
+	}
+
+	// Carbon keeps the last datapoint written for a timestamp bucket, so
+	// datapoints of a series must be written in timestamp order for an older
+	// one not to overwrite a newer one. Buffers are filled and flushed in
+	// order and a series always goes to the same carbon address, so sorting
+	// samples is enough to preserve the order of each series.
+	samples = sortedByTimestamp(samples)
+
+	if c.cfg.Write.MinInterval > 0 {
+		numSamples := len(samples)
+		samples = downsample(samples, c.cfg.Write.MinInterval)
+		downsampledSamples.Add(float64(numSamples - len(samples)))
+	}
+	return samples, nil
+}
+
+// prepareSample returns s with the constant labels and the missing name
+// placeholder of the write options, which are applied to each sample right
+// before rendering it.
+func (c *Client) prepareSample(s *model.Sample) *model.Sample {
+	if len(c.cfg.Write.ConstantLabels) > 0 {
+		s = withConstantLabels(s, c.cfg.Write.ConstantLabels)
+	}
+	if s.Metric[model.MetricNameLabel] == "" && c.cfg.Write.MissingNamePlaceholder != "" {
+		s = withMetricName(s, c.cfg.Write.MissingNamePlaceholder)
+	}
+	return s
+}
+
+// hasMoreSeries tells whether samples belong to more than maxSeries unique series.
+func hasMoreSeries(samples model.Samples, maxSeries int) bool {
+	if len(samples) <= maxSeries {
+		return false
+	}
+	series := make(map[model.Fingerprint]struct{}, maxSeries+1)
+	for _, s := range samples {
+		series[s.Metric.Fingerprint()] = struct{}{}
+		if len(series) > maxSeries {
+			return true
+		}
+	}
+	return false
+}
+
+// dropByName returns the samples whose metric name doesn't match re. Samples
+// are shared between writers, the given slice is left untouched.
+func dropByName(samples model.Samples, re *graphiteCfg.Regexp) model.Samples {
+	kept := make(model.Samples, 0, len(samples))
+	for _, s := range samples {
+		if !re.MatchString(string(s.Metric[model.MetricNameLabel])) {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// renderedSample holds the datapoints built from a sample, or the error which
+// prevented building them.
+type renderedSample struct {
+	sample     *model.Sample
+	datapoints []string
+	err        error
+}
+
+// renderSamples builds the datapoints of samples, concurrently when
+// graphite.write.render_workers is set. Results are in the order of samples.
+func (c *Client) renderSamples(samples model.Samples, format gpaths.Format, graphitePrefix gpaths.Prefix) []renderedSample {
+	rendered := make([]renderedSample, len(samples))
+	render := func(i int) {
+		s := c.prepareSample(samples[i])
+		datapoints, err := gpaths.ToDatapoints(s, format, graphitePrefix, c.cfg.Write.Rules, c.templateData())
+		rendered[i] = renderedSample{sample: s, datapoints: datapoints, err: err}
+	}
+
+	workers := c.cfg.Write.RenderWorkers
+	if workers <= 1 || len(samples) < 2 {
+		for i := range samples {
+			render(i)
+		}
+		return rendered
+	}
+
+	input := make(chan int, len(samples))
+	for i := range samples {
+		input <- i
+	}
+	close(input)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range input {
+				render(j)
+			}
+		}()
+	}
+	wg.Wait()
+	return rendered
+}
+
+// groupByPath sorts lines by path so that carbon receives the datapoints of
+// a metric consecutively. The sort is stable to keep the datapoints of a
+// path in timestamp order.
+func groupByPath(lines []string) {
+	sort.SliceStable(lines, func(i, j int) bool {
+		return linePath(lines[i]) < linePath(lines[j])
+	})
+}
+
+// linePath returns the path of a "<path> <value> <timestamp>" line.
+func linePath(line string) string {
+	end := len(line)
+	for spaces := 0; spaces < 2 && end > 0; spaces++ {
+		end = strings.LastIndexByte(line[:end], ' ')
+	}
+	if end < 0 {
+		return line
+	}
+	return line[:end]
 }
 
 // Write implements the client.Writer interface.
@@ -96,40 +504,286 @@ func (c *Client) Write(samples model.Samples, r *http.Request, dryRun bool) ([]b
 		return []byte("Skipped: Not set carbon address."), nil
 	}
 
-	bytesBuffers, err := c.prepareWrite(samples, r)
+	bytesBuffers, ignored, err := c.prepareWrite(samples, r)
 	if err != nil {
 		return nil, err
 	}
 
 	if dryRun {
 		dryRunResponse := make([]byte, 0)
-		for _, buf := range bytesBuffers {
-			dryRunResponse = append(dryRunResponse, buf.Bytes()...)
+		for _, address := range c.carbonAddresses() {
+			for _, buf := range bytesBuffers[address] {
+				dryRunResponse = append(dryRunResponse, buf.Bytes()...)
+			}
 		}
 		return dryRunResponse, nil
 
 	}
-	// We are going to use the socket, lock it.
-	c.carbonConLock.Lock()
-	defer c.carbonConLock.Unlock()
-
+	for _, rendered := range ignored {
+		c.deadLetters.Write(rendered.sample, rendered.err.Error())
+	}
+	addresses := c.carbonAddresses()
 	select {
 	case <-r.Context().Done():
-		return []byte("context cancelled."), fmt.Errorf("request context cancelled while using socket %s <=> %s",
-			c.carbonCon.LocalAddr().String(), c.carbonCon.RemoteAddr().String())
+		for _, address := range addresses {
+			failedDatapoints.WithLabelValues(address).Add(countDatapoints(bytesBuffers[address]))
+		}
+		return []byte("context cancelled."), fmt.Errorf("request context cancelled before writing to carbon")
 	default:
 	}
 
-	for _, buf := range bytesBuffers {
-		conn, err := c.connectToCarbon()
-		if err != nil {
+	if c.rateLimiter != nil {
+		var datapoints float64
+		for _, address := range addresses {
+			datapoints += countDatapoints(bytesBuffers[address])
+		}
+		if err := c.throttle(r.Context(), datapoints); err != nil {
+			for _, address := range addresses {
+				failedDatapoints.WithLabelValues(address).Add(countDatapoints(bytesBuffers[address]))
+			}
 			return nil, err
 		}
-		_, err = conn.Write(buf.Bytes())
+	}
+
+	for i, address := range addresses {
+		written, err := c.writeBuffers(r.Context(), address, bytesBuffers[address])
+		sentDatapoints.WithLabelValues(address).Add(countDatapoints(bytesBuffers[address][:written]))
+		c.observeBatches(address, bytesBuffers[address][:written])
 		if err != nil {
-			c.disconnectFromCarbon()
+			c.recordWrite(true)
+			// Neither the failed batch nor the following ones are written.
+			failedDatapoints.WithLabelValues(address).Add(countDatapoints(bytesBuffers[address][written:]))
+			for _, next := range addresses[i+1:] {
+				failedDatapoints.WithLabelValues(next).Add(countDatapoints(bytesBuffers[next]))
+			}
 			return nil, err
 		}
 	}
+	c.recordWrite(false)
+	c.carbonConLock.Lock()
+	c.touchCarbon()
+	c.carbonConLock.Unlock()
 	return []byte("Done."), nil
 }
+
+// writeBuffers writes buffers to address and returns how many of them were
+// written. Writes to the default address use a connection of the pool when
+// enabled, other writes hold carbonConLock while writing.
+func (c *Client) writeBuffers(ctx context.Context, address string, buffers []*bytes.Buffer) (int, error) {
+	if len(buffers) == 0 {
+		return 0, nil
+	}
+
+	if address == c.cfg.Write.CarbonAddress && c.carbonPool != nil {
+		cc, err := c.carbonPool.get(ctx)
+		if err != nil {
+			return 0, err
+		}
+		defer c.carbonPool.put(cc)
+		for i, buf := range buffers {
+			if err := c.writeToConn(cc, address, buf.Bytes()); err != nil {
+				return i, err
+			}
+		}
+		return len(buffers), nil
+	}
+
+	c.carbonConLock.Lock()
+	defer c.carbonConLock.Unlock()
+	for i, buf := range buffers {
+		if err := c.writeToCarbon(address, buf.Bytes()); err != nil {
+			return i, err
+		}
+	}
+	return len(buffers), nil
+}
+
+// observeBatches records the size of the batches written to address.
+func (c *Client) observeBatches(address string, buffers []*bytes.Buffer) {
+	for _, buf := range buffers {
+		c.carbonLinesPerBatch.WithLabelValues(address).Observe(countDatapoints([]*bytes.Buffer{buf}))
+		c.carbonBytes.WithLabelValues(address).Add(float64(buf.Len()))
+	}
+}
+
+// recordWrite counts a write to carbon in the write health, if tracked.
+func (c *Client) recordWrite(failed bool) {
+	if c.writeHealth != nil {
+		c.writeHealth.record(time.Now(), failed)
+	}
+}
+
+// writeToCarbon writes data to the connection to address, either the default
+// one or the one of a route. carbonConLock must be held.
+func (c *Client) writeToCarbon(address string, data []byte) error {
+	if address == c.cfg.Write.CarbonAddress {
+		conn, err := c.connectToCarbon()
+		if err != nil {
+			return err
+		}
+		if err := c.send(conn, data); err != nil {
+			c.disconnectFromCarbon()
+			return err
+		}
+		return nil
+	}
+
+	conn, err := c.connectToRoute(address)
+	if err != nil {
+		return err
+	}
+	if err := c.send(conn, data); err != nil {
+		c.disconnectFromRoute(address)
+		return err
+	}
+	return nil
+}
+
+// writeToConn writes data to cc, connecting it to address if needed.
+func (c *Client) writeToConn(cc *carbonConn, address string, data []byte) error {
+	conn, err := c.connect(cc, address)
+	if err != nil {
+		return err
+	}
+	if err := c.send(conn, data); err != nil {
+		cc.close()
+		return err
+	}
+	return nil
+}
+
+// ackOK is the line acknowledging a write when write.expect_ack is set.
+const ackOK = "OK"
+
+// maxAckLength bounds the length of acknowledgement lines.
+const maxAckLength = 1024
+
+// send writes data to conn and, if write.expect_ack is set on TCP, waits for
+// the receiver to acknowledge it with an "OK" line. Any other line is a
+// negative acknowledgement, and no line within the write timeout a failure.
+// Callers close conn when send fails, e.g. after write.carbon_write_deadline.
+func (c *Client) send(conn net.Conn, data []byte) error {
+	if deadline := c.cfg.Write.CarbonWriteDeadline; deadline > 0 {
+		if err := conn.SetWriteDeadline(time.Now().Add(deadline)); err != nil {
+			return err
+		}
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+	if _, err := conn.Write(data); err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return fmt.Errorf("writing to %s exceeded the carbon write deadline: %s", conn.RemoteAddr(), err)
+		}
+		return err
+	}
+	if !c.cfg.Write.ExpectAck || c.cfg.Write.CarbonTransport != "tcp" {
+		return nil
+	}
+
+	if c.writeTimeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+			return err
+		}
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	ack, err := readAck(conn)
+	if err != nil {
+		return fmt.Errorf("no acknowledgement from %s: %s", conn.RemoteAddr(), err)
+	}
+	if ack != ackOK {
+		return fmt.Errorf("negative acknowledgement from %s: %q", conn.RemoteAddr(), ack)
+	}
+	return nil
+}
+
+// readAck reads an acknowledgement line from conn byte by byte, so that
+// nothing after it is consumed.
+func readAck(conn net.Conn) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < maxAckLength {
+		if _, err := conn.Read(b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return strings.TrimSuffix(string(line), "\r"), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", fmt.Errorf("acknowledgement longer than %d bytes", maxAckLength)
+}
+
+// countDatapoints returns the number of lines in buffers.
+func countDatapoints(buffers []*bytes.Buffer) float64 {
+	count := 0
+	for _, buf := range buffers {
+		count += bytes.Count(buf.Bytes(), []byte("\n"))
+	}
+	return float64(count)
+}
+
+// withMetricName returns a copy of s named name, leaving s untouched as its
+// metric may be shared with other samples.
+func withMetricName(s *model.Sample, name string) *model.Sample {
+	metric := s.Metric.Clone()
+	metric[model.MetricNameLabel] = model.LabelValue(name)
+	return &model.Sample{Metric: metric, Value: s.Value, Timestamp: s.Timestamp}
+}
+
+// withConstantLabels returns a copy of s with the labels it doesn't have
+// already, leaving s untouched as its metric may be shared with other samples.
+func withConstantLabels(s *model.Sample, labels graphiteCfg.LabelSet) *model.Sample {
+	metric := s.Metric.Clone()
+	for name, value := range labels {
+		if _, ok := metric[name]; !ok {
+			metric[name] = value
+		}
+	}
+	return &model.Sample{Metric: metric, Value: s.Value, Timestamp: s.Timestamp}
+}
+
+// sortedByTimestamp returns samples sorted by timestamp. Samples with the same
+// timestamp keep their order. samples is shared with the other writers, it is
+// copied rather than sorted in place, and only when out of order.
+func sortedByTimestamp(samples model.Samples) model.Samples {
+	isSorted := sort.SliceIsSorted(samples, func(i, j int) bool {
+		return samples[i].Timestamp < samples[j].Timestamp
+	})
+	if isSorted {
+		return samples
+	}
+	sorted := make(model.Samples, len(samples))
+	copy(sorted, samples)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp < sorted[j].Timestamp
+	})
+	return sorted
+}
+
+// downsample keeps only the last sample of each series per interval.
+// Intervals are aligned on the epoch so that consecutive requests use the
+// same intervals, like carbon retentions do.
+func downsample(samples model.Samples, interval time.Duration) model.Samples {
+	type seriesInterval struct {
+		fingerprint model.Fingerprint
+		interval    int64
+	}
+
+	intervalMs := int64(interval / time.Millisecond)
+	if intervalMs <= 0 {
+		return samples
+	}
+	indexes := make(map[seriesInterval]int, len(samples))
+	kept := make(model.Samples, 0, len(samples))
+	for _, s := range samples {
+		key := seriesInterval{s.Metric.Fingerprint(), int64(s.Timestamp) / intervalMs}
+		if i, ok := indexes[key]; ok {
+			if s.Timestamp >= kept[i].Timestamp {
+				kept[i] = s
+			}
+			continue
+		}
+		indexes[key] = len(kept)
+		kept = append(kept, s)
+	}
+	return kept
+}
@@ -0,0 +1,684 @@
+// Copyright 2017 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/criteo/graphite-remote-adapter/client/graphite/config"
+	"github.com/criteo/graphite-remote-adapter/client/graphite/paths"
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func newTestWriteClient(writeCfg config.WriteConfig) *Client {
+	return &Client{
+		readLogger:  log.NewNopLogger(),
+		writeLogger: log.NewNopLogger(),
+		cfg: &config.Config{
+			DefaultPrefix: "prometheus-prefix.",
+			Write:         writeCfg,
+		},
+		format:         paths.Format{Type: paths.FormatCarbon},
+		defaultPrefix:  paths.LiteralPrefix("prometheus-prefix."),
+		ignoredSamples: prometheus.NewCounter(prometheus.CounterOpts{Name: "test"}),
+		carbonLinesPerBatch: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "test", Buckets: prometheus.ExponentialBuckets(1, 4, 9)}, []string{"destination"}),
+		carbonBytes: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test"}, []string{"destination"}),
+	}
+}
+
+func preparedLines(t *testing.T, c *Client, samples model.Samples) string {
+	fakeRequest, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	buffers, _, err := c.prepareWrite(samples, fakeRequest)
+	require.NoError(t, err)
+	lines := ""
+	for _, address := range c.carbonAddresses() {
+		for _, buf := range buffers[address] {
+			lines += buf.String()
+		}
+	}
+	return lines
+}
+
+func TestPrepareWriteWithoutMetricName(t *testing.T) {
+	unnamedMetric := model.Metric{"owner": "team-X"}
+	samples := model.Samples{
+		{Metric: unnamedMetric, Value: 42, Timestamp: 300000},
+		{Metric: model.Metric{model.MetricNameLabel: "test"}, Value: 18, Timestamp: 300000},
+	}
+
+	c := newTestWriteClient(config.WriteConfig{})
+	require.Equal(t, "prometheus-prefix.test 18.000000 300\n", preparedLines(t, c, samples))
+
+	c = newTestWriteClient(config.WriteConfig{MissingNamePlaceholder: "unnamed"})
+	require.Equal(t,
+		"prometheus-prefix.unnamed.owner.team-X 42.000000 300\n"+
+			"prometheus-prefix.test 18.000000 300\n",
+		preparedLines(t, c, samples))
+	// The original metric must not be modified.
+	require.Equal(t, model.Metric{"owner": "team-X"}, unnamedMetric)
+}
+
+func TestPrepareWriteWithPrefixWithoutTrailingDot(t *testing.T) {
+	samples := model.Samples{{Metric: model.Metric{model.MetricNameLabel: "test"}, Value: 18, Timestamp: 300000}}
+
+	c := newTestWriteClient(config.WriteConfig{})
+	c.defaultPrefix = paths.LiteralPrefix("prometheus-prefix")
+	c.format.PrefixSeparator = true
+	require.Equal(t, "prometheus-prefix.test 18.000000 300\n", preparedLines(t, c, samples))
+}
+
+func TestPrepareWriteWithRequestPrefix(t *testing.T) {
+	samples := model.Samples{{Metric: model.Metric{model.MetricNameLabel: "test"}, Value: 18, Timestamp: 300000}}
+
+	c := newTestWriteClient(config.WriteConfig{})
+	prefix, err := paths.ParsePrefix("{{.env}}.")
+	require.NoError(t, err)
+	c.defaultPrefix = prefix
+	c.cfg.Write.TemplateData = map[string]interface{}{"env": "prod"}
+	require.Equal(t, "prod.test 18.000000 300\n", preparedLines(t, c, samples))
+
+	// Prefixes from requests are never rendered as templates.
+	fakeRequest, _ := http.NewRequest("POST", "http://fakeHost:6666?graphite.default-prefix={{.env}}.", nil)
+	buffers, _, err := c.prepareWrite(samples, fakeRequest)
+	require.NoError(t, err)
+	require.Equal(t, "{{.env}}.test 18.000000 300\n", buffers[""][0].String())
+}
+
+func TestPrepareWriteWithRequestFormat(t *testing.T) {
+	samples := model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "test", "owner": "team-X"}, Value: 42, Timestamp: 300000},
+	}
+	c := newTestWriteClient(config.WriteConfig{})
+
+	fakeRequest, _ := http.NewRequest("POST", "http://fakeHost:6666?graphite.format=tags", nil)
+	buffers, _, err := c.prepareWrite(samples, fakeRequest)
+	require.NoError(t, err)
+	require.Equal(t, "prometheus-prefix.test;owner=team-X 42.000000 300\n", buffers[""][0].String())
+
+	fakeRequest, _ = http.NewRequest("POST", "http://fakeHost:6666?graphite.format=foo", nil)
+	_, _, err = c.prepareWrite(samples, fakeRequest)
+	require.Error(t, err)
+
+	require.Equal(t, "prometheus-prefix.test.owner.team-X 42.000000 300\n", preparedLines(t, c, samples))
+}
+
+func TestDownsample(t *testing.T) {
+	metricX := model.Metric{model.MetricNameLabel: "test", "owner": "team-X"}
+	metricY := model.Metric{model.MetricNameLabel: "test", "owner": "team-Y"}
+	samples := model.Samples{
+		{Metric: metricX, Value: 1, Timestamp: 0},
+		{Metric: metricY, Value: 2, Timestamp: 1000},
+		{Metric: metricX, Value: 3, Timestamp: 9000},
+		{Metric: metricX, Value: 4, Timestamp: 10000},
+		{Metric: metricY, Value: 5, Timestamp: 5000},
+	}
+
+	expected := model.Samples{
+		{Metric: metricX, Value: 3, Timestamp: 9000},
+		{Metric: metricY, Value: 5, Timestamp: 5000},
+		{Metric: metricX, Value: 4, Timestamp: 10000},
+	}
+	require.Equal(t, expected, downsample(samples, 10*time.Second))
+}
+
+func TestWriteClosesIdleConnection(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	c := newTestWriteClient(config.WriteConfig{
+		CarbonAddress:           listener.Addr().String(),
+		CarbonTransport:         "tcp",
+		CarbonReconnectInterval: time.Hour,
+		CarbonIdleTimeout:       10 * time.Millisecond,
+	})
+	c.writeTimeout = time.Second
+	defer c.Shutdown()
+
+	fakeRequest, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	samples := model.Samples{{Metric: model.Metric{model.MetricNameLabel: "test"}, Value: 18}}
+	_, err = c.Write(samples, fakeRequest, false)
+	require.NoError(t, err)
+
+	c.carbonConLock.Lock()
+	require.NotNil(t, c.carbonCon)
+	c.carbonConLock.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+	c.carbonConLock.Lock()
+	require.Nil(t, c.carbonCon)
+	c.carbonConLock.Unlock()
+}
+
+func TestWriteDeadLettersOnlyOnRealWrites(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	dir, err := ioutil.TempDir("", "deadletter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "dead.jsonl")
+
+	c := newTestWriteClient(config.WriteConfig{
+		CarbonAddress:   listener.Addr().String(),
+		CarbonTransport: "tcp",
+	})
+	c.writeTimeout = time.Second
+	c.deadLetters, err = newDeadLetterWriter(filename, log.NewNopLogger())
+	require.NoError(t, err)
+
+	fakeRequest, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	samples := model.Samples{{Metric: model.Metric{"owner": "team-X"}, Value: 18}}
+	_, err = c.Write(samples, fakeRequest, true)
+	require.NoError(t, err)
+	_, err = c.Write(samples, fakeRequest, false)
+	require.NoError(t, err)
+	// Shutting down flushes the dead letters.
+	c.Shutdown()
+
+	content, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	expected := `{"sample":{"metric":{"owner":"team-X"},"value":[0,"18"]},"reason":"` + paths.ErrMissingMetricName.Error() + `"}` + "\n"
+	require.Equal(t, expected, string(content))
+}
+
+func TestWriteDetectsHTTPServer(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	logs := make(chan string, 10)
+	c := newTestWriteClient(config.WriteConfig{
+		CarbonAddress:   server.Listener.Addr().String(),
+		CarbonTransport: "tcp",
+	})
+	c.writeLogger = log.LoggerFunc(func(keyvals ...interface{}) error {
+		logs <- fmt.Sprint(keyvals...)
+		return nil
+	})
+	c.writeTimeout = time.Second
+	defer c.Shutdown()
+
+	fakeRequest, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	samples := model.Samples{{Metric: model.Metric{model.MetricNameLabel: "test"}, Value: 18}}
+	_, err := c.Write(samples, fakeRequest, false)
+	require.NoError(t, err)
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case l := <-logs:
+			if strings.Contains(l, "appears to be an HTTP server") {
+				return
+			}
+		case <-timeout:
+			t.Fatal("HTTP server not detected")
+		}
+	}
+}
+
+func TestWriteExpectAck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// The relay acknowledges the writes with the given lines, in order.
+	acks := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				for {
+					if _, err := conn.Read(buf); err != nil {
+						return
+					}
+					if ack := <-acks; ack != "" {
+						conn.Write([]byte(ack + "\n"))
+					}
+				}
+			}()
+		}
+	}()
+
+	c := newTestWriteClient(config.WriteConfig{
+		CarbonAddress:   listener.Addr().String(),
+		CarbonTransport: "tcp",
+		ExpectAck:       true,
+	})
+	c.writeTimeout = 100 * time.Millisecond
+	defer c.Shutdown()
+
+	fakeRequest, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	samples := model.Samples{{Metric: model.Metric{model.MetricNameLabel: "test"}, Value: 18}}
+
+	acks <- "OK"
+	_, err = c.Write(samples, fakeRequest, false)
+	require.NoError(t, err)
+
+	acks <- "ERR queue full"
+	_, err = c.Write(samples, fakeRequest, false)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "queue full")
+
+	// No acknowledgement within the write timeout.
+	acks <- ""
+	_, err = c.Write(samples, fakeRequest, false)
+	require.Error(t, err)
+}
+
+func TestWriteToCarbonDeadline(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	// The receiver accepts connections but never reads from them.
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	c := newTestWriteClient(config.WriteConfig{
+		CarbonAddress:           listener.Addr().String(),
+		CarbonTransport:         "tcp",
+		CarbonReconnectInterval: time.Hour,
+		CarbonWriteDeadline:     50 * time.Millisecond,
+	})
+	defer c.Shutdown()
+
+	// Writes succeed until the socket buffers are full, then block.
+	data := bytes.Repeat([]byte("test 1 0\n"), 8<<10)
+	c.carbonConLock.Lock()
+	for i := 0; i < 1<<10 && err == nil; i++ {
+		err = c.writeToCarbon(c.cfg.Write.CarbonAddress, data)
+	}
+	disconnected := c.carbonCon == nil
+	c.carbonConLock.Unlock()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "deadline")
+	require.True(t, disconnected, "Expected the connection to be closed after the deadline")
+
+	for len(accepted) > 0 {
+		(<-accepted).Close()
+	}
+}
+
+func TestWriteCountsDatapointsPerDestination(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	// Nothing listens on the address of the route.
+	unreachable, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	unreachable.Close()
+
+	address := listener.Addr().String()
+	c := newTestWriteClient(config.WriteConfig{
+		CarbonAddress:   address,
+		CarbonTransport: "tcp",
+		Routes: []*config.Route{
+			{Match: config.LabelSet{"owner": "team-Y"}, CarbonAddress: unreachable.Addr().String()},
+		},
+	})
+	c.writeTimeout = time.Second
+	defer c.Shutdown()
+
+	sent := testutil.ToFloat64(sentDatapoints.WithLabelValues(address))
+	failed := testutil.ToFloat64(failedDatapoints.WithLabelValues(unreachable.Addr().String()))
+
+	fakeRequest, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	samples := model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "test", "owner": "team-X"}, Value: 1},
+		{Metric: model.Metric{model.MetricNameLabel: "test", "owner": "team-X"}, Value: 2, Timestamp: 1000},
+		{Metric: model.Metric{model.MetricNameLabel: "test", "owner": "team-Y"}, Value: 3},
+	}
+	_, err = c.Write(samples, fakeRequest, false)
+	require.Error(t, err)
+
+	require.Equal(t, sent+2, testutil.ToFloat64(sentDatapoints.WithLabelValues(address)))
+	require.Equal(t, failed+1, testutil.ToFloat64(failedDatapoints.WithLabelValues(unreachable.Addr().String())))
+}
+
+func TestWriteCountsCarbonBytes(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	address := conn.LocalAddr().String()
+	c := newTestWriteClient(config.WriteConfig{CarbonAddress: address, CarbonTransport: "udp"})
+	c.writeTimeout = time.Second
+	defer c.Shutdown()
+	samples := model.Samples{}
+	for i := 0; i < 40; i++ {
+		samples = append(samples, &model.Sample{
+			Metric: model.Metric{model.MetricNameLabel: "test"}, Value: 1, Timestamp: model.Time(i * 1000)})
+	}
+
+	// Dry runs aren't counted.
+	fakeRequest, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	lines, err := c.Write(samples, fakeRequest, true)
+	require.NoError(t, err)
+	require.Equal(t, float64(0), testutil.ToFloat64(c.carbonBytes.WithLabelValues(address)))
+	require.Equal(t, uint64(0), histogramCount(t, c.carbonLinesPerBatch.WithLabelValues(address)))
+
+	_, err = c.Write(samples, fakeRequest, false)
+	require.NoError(t, err)
+	// The lines don't fit in a single UDP datagram.
+	require.True(t, len(lines) > config.DefaultUDPMaxBytes && len(lines) <= 2*config.DefaultUDPMaxBytes)
+	require.Equal(t, float64(len(lines)), testutil.ToFloat64(c.carbonBytes.WithLabelValues(address)))
+	require.Equal(t, uint64(2), histogramCount(t, c.carbonLinesPerBatch.WithLabelValues(address)))
+}
+
+func TestPrepareWriteWithUDPMaxBytes(t *testing.T) {
+	c := newTestWriteClient(config.WriteConfig{
+		CarbonAddress: "carbon:2003", CarbonTransport: "udp", UDPMaxBytes: 100})
+	samples := model.Samples{}
+	for i := 0; i < 10; i++ {
+		// Lines of the same length: "prometheus-prefix.test 1.000000 100000X\n".
+		samples = append(samples, &model.Sample{
+			Metric: model.Metric{model.MetricNameLabel: "test"}, Value: 1, Timestamp: model.Time((1000000 + i) * 1000)})
+	}
+
+	fakeRequest, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	buffers, _, err := c.prepareWrite(samples, fakeRequest)
+	require.NoError(t, err)
+
+	lineLength := len("prometheus-prefix.test 1.000000 1000000\n")
+	linesPerDatagram := 100 / lineLength
+	require.Len(t, buffers["carbon:2003"], (10+linesPerDatagram-1)/linesPerDatagram)
+	for i, buf := range buffers["carbon:2003"] {
+		expected := linesPerDatagram * lineLength
+		if i == len(buffers["carbon:2003"])-1 {
+			expected = (10 - i*linesPerDatagram) * lineLength
+		}
+		require.Equal(t, expected, buf.Len())
+	}
+}
+
+func histogramCount(t *testing.T, o prometheus.Observer) uint64 {
+	m := &dto.Metric{}
+	require.NoError(t, o.(prometheus.Histogram).Write(m))
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestPrepareWriteWithRoutes(t *testing.T) {
+	samples := model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "test", "team": "storage"}, Value: 1, Timestamp: 300000},
+		{Metric: model.Metric{model.MetricNameLabel: "test", "team": "compute"}, Value: 2, Timestamp: 300000},
+		{Metric: model.Metric{model.MetricNameLabel: "other", "team": "storage"}, Value: 3, Timestamp: 300000},
+	}
+	c := newTestWriteClient(config.WriteConfig{
+		CarbonAddress: "carbon-b:2003",
+		Routes: []*config.Route{
+			{Match: config.LabelSet{"team": "storage"}, CarbonAddress: "carbon-a:2003"},
+		},
+	})
+
+	fakeRequest, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+	buffers, _, err := c.prepareWrite(samples, fakeRequest)
+	require.NoError(t, err)
+	require.Len(t, buffers, 2)
+	require.Equal(t,
+		"prometheus-prefix.test.team.storage 1.000000 300\n"+
+			"prometheus-prefix.other.team.storage 3.000000 300\n",
+		buffers["carbon-a:2003"][0].String())
+	require.Equal(t,
+		"prometheus-prefix.test.team.compute 2.000000 300\n",
+		buffers["carbon-b:2003"][0].String())
+	require.Equal(t, []string{"carbon-b:2003", "carbon-a:2003"}, c.carbonAddresses())
+}
+
+func TestPrepareWriteKeepsSeriesOrdered(t *testing.T) {
+	metricX := model.Metric{model.MetricNameLabel: "test", "owner": "team-X"}
+	metricY := model.Metric{model.MetricNameLabel: "test", "owner": "team-Y"}
+	samples := model.Samples{
+		{Metric: metricX, Value: 2, Timestamp: 600000},
+		{Metric: metricY, Value: 3, Timestamp: 300000},
+		{Metric: metricX, Value: 1, Timestamp: 300000},
+	}
+	original := append(model.Samples{}, samples...)
+
+	c := newTestWriteClient(config.WriteConfig{})
+	require.Equal(t,
+		"prometheus-prefix.test.owner.team-Y 3.000000 300\n"+
+			"prometheus-prefix.test.owner.team-X 1.000000 300\n"+
+			"prometheus-prefix.test.owner.team-X 2.000000 600\n",
+		preparedLines(t, c, samples))
+	// Samples are shared between writers, they must not be reordered in place.
+	require.Equal(t, original, samples)
+}
+
+func TestPrepareWriteGroupByPath(t *testing.T) {
+	metricX := model.Metric{model.MetricNameLabel: "test", "owner": "team-X"}
+	metricY := model.Metric{model.MetricNameLabel: "test", "owner": "team-Y"}
+	samples := model.Samples{
+		{Metric: metricY, Value: 1, Timestamp: 300000},
+		{Metric: metricX, Value: 2, Timestamp: 300000},
+		{Metric: metricY, Value: 3, Timestamp: 600000},
+		{Metric: metricX, Value: 4, Timestamp: 600000},
+	}
+
+	c := newTestWriteClient(config.WriteConfig{GroupByPath: true})
+	require.Equal(t,
+		"prometheus-prefix.test.owner.team-X 2.000000 300\n"+
+			"prometheus-prefix.test.owner.team-X 4.000000 600\n"+
+			"prometheus-prefix.test.owner.team-Y 1.000000 300\n"+
+			"prometheus-prefix.test.owner.team-Y 3.000000 600\n",
+		preparedLines(t, c, samples))
+}
+
+func TestLinePath(t *testing.T) {
+	require.Equal(t, "a.b", linePath("a.b 1.000000 300\n"))
+	require.Equal(t, `a{b="c d"}`, linePath(`a{b="c d"} 1.000000 300`+"\n"))
+	require.Equal(t, "a.b", linePath("a.b"))
+}
+
+func BenchmarkPrepareWrite(b *testing.B) {
+	var samples model.Samples
+	for t := 0; t < 10; t++ {
+		for i := 0; i < 1000; i++ {
+			samples = append(samples, &model.Sample{
+				Metric: model.Metric{
+					model.MetricNameLabel: "http_requests_total",
+					"instance":            model.LabelValue(fmt.Sprintf("host-%d:9100", i)),
+					"job":                 "node",
+				},
+				Value:     model.SampleValue(i),
+				Timestamp: model.Time(t * 15000),
+			})
+		}
+	}
+	fakeRequest, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+
+	for _, groupByPath := range []bool{false, true} {
+		b.Run(fmt.Sprintf("group_by_path=%v", groupByPath), func(b *testing.B) {
+			c := newTestWriteClient(config.WriteConfig{GroupByPath: groupByPath})
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.prepareWrite(samples, fakeRequest)
+			}
+		})
+	}
+	for _, renderWorkers := range []int{4, 8} {
+		b.Run(fmt.Sprintf("render_workers=%d", renderWorkers), func(b *testing.B) {
+			c := newTestWriteClient(config.WriteConfig{RenderWorkers: renderWorkers})
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.prepareWrite(samples, fakeRequest)
+			}
+		})
+	}
+}
+
+func TestPrepareWriteWithRenderWorkers(t *testing.T) {
+	var samples model.Samples
+	for i := 0; i < 100; i++ {
+		samples = append(samples, &model.Sample{
+			Metric:    model.Metric{model.MetricNameLabel: "test", "instance": model.LabelValue(fmt.Sprintf("host-%d", i%10))},
+			Value:     model.SampleValue(i),
+			Timestamp: model.Time(i * 1000),
+		})
+	}
+	// Samples without a name are dropped whatever the number of workers.
+	samples = append(samples, &model.Sample{Metric: model.Metric{"owner": "team-X"}, Value: 1})
+
+	expected := preparedLines(t, newTestWriteClient(config.WriteConfig{}), samples)
+	require.Equal(t, expected, preparedLines(t, newTestWriteClient(config.WriteConfig{RenderWorkers: 4}), samples))
+}
+
+func TestConcurrentPrepareWrite(t *testing.T) {
+	paths.InitPathsCache(time.Hour, time.Hour)
+	defer paths.DisablePathsCache()
+
+	tmpl, err := config.ParseTemplate("team.{{.labels.owner}}")
+	require.NoError(t, err)
+	c := newTestWriteClient(config.WriteConfig{
+		Rules: []*config.Rule{
+			{Match: config.LabelSet{"owner": "team-X"}, Tmpl: tmpl, Continue: true},
+		},
+	})
+	samples := model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "test", "owner": "team-X"}, Value: 1, Timestamp: 300000},
+		{Metric: model.Metric{model.MetricNameLabel: "test", "owner": "team-Y"}, Value: 2, Timestamp: 300000},
+	}
+	expected := "team.team-X 1.000000 300\n" +
+		"prometheus-prefix.test.owner.team-X 1.000000 300\n" +
+		"prometheus-prefix.test.owner.team-Y 2.000000 300\n"
+
+	// Writers share the paths cache, run with -race.
+	done := make(chan string)
+	for i := 0; i < 8; i++ {
+		go func() {
+			fakeRequest, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+			buffers, _, err := c.prepareWrite(samples, fakeRequest)
+			if err != nil {
+				done <- err.Error()
+				return
+			}
+			done <- buffers[""][0].String()
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		require.Equal(t, expected, <-done)
+	}
+}
+
+func TestPrepareWriteDropsByName(t *testing.T) {
+	samples := model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "go_goroutines"}, Value: 1, Timestamp: 300000},
+		{Metric: model.Metric{model.MetricNameLabel: "test"}, Value: 2, Timestamp: 300000},
+		{Metric: model.Metric{model.MetricNameLabel: "process_open_fds"}, Value: 3, Timestamp: 300000},
+		{Metric: model.Metric{model.MetricNameLabel: "test_go_version"}, Value: 4, Timestamp: 300000},
+	}
+	original := append(model.Samples{}, samples...)
+
+	var cfg config.Config
+	require.NoError(t, yaml.Unmarshal([]byte("write:\n  drop_name_regex: (go|process)_.*"), &cfg))
+	c := newTestWriteClient(cfg.Write)
+	require.Equal(t,
+		"prometheus-prefix.test 2.000000 300\n"+
+			"prometheus-prefix.test_go_version 4.000000 300\n",
+		preparedLines(t, c, samples))
+	require.Equal(t, original, samples)
+}
+
+func TestSimulateLikePrepareWrite(t *testing.T) {
+	samples := model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "go_goroutines"}, Value: 1, Timestamp: 360000},
+		{Metric: model.Metric{model.MetricNameLabel: "test"}, Value: 2, Timestamp: 360000},
+		{Metric: model.Metric{model.MetricNameLabel: "test"}, Value: 3, Timestamp: 300000},
+	}
+	fakeRequest, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+
+	var cfg config.Config
+	require.NoError(t, yaml.Unmarshal([]byte("write:\n  drop_name_regex: go_.*\n  constant_labels:\n    dc: par"), &cfg))
+	c := newTestWriteClient(cfg.Write)
+	simulated, err := c.Simulate(samples, fakeRequest)
+	require.NoError(t, err)
+
+	// Dropped samples are left out, the others are simulated in timestamp order.
+	var datapoints []string
+	for _, s := range simulated.([]*SimulatedSample) {
+		for _, d := range s.Datapoints {
+			datapoints = append(datapoints, d.Datapoint)
+		}
+	}
+	require.Equal(t, preparedLines(t, c, samples), strings.Join(datapoints, ""))
+	require.Equal(t, []string{
+		"prometheus-prefix.test.dc.par 3.000000 300\n",
+		"prometheus-prefix.test.dc.par 2.000000 360\n",
+	}, datapoints)
+}
+
+func TestPrepareWriteMaxUniqueSeries(t *testing.T) {
+	samples := model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "test", "owner": "team-X"}, Value: 1, Timestamp: 300000},
+		{Metric: model.Metric{model.MetricNameLabel: "test", "owner": "team-X"}, Value: 2, Timestamp: 360000},
+		{Metric: model.Metric{model.MetricNameLabel: "test", "owner": "team-Y"}, Value: 3, Timestamp: 300000},
+	}
+	fakeRequest, _ := http.NewRequest("POST", "http://fakeHost:6666", nil)
+
+	c := newTestWriteClient(config.WriteConfig{MaxUniqueSeries: 2})
+	_, _, err := c.prepareWrite(samples, fakeRequest)
+	require.NoError(t, err)
+
+	before := testutil.ToFloat64(cardinalityRejectedRequests)
+	c = newTestWriteClient(config.WriteConfig{MaxUniqueSeries: 1})
+	_, _, err = c.prepareWrite(samples, fakeRequest)
+	require.Error(t, err)
+	require.Equal(t, before+1, testutil.ToFloat64(cardinalityRejectedRequests))
+}
+
+func TestPrepareWriteWithConstantLabels(t *testing.T) {
+	metric := model.Metric{model.MetricNameLabel: "test", "owner": "team-X"}
+	samples := model.Samples{
+		{Metric: metric, Value: 1, Timestamp: 300000},
+		{Metric: model.Metric{model.MetricNameLabel: "test", "region": "us"}, Value: 2, Timestamp: 300000},
+	}
+
+	c := newTestWriteClient(config.WriteConfig{ConstantLabels: config.LabelSet{"region": "eu"}})
+	require.Equal(t,
+		"prometheus-prefix.test.owner.team-X.region.eu 1.000000 300\n"+
+			"prometheus-prefix.test.region.us 2.000000 300\n",
+		preparedLines(t, c, samples))
+	// The original metric must not be modified.
+	require.Equal(t, model.Metric{model.MetricNameLabel: "test", "owner": "team-X"}, metric)
+}
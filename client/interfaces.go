@@ -16,6 +16,7 @@ package client
 import (
 	"net/http"
 
+	"github.com/criteo/graphite-remote-adapter/config"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/prompb"
 )
@@ -39,3 +40,22 @@ type Reader interface {
 	Read(req *prompb.ReadRequest, r *http.Request) (*prompb.ReadResponse, error)
 	Client
 }
+
+// Simulator is a client able to describe how samples would be written to remote.
+type Simulator interface {
+	Simulate(samples model.Samples, r *http.Request) (interface{}, error)
+	Client
+}
+
+// HealthChecker is a client able to tell whether it is healthy.
+type HealthChecker interface {
+	Healthy() error
+	Client
+}
+
+// ReadReloader is a client able to apply a new read configuration without
+// being rebuilt, e.g. keeping its write connections.
+type ReadReloader interface {
+	ApplyReadConfig(cfg *config.Config)
+	Client
+}
@@ -23,10 +23,10 @@ import (
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/imdario/mergo"
-	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/version"
 
 	"github.com/criteo/graphite-remote-adapter/config"
+	"github.com/criteo/graphite-remote-adapter/utils"
 	"github.com/criteo/graphite-remote-adapter/web"
 )
 
@@ -34,6 +34,7 @@ func reload(cliCfg *config.Config, logger log.Logger) (*config.Config, error) {
 	cfg := &config.DefaultConfig
 	// Parse config file if needed
 	if cliCfg.ConfigFile != "" {
+		utils.SetStrictConfig(cliCfg.ConfigStrict)
 		fileCfg, err := config.LoadFile(logger, cliCfg.ConfigFile)
 		if err != nil {
 			level.Error(logger).Log("err", err, "msg", "Error loading config file")
@@ -65,7 +66,9 @@ func reload(cliCfg *config.Config, logger log.Logger) (*config.Config, error) {
 func main() {
 	cliCfg := config.ParseCommandLine()
 
-	logger := promlog.New(&promlog.Config{Level: &cliCfg.LogLevel, Format: &promlog.AllowedFormat{}})
+	// Components filter the logs of baseLogger at their own level.
+	baseLogger := utils.NewBaseLogger()
+	logger := utils.LevelLogger(baseLogger, cliCfg.LogLevel.String())
 	level.Info(logger).Log("msg", "Starting graphite-remote-adapter", "version", version.Info())
 	level.Info(logger).Log("build_context", version.BuildContext())
 
@@ -76,14 +79,14 @@ func main() {
 		return
 	}
 
-	webHandler := web.New(log.With(logger, "component", "web"), cfg)
+	webHandler := web.New(baseLogger, cfg)
 	if err := webHandler.ApplyConfig(cfg); err != nil {
 		level.Error(logger).Log("err", err, "msg", "Error applying webHandler config")
 		return
 	}
 
 	// Tooling to dynamically reload the config for each clients.
-	hup := make(chan os.Signal)
+	hup := make(chan os.Signal, 1)
 	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
 		for {
@@ -99,17 +102,17 @@ func main() {
 					continue
 				}
 				level.Info(logger).Log("msg", "Reloaded config file")
-			case rc := <-webHandler.Reload():
+			case req := <-webHandler.Reload():
 				cfg, err := reload(cliCfg, logger)
 				if err != nil {
 					level.Error(logger).Log("err", err, "msg", "Error reloading config")
-					rc <- err
-				} else if err := webHandler.ApplyConfig(cfg); err != nil {
+					req.Err <- err
+				} else if err := webHandler.ApplyConfigSection(cfg, req.Section); err != nil {
 					level.Error(logger).Log("err", err, "msg", "Error applying webHandler config")
-					rc <- err
+					req.Err <- err
 				} else {
-					level.Info(logger).Log("msg", "Reloaded config file")
-					rc <- nil
+					level.Info(logger).Log("section", req.Section, "msg", "Reloaded config file")
+					req.Err <- nil
 				}
 			}
 		}
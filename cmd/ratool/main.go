@@ -27,6 +27,7 @@ func main() {
 
 	configureMockWriteCmd(app)
 	configureUnittestCmd(app)
+	configureSchemaCmd(app)
 
 	app.GetFlag("help").Short('h')
 	kingpin.MustParse(app.Parse(os.Args[1:]))
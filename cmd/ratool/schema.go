@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	graphiteCfg "github.com/criteo/graphite-remote-adapter/client/graphite/config"
+	"github.com/criteo/graphite-remote-adapter/config"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	schemaHelp = `Print the JSON Schema of the remote-adapter configuration file.`
+
+	jsonSchemaDraft = "http://json-schema.org/draft-07/schema#"
+	durationPattern = `^(\d+(\.\d+)?(ns|us|µs|ms|s|m|h))+$`
+)
+
+var (
+	durationType      = reflect.TypeOf(time.Duration(0))
+	yamlMarshalerType = reflect.TypeOf((*yaml.Marshaler)(nil)).Elem()
+	urlListType       = reflect.TypeOf(graphiteCfg.URLList{})
+)
+
+type schemaCmd struct{}
+
+func configureSchemaCmd(app *kingpin.Application) {
+	var (
+		s         = &schemaCmd{}
+		schemaCmd = app.Command("schema", schemaHelp)
+	)
+	schemaCmd.Action(s.Schema)
+}
+
+func (s *schemaCmd) Schema(ctx *kingpin.ParseContext) error {
+	b, err := json.MarshalIndent(configSchema(), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+// configSchema builds the JSON Schema of config.Config from its yaml struct tags.
+func configSchema() map[string]interface{} {
+	schema := typeSchema(reflect.TypeOf(config.Config{}))
+	schema["$schema"] = jsonSchemaDraft
+	schema["title"] = "graphite-remote-adapter configuration"
+	return schema
+}
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	// Types marshaled as YAML scalars (templates, regexps) are strings.
+	if t.Implements(yamlMarshalerType) {
+		return map[string]interface{}{"type": "string"}
+	}
+	// URL lists can also be given as a single URL.
+	if t == urlListType {
+		return map[string]interface{}{"anyOf": []interface{}{
+			map[string]interface{}{"type": "string"},
+			map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+		}}
+	}
+	if t == durationType {
+		return map[string]interface{}{"type": "string", "pattern": durationPattern}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		schema := map[string]interface{}{"type": "object"}
+		if t.Elem().Kind() != reflect.Interface {
+			schema["additionalProperties"] = typeSchema(t.Elem())
+		}
+		return schema
+	case reflect.Struct:
+		return structSchema(t)
+	}
+	// Anything goes, e.g. interface{}.
+	return map[string]interface{}{}
+}
+
+func structSchema(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		// Skip unexported fields and fields which can't be set from YAML.
+		if field.PkgPath != "" {
+			continue
+		}
+		tag, ok := field.Tag.Lookup("yaml")
+		if !ok {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		properties[name] = typeSchema(field.Type)
+	}
+	// Unknown fields are rejected when loading the configuration.
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_configSchema(t *testing.T) {
+	schema := configSchema()
+	assert.Equal(t, jsonSchemaDraft, schema["$schema"])
+	assert.Equal(t, false, schema["additionalProperties"])
+
+	properties := schema["properties"].(map[string]interface{})
+	assert.NotContains(t, properties, "ConfigFile")
+	assert.NotContains(t, properties, "XXX")
+
+	graphite := properties["graphite"].(map[string]interface{})["properties"].(map[string]interface{})
+	read := graphite["read"].(map[string]interface{})["properties"].(map[string]interface{})
+	assert.Contains(t, read["url"], "anyOf")
+	write := graphite["write"].(map[string]interface{})["properties"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"type": "string", "pattern": durationPattern}, write["paths_cache_ttl"])
+	assert.Equal(t, map[string]interface{}{"type": "object"}, write["template_data"])
+
+	rule := write["rules"].(map[string]interface{})["items"].(map[string]interface{})["properties"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"type": "string"}, rule["template"])
+	assert.Equal(t, map[string]interface{}{"type": "boolean"}, rule["continue"])
+	assert.Equal(t, map[string]interface{}{
+		"type":                 "object",
+		"additionalProperties": map[string]interface{}{"type": "string"},
+	}, rule["match_re"])
+}
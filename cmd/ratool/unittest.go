@@ -5,6 +5,7 @@ import (
 	"github.com/andreyvit/diff"
 	"github.com/criteo/graphite-remote-adapter/client/graphite/paths"
 	"github.com/criteo/graphite-remote-adapter/config"
+	"github.com/criteo/graphite-remote-adapter/utils"
 	"github.com/go-kit/kit/log/level"
 	"github.com/prometheus/common/model"
 	"github.com/sergi/go-diff/diffmatchpatch"
@@ -98,9 +99,14 @@ func makeSortedOutput(testContext *testConfig, graCfg *config.Config) (string, e
 		return "", err
 	}
 
+	templateData, err := graCfg.Graphite.Write.MergedTemplateData()
+	if err != nil {
+		return "", err
+	}
+
 	var outputPaths []string
 	for _, s := range samples {
-		datapoints, _ := paths.ToDatapoints(s, paths.Format{Type: paths.FormatCarbon}, "", graCfg.Graphite.Write.Rules, graCfg.Graphite.Write.TemplateData)
+		datapoints, _ := paths.ToDatapoints(s, paths.Format{Type: paths.FormatCarbon}, paths.LiteralPrefix(""), graCfg.Graphite.Write.Rules, templateData)
 		for _, dt := range datapoints {
 			outputPaths = append(outputPaths, dt)
 		}
@@ -111,7 +117,7 @@ func makeSortedOutput(testContext *testConfig, graCfg *config.Config) (string, e
 
 func makeSamples(input string) ([]*model.Sample, error) {
 	reader := strings.NewReader(input)
-	return readSamples(reader)
+	return utils.ReadSamples(reader)
 }
 
 type unittestConfig struct {
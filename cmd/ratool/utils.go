@@ -1,10 +1,9 @@
 package main
 
 import (
-	"io"
 	"os"
 
-	"github.com/prometheus/common/expfmt"
+	"github.com/criteo/graphite-remote-adapter/utils"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/promlog"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
@@ -26,29 +25,5 @@ func loadSamplesFile(filename string) ([]*model.Sample, error) {
 	if err != nil {
 		return nil, err
 	}
-	return readSamples(file)
-}
-
-func readSamples(reader io.Reader) ([]*model.Sample, error) {
-	dec := &expfmt.SampleDecoder{
-		Dec: expfmt.NewDecoder(reader, expfmt.FmtText),
-		Opts: &expfmt.DecodeOptions{
-			Timestamp: model.Now(),
-		},
-	}
-
-	var all model.Vector
-	for {
-		var smpls model.Vector
-		err := dec.Decode(&smpls)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
-		all = append(all, smpls...)
-	}
-
-	return all, nil
+	return utils.ReadSamples(file)
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 
 	graphite "github.com/criteo/graphite-remote-adapter/client/graphite/config"
 	"github.com/pkg/errors"
@@ -14,7 +15,7 @@ import (
 
 // ParseCommandLine parse flags and args from cli.
 func ParseCommandLine() *Config {
-	cfg := &Config{}
+	cfg := &Config{Log: logOptions{Components: map[string]string{}}}
 
 	a := kingpin.New(filepath.Base(os.Args[0]), "The Graphite remote adapter")
 
@@ -25,17 +26,48 @@ func ParseCommandLine() *Config {
 	a.Flag("config.file", "Graphite-remote-adapter configuration file path.").
 		StringVar(&cfg.ConfigFile)
 
+	a.Flag("config.strict", "Reject configuration files with unknown fields. Otherwise they are logged and ignored.").
+		Default("true").BoolVar(&cfg.ConfigStrict)
+
 	a.Flag("web.listen-address", "Address to listen on for UI and telemtry.").
 		StringVar(&cfg.Web.ListenAddress)
 
 	a.Flag("web.telemetry-path", "Path to listen for telemtry.").
 		StringVar(&cfg.Web.TelemetryPath)
 
+	a.Flag("web.external-url",
+		"URL under which the adapter is externally reachable, e.g. behind a reverse proxy. Its path prefixes the web endpoints.").
+		StringVar(&cfg.Web.ExternalURL)
+
+	a.Flag("web.route-prefix",
+		"Prefix of the web endpoints. Defaults to the path of web.external-url.").
+		StringVar(&cfg.Web.RoutePrefix)
+
+	a.Flag("web.verbose-errors",
+		"Send error messages in responses, use --no-web.verbose-errors to only log them. Default is true").
+		SetValue(&boolPtrValue{&cfg.Web.VerboseErrors})
+
+	a.Flag("web.enable-paths-cache-debug",
+		"Serve the entries of the Graphite paths cache as JSON on /debug/paths-cache.").
+		BoolVar(&cfg.Web.EnablePathsCacheDebug)
+
 	a.Flag("write.timeout",
 		"Maximum duration before timing out remote write requests. Default is 5m").
 		Default(DefaultConfig.Write.Timeout.String()).
 		DurationVar(&cfg.Write.Timeout)
 
+	a.Flag("write.disabled",
+		"Reject remote write requests, e.g. for read-only replicas.").
+		BoolVar(&cfg.Write.Disabled)
+
+	a.Flag("write.allow-no-writers",
+		"Accept and discard write requests when no writer is configured, instead of failing them.").
+		BoolVar(&cfg.Write.AllowNoWriters)
+
+	a.Flag("write.duplicate-labels",
+		"Value kept of a label repeated in a series: last or first, or reject to fail the request. Default is last").
+		EnumVar(&cfg.Write.DuplicateLabels, DuplicateLabelsLast, DuplicateLabelsFirst, DuplicateLabelsReject)
+
 	a.Flag("read.timeout",
 		"Maximum duration before timing out remote read requests. Default is 5m").
 		Default(DefaultConfig.Read.Timeout.String()).
@@ -50,10 +82,30 @@ func ParseCommandLine() *Config {
 		"Avoid returning error to promtheus returning empty result instead.").
 		BoolVar(&cfg.Read.IgnoreError)
 
+	a.Flag("read.source-label",
+		"If set, label added to read series with the name of the reader they come from.").
+		StringVar(&cfg.Read.SourceLabel)
+
+	a.Flag("read.federate-lookback",
+		"How far before read.delay /federate looks for the latest sample of series. Default is 5m").
+		Default(DefaultConfig.Read.FederateLookback.String()).
+		DurationVar(&cfg.Read.FederateLookback)
+
+	a.Flag("read.disabled",
+		"Reject remote read requests, e.g. for write-only replicas.").
+		BoolVar(&cfg.Read.Disabled)
+
 	// Add logLevel flag
 	a.Flag(promlogflag.LevelFlagName, promlogflag.LevelFlagHelp).
 		Default("info").SetValue(&cfg.LogLevel)
 
+	a.Flag("log.component-level",
+		"Log level of a component, e.g. graphite_read=debug, overriding log.level. Can be repeated.").
+		StringMapVar(&cfg.Log.Components)
+	a.Validate(func(*kingpin.Application) error {
+		return checkComponentLevels(cfg.Log.Components)
+	})
+
 	// Add graphite flag
 	graphite.AddCommandLine(a, &cfg.Graphite)
 
@@ -65,3 +117,30 @@ func ParseCommandLine() *Config {
 	}
 	return cfg
 }
+
+// boolPtrValue is a boolean flag leaving its target nil unless set, so that it
+// doesn't override the configuration file when merged.
+type boolPtrValue struct {
+	target **bool
+}
+
+func (v *boolPtrValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*v.target = &b
+	return nil
+}
+
+func (v *boolPtrValue) String() string {
+	if *v.target == nil {
+		return ""
+	}
+	return strconv.FormatBool(**v.target)
+}
+
+// IsBoolFlag makes the flag a switch, e.g. --no-web.verbose-errors.
+func (v *boolPtrValue) IsBoolFlag() bool {
+	return true
+}
@@ -1,12 +1,19 @@
 package config
 
 import (
+	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/common/promlog"
 	yaml "gopkg.in/yaml.v2"
 
@@ -28,21 +35,64 @@ func Load(s string) (*Config, error) {
 	return cfg, nil
 }
 
+var unknownFields = promauto.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "remote_adapter",
+		Name:      "config_unknown_fields",
+		Help:      "Number of unknown fields ignored in the last loaded configuration file.",
+	},
+)
+
+// gzipMagic are the first bytes of gzip compressed files.
+var gzipMagic = []byte{0x1f, 0x8b}
+
 // LoadFile parses the given YAML file into a Config.
+// Gzip compressed files are transparently decompressed.
 func LoadFile(logger log.Logger, filename string) (*Config, error) {
 	level.Info(logger).Log("file", filename, "msg", "Loading configuration file")
 	content, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
+	if bytes.HasPrefix(content, gzipMagic) {
+		content, err = gunzip(content)
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing %s: %s", filename, err)
+		}
+	}
 	cfg, err := Load(string(content))
 	if err != nil {
 		return nil, err
 	}
+	if err := cfg.Graphite.Write.LoadRulesFile(filepath.Dir(filename)); err != nil {
+		return nil, err
+	}
+	if err := cfg.Graphite.Write.LoadTemplateDataFile(filepath.Dir(filename)); err != nil {
+		return nil, err
+	}
+	if err := cfg.Graphite.Read.LoadCredentials(filepath.Dir(filename)); err != nil {
+		return nil, err
+	}
+
+	// Unknown fields are only recorded when the configuration isn't strict.
+	fields := utils.TakeUnknownConfigFields()
+	for _, field := range fields {
+		level.Warn(logger).Log("file", filename, "field", field, "msg", "Ignoring unknown configuration field")
+	}
+	unknownFields.Set(float64(len(fields)))
 
 	return cfg, nil
 }
 
+func gunzip(content []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
 // DefaultConfig is the default top-level configuration.
 var DefaultConfig = Config{
 	Web: webOptions{
@@ -50,9 +100,10 @@ var DefaultConfig = Config{
 		TelemetryPath: "/metrics",
 	},
 	Read: readOptions{
-		Timeout:     5 * time.Minute,
-		Delay:       1 * time.Hour,
-		IgnoreError: true,
+		Timeout:          5 * time.Minute,
+		Delay:            1 * time.Hour,
+		IgnoreError:      true,
+		FederateLookback: 5 * time.Minute,
 	},
 	Write: writeOptions{
 		Timeout: 5 * time.Minute,
@@ -64,11 +115,15 @@ var DefaultConfig = Config{
 type Config struct {
 	ConfigFile string
 	LogLevel   promlog.AllowedLevel
+	Log        logOptions      `yaml:"log,omitempty" json:"log,omitempty"`
 	Web        webOptions      `yaml:"web,omitempty" json:"web,omitempty"`
 	Read       readOptions     `yaml:"read,omitempty" json:"read,omitempty"`
 	Write      writeOptions    `yaml:"write,omitempty" json:"write,omitempty"`
 	Graphite   graphite.Config `yaml:"graphite,omitempty" json:"graphite,omitempty"`
 
+	// ConfigStrict rejects configuration files with unknown fields.
+	ConfigStrict bool `yaml:"-" json:"-"`
+
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
 
@@ -95,9 +150,74 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return utils.CheckOverflow(c.XXX, "config")
 }
 
+// Logger returns base tagged with component and filtered at the level of
+// component in Log.Components, or else at LogLevel. base must not be filtered,
+// see utils.NewBaseLogger.
+func (c *Config) Logger(base log.Logger, component string) log.Logger {
+	lvl, ok := c.Log.Components[component]
+	if !ok {
+		lvl = c.LogLevel.String()
+	}
+	return utils.LevelLogger(base, lvl, "component", component)
+}
+
+// logComponents are the components whose log level can be set.
+var logComponents = []string{"web", "graphite", "graphite_read", "graphite_write"}
+
+// checkComponentLevels returns an error if components holds an unknown
+// component or an unknown log level.
+func checkComponentLevels(components map[string]string) error {
+	for component, lvl := range components {
+		known := false
+		for _, c := range logComponents {
+			known = known || c == component
+		}
+		if !known {
+			return fmt.Errorf("unknown log component %q, expected one of %s", component, strings.Join(logComponents, ", "))
+		}
+		if _, err := utils.AllowLevel(lvl); err != nil {
+			return fmt.Errorf("invalid log level of component %s: %s", component, err)
+		}
+	}
+	return nil
+}
+
+type logOptions struct {
+	// Components holds the log level of components, e.g. graphite_read, which
+	// log at LogLevel otherwise.
+	Components map[string]string `yaml:"components,omitempty" json:"components,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (opts *logOptions) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain logOptions
+
+	if err := unmarshal((*plain)(opts)); err != nil {
+		return err
+	}
+
+	if err := checkComponentLevels(opts.Components); err != nil {
+		return err
+	}
+
+	return utils.CheckOverflow(opts.XXX, "logOptions")
+}
+
 type webOptions struct {
 	ListenAddress string `yaml:"listen_address,omitempty" json:"listen_address,omitempty"`
 	TelemetryPath string `yaml:"telemetry_path,omitempty" json:"telemetry_path,omitempty"`
+	// URL under which the adapter is reachable, e.g. behind a reverse proxy.
+	// Its path prefixes the web endpoints unless RoutePrefix is set.
+	ExternalURL string `yaml:"external_url,omitempty" json:"external_url,omitempty"`
+	RoutePrefix string `yaml:"route_prefix,omitempty" json:"route_prefix,omitempty"`
+	// If false, error responses only hold the status text, errors are logged.
+	// Unset means true.
+	VerboseErrors *bool `yaml:"verbose_errors,omitempty" json:"verbose_errors,omitempty"`
+	// If set, the entries of the paths cache are served on /debug/paths-cache.
+	EnablePathsCacheDebug bool `yaml:"enable_paths_cache_debug,omitempty" json:"enable_paths_cache_debug,omitempty"`
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
@@ -112,13 +232,45 @@ func (opts *webOptions) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
+	if _, err := url.Parse(opts.ExternalURL); err != nil {
+		return fmt.Errorf("invalid external_url: %s", err)
+	}
+
 	return utils.CheckOverflow(opts.XXX, "webOptions")
 }
 
+// ShowErrors tells whether error messages are sent in responses.
+func (opts webOptions) ShowErrors() bool {
+	return opts.VerboseErrors == nil || *opts.VerboseErrors
+}
+
+// PathPrefix returns the prefix of the web endpoints, RoutePrefix or else the
+// path of ExternalURL, without trailing slash.
+func (opts webOptions) PathPrefix() string {
+	prefix := opts.RoutePrefix
+	if prefix == "" && opts.ExternalURL != "" {
+		if u, err := url.Parse(opts.ExternalURL); err == nil {
+			prefix = u.Path
+		}
+	}
+	prefix = strings.TrimRight(prefix, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	return prefix
+}
+
 type readOptions struct {
 	Timeout     time.Duration `yaml:"timeout,omitempty" json:"timeout,omitempty"`
 	Delay       time.Duration `yaml:"delay,omitempty" json:"delay,omitempty"`
 	IgnoreError bool          `yaml:"ignore_error,omitempty" json:"ignore_error,omitempty"`
+	// If set, SourceLabel is added to each read series with the URL of the graphite-web it comes from.
+	SourceLabel string `yaml:"source_label,omitempty" json:"source_label,omitempty"`
+	// If set, read requests are rejected, e.g. for write-only replicas.
+	Disabled bool `yaml:"disabled,omitempty" json:"disabled,omitempty"`
+	// FederateLookback is how far before Delay /federate looks for the
+	// latest sample of series.
+	FederateLookback time.Duration `yaml:"federate_lookback,omitempty" json:"federate_lookback,omitempty"`
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
@@ -136,8 +288,23 @@ func (opts *readOptions) UnmarshalYAML(unmarshal func(interface{}) error) error
 	return utils.CheckOverflow(opts.XXX, "readOptions")
 }
 
+// Policies for label names repeated in a series of a write request.
+const (
+	DuplicateLabelsLast   = "last"
+	DuplicateLabelsFirst  = "first"
+	DuplicateLabelsReject = "reject"
+)
+
 type writeOptions struct {
 	Timeout time.Duration `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	// If set, write requests are rejected, e.g. for read-only replicas.
+	Disabled bool `yaml:"disabled,omitempty" json:"disabled,omitempty"`
+	// If set, write requests are accepted and discarded when no writer is
+	// configured. Otherwise they fail with 503 Service Unavailable.
+	AllowNoWriters bool `yaml:"allow_no_writers,omitempty" json:"allow_no_writers,omitempty"`
+	// DuplicateLabels tells which value of a label name repeated in a series
+	// is kept, the last or the first one, or whether the request is rejected.
+	DuplicateLabels string `yaml:"duplicate_labels,omitempty" json:"duplicate_labels,omitempty"`
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
@@ -152,5 +319,12 @@ func (opts *writeOptions) UnmarshalYAML(unmarshal func(interface{}) error) error
 		return err
 	}
 
+	switch opts.DuplicateLabels {
+	case "", DuplicateLabelsLast, DuplicateLabelsFirst, DuplicateLabelsReject:
+	default:
+		return fmt.Errorf("unsupported duplicate_labels %q, expected %s, %s or %s",
+			opts.DuplicateLabels, DuplicateLabelsLast, DuplicateLabelsFirst, DuplicateLabelsReject)
+	}
+
 	return utils.CheckOverflow(opts.XXX, "writeOptions")
 }
@@ -14,11 +14,22 @@
 package config
 
 import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	graphite "github.com/criteo/graphite-remote-adapter/client/graphite/config"
+	"github.com/criteo/graphite-remote-adapter/utils"
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	yaml "gopkg.in/yaml.v2"
 )
 
 var expectedConf = &Config{
@@ -27,9 +38,10 @@ var expectedConf = &Config{
 		TelemetryPath: "/coolMetrics",
 	},
 	Read: readOptions{
-		Timeout:     18 * time.Minute,
-		Delay:       42 * time.Minute,
-		IgnoreError: true,
+		Timeout:          18 * time.Minute,
+		Delay:            42 * time.Minute,
+		IgnoreError:      true,
+		FederateLookback: 5 * time.Minute,
 	},
 	Write: writeOptions{
 		Timeout: 18 * time.Minute,
@@ -50,3 +62,175 @@ func TestLoadConfigFile(t *testing.T) {
 			"testdata/conf.good.yml", c.String(), expectedConf.String())
 	}
 }
+
+func TestLoadGzipConfigFile(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/conf.good.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "conf.good.yml.gz")
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := gzip.NewWriter(f)
+	w.Write(content)
+	w.Close()
+	f.Close()
+
+	c, err := LoadFile(log.NewNopLogger(), filename)
+	if err != nil {
+		t.Fatalf("Error parsing %s: %s", filename, err)
+	}
+	c.original = ""
+
+	if c.String() != expectedConf.String() {
+		t.Fatalf("%s: unexpected config result: \n%s\nExpecting:\n%s",
+			filename, c.String(), expectedConf.String())
+	}
+}
+
+func TestLoadNonStrictConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "conf.yml")
+	content := "read:\n  timeout: 18m\n  old_field: true\ngraphite:\n  write:\n    other_field: 1\n"
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadFile(log.NewNopLogger(), filename); err == nil {
+		t.Fatalf("Expected an error loading %s in strict mode", filename)
+	}
+
+	utils.SetStrictConfig(false)
+	defer utils.SetStrictConfig(true)
+	c, err := LoadFile(log.NewNopLogger(), filename)
+	if err != nil {
+		t.Fatalf("Error parsing %s: %s", filename, err)
+	}
+	if c.Read.Timeout != 18*time.Minute {
+		t.Errorf("Expected %s, got %s", 18*time.Minute, c.Read.Timeout)
+	}
+	if v := testutil.ToFloat64(unknownFields); v != 2 {
+		t.Errorf("Expected 2 unknown fields, got %v", v)
+	}
+}
+
+func TestLoadConfigFileWithRulesFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := `
+graphite:
+  write:
+    rules_file: rules.yml
+    rules:
+    - match:
+        owner: team-X
+      template: 'team-x.{{.labels.service}}'
+`
+	rules := `
+- match:
+    owner: team-Y
+  template: 'team-y.{{.labels.service}}'
+- match:
+    owner: team-Z
+  template: 'team-z.{{.labels.service}}'
+  priority: 1
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "conf.yml"), []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "rules.yml"), []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := LoadFile(log.NewNopLogger(), filepath.Join(dir, "conf.yml"))
+	if err != nil {
+		t.Fatalf("Error parsing config: %s", err)
+	}
+	var owners []string
+	for _, rule := range c.Graphite.Write.Rules {
+		owners = append(owners, string(rule.Match["owner"]))
+	}
+	expected := []string{"team-Z", "team-X", "team-Y"}
+	if !reflect.DeepEqual(expected, owners) {
+		t.Errorf("Expected rules of %s, got %s", expected, owners)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "rules.yml"), []byte("- foo: bar\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFile(log.NewNopLogger(), filepath.Join(dir, "conf.yml")); err == nil {
+		t.Errorf("Expected an error for a rules file with unknown fields")
+	}
+}
+
+func TestWebPathPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		opts     webOptions
+		expected string
+	}{
+		{webOptions{}, ""},
+		{webOptions{ExternalURL: "http://proxy.example.com/"}, ""},
+		{webOptions{ExternalURL: "http://proxy.example.com/graphite-adapter/"}, "/graphite-adapter"},
+		{webOptions{ExternalURL: "http://proxy.example.com/graphite-adapter", RoutePrefix: "/"}, ""},
+		{webOptions{RoutePrefix: "graphite-adapter"}, "/graphite-adapter"},
+	} {
+		if actual := tc.opts.PathPrefix(); actual != tc.expected {
+			t.Errorf("Expected %q for %+v, got %q", tc.expected, tc.opts, actual)
+		}
+	}
+}
+
+func TestComponentLogger(t *testing.T) {
+	var buf bytes.Buffer
+	base := log.NewLogfmtLogger(&buf)
+	cfg := &Config{Log: logOptions{Components: map[string]string{"graphite_read": "debug"}}}
+	cfg.LogLevel.Set("warn")
+
+	level.Debug(cfg.Logger(base, "graphite_read")).Log("msg", "read")
+	level.Info(cfg.Logger(base, "graphite_write")).Log("msg", "write")
+	level.Warn(cfg.Logger(base, "web")).Log("msg", "web")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %q", lines)
+	}
+	if !strings.Contains(lines[0], "component=graphite_read") || !strings.Contains(lines[1], "component=web") {
+		t.Errorf("Unexpected lines %q", lines)
+	}
+}
+
+func TestCheckComponentLevels(t *testing.T) {
+	if err := checkComponentLevels(map[string]string{"graphite_read": "debug", "web": "error"}); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	for _, components := range []map[string]string{
+		{"graphite_read": "verbose"},
+		{"graphite_reader": "debug"},
+	} {
+		if err := checkComponentLevels(components); err == nil {
+			t.Errorf("Expected an error for %v", components)
+		}
+	}
+
+	var opts logOptions
+	if err := yaml.Unmarshal([]byte("components:\n  graphite_reader: debug\n"), &opts); err == nil {
+		t.Errorf("Expected an error for an unknown component")
+	}
+}
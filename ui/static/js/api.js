@@ -1,55 +1,85 @@
-const regexpMetric = /([a-zA-Z_:][a-zA-Z0-9_:]*)(?:{(.*)})?\s+((?:\d*\.)?\d+(?:e\d+)?)(?:\s+(\d+))?/;
-const regexpLabels = /([a-zA-Z_][a-zA-Z0-9_]*)\s?=\s?"([^"\\\\]*(?:\\.[^"\\\\]*)*)"/gm;
+let simulationTimer = null;
 
-function parseLabels(metricName, rawLabelsStr) {
-    let labels = {"__name__": metricName};
-    if (rawLabelsStr !== undefined) {
-        while (match = regexpLabels.exec(rawLabelsStr)) {
-            labels[match[1]] = match[2];
+function escapeHtml(str) {
+    return $('<div/>').text(str).html();
+}
+
+function describeSample(sample) {
+    let name = sample.metric["__name__"] || "";
+    let labels = [];
+    $.each(sample.metric, function (labelName, labelValue) {
+        if (labelName !== "__name__") {
+            labels.push(labelName + '="' + labelValue + '"');
         }
-    }
-    return labels;
+    });
+    let labelsStr = labels.length > 0 ? "{" + labels.sort().join(", ") + "}" : "";
+    return name + labelsStr + " " + sample.value[1];
 }
 
-function parseSample(txtLine, defaultTimestampS) {
-    let match = regexpMetric.exec(txtLine);
-    if (match != null) {
-        let labels = parseLabels(match[1], match[2]);
-        let ts = parseInt(match[4]) || defaultTimestampS;
-        return {"metric": labels, "value": [ts, match[3]]};
+function describeRule(datapoint) {
+    if (datapoint.rule < 0) {
+        return '<span class="text-muted">default path</span>';
     }
-    return null;
+    return '#' + datapoint.rule + ' <code>' + escapeHtml(datapoint.template) + '</code>';
 }
 
 function handleSimulationResult(result) {
-    let jsonres = JSON.parse(result);
-
-    let html = "<dl>";
-    $.each(jsonres, function (writerName, writerMsg) {
-        html += '<dt>' + writerName + '</dt>';
-        html += '<dd><pre class="alert alert-light">' + writerMsg + '</pre></dd>';
+    let html = "";
+    $.each(result, function (writerName, simulation) {
+        html += '<h4>' + escapeHtml(writerName) + '</h4>';
+        if (!Array.isArray(simulation)) {
+            html += '<div class="alert alert-danger">' + escapeHtml(simulation.error) + '</div>';
+            return;
+        }
+        html += '<table class="table table-sm">';
+        html += '<thead><tr><th>Sample</th><th>Datapoint</th><th>Rule</th></tr></thead><tbody>';
+        $.each(simulation, function (i, simulated) {
+            let sample = escapeHtml(describeSample(simulated.sample));
+            if (simulated.error !== undefined) {
+                html += '<tr class="table-warning"><td>' + sample + '</td>';
+                html += '<td colspan="2">dropped: ' + escapeHtml(simulated.error) + '</td></tr>';
+                return;
+            }
+            if (simulated.datapoints.length === 0) {
+                html += '<tr class="table-secondary"><td>' + sample + '</td>';
+                html += '<td colspan="2">silenced by a rule</td></tr>';
+                return;
+            }
+            $.each(simulated.datapoints, function (j, datapoint) {
+                html += '<tr>';
+                if (j === 0) {
+                    html += '<td rowspan="' + simulated.datapoints.length + '">' + sample + '</td>';
+                }
+                html += '<td><pre class="mb-0">' + escapeHtml(datapoint.datapoint) + '</pre></td>';
+                html += '<td>' + describeRule(datapoint) + '</td>';
+                html += '</tr>';
+            });
+        });
+        html += '</tbody></table>';
     });
-    html += "</dl>";
     $("#outputs").html(html);
+    $("#error-msg").empty();
 }
 
-function simulWrite() {
-    let txt = $("#input").val();
-    let lines = txt.split(/\n/);
-    let nowS = $.now() / 1000;
+function handleSimulationError(xhr) {
+    $("#error-msg").html('<div class="alert alert-danger">' + escapeHtml(xhr.responseText) + '</div>');
+}
 
-    let samples = [];
-    $.each(lines, function (i, line) {
-        let sample = parseSample($.trim(line), nowS);
-        if (sample != null) {
-            samples.push(sample);
-        }
-    });
+function simulWrite() {
     $.ajax({
-        url: 'write',
+        url: 'simulation',
         type: 'post',
-        data: JSON.stringify(samples),
-        headers: {"Content-Type": 'application/json'},
-        success: handleSimulationResult
+        // The exposition text format expects each line to end with a line feed.
+        data: $("#input").val() + "\n",
+        headers: {"Content-Type": 'text/plain'},
+        dataType: 'json',
+        success: handleSimulationResult,
+        error: handleSimulationError
     });
-}
\ No newline at end of file
+}
+
+// Simulate again once the user stops typing.
+function scheduleSimulWrite() {
+    clearTimeout(simulationTimer);
+    simulationTimer = setTimeout(simulWrite, 500);
+}
@@ -0,0 +1,99 @@
+// Copyright 2017 Thibault Chataigner <thibault.chataigner@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"sync"
+)
+
+const (
+	// Maximum number of responses kept to send conditional requests.
+	responsesCacheSize = 1000
+	// Maximum total size of the bodies of these responses.
+	responsesCacheBytes = 64 << 20
+)
+
+var responsesCache = newResponseCache(responsesCacheSize, responsesCacheBytes)
+
+// cachedResponse is a response body along with its validators.
+type cachedResponse struct {
+	etag         string
+	lastModified string
+	body         []byte
+}
+
+// responseCache is a cache of responses keyed by URL, bounded both by number
+// of responses and by total size of their bodies. When full, the oldest
+// inserted responses are evicted first.
+type responseCache struct {
+	lock      sync.Mutex
+	size      int
+	maxBytes  int
+	bytes     int
+	responses map[string]*cachedResponse
+	keys      []string
+}
+
+func newResponseCache(size int, maxBytes int) *responseCache {
+	return &responseCache{
+		size:      size,
+		maxBytes:  maxBytes,
+		responses: make(map[string]*cachedResponse, size),
+	}
+}
+
+func (c *responseCache) get(key string) (*cachedResponse, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	r, ok := c.responses[key]
+	return r, ok
+}
+
+func (c *responseCache) set(key string, r *cachedResponse) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	old, ok := c.responses[key]
+	// Responses which would fill the cache on their own aren't kept.
+	if len(r.body) > c.maxBytes {
+		c.remove(key)
+		return
+	}
+	if ok {
+		c.bytes -= len(old.body)
+	} else {
+		if len(c.keys) >= c.size {
+			c.remove(c.keys[0])
+		}
+		c.keys = append(c.keys, key)
+	}
+	c.responses[key] = r
+	c.bytes += len(r.body)
+	for c.bytes > c.maxBytes {
+		c.remove(c.keys[0])
+	}
+}
+
+// remove evicts the response cached under key.
+func (c *responseCache) remove(key string) {
+	for i, k := range c.keys {
+		if k == key {
+			c.keys = append(c.keys[:i], c.keys[i+1:]...)
+			break
+		}
+	}
+	if r, ok := c.responses[key]; ok {
+		c.bytes -= len(r.body)
+		delete(c.responses, key)
+	}
+}
@@ -2,9 +2,35 @@ package utils
 
 import (
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
 )
 
+var (
+	configLock          sync.Mutex
+	strictConfig        = true
+	unknownConfigFields []string
+)
+
+// SetStrictConfig sets whether CheckOverflow rejects unknown fields. When not
+// strict, unknown fields are recorded instead, see TakeUnknownConfigFields.
+func SetStrictConfig(strict bool) {
+	configLock.Lock()
+	defer configLock.Unlock()
+	strictConfig = strict
+}
+
+// TakeUnknownConfigFields returns the unknown fields recorded by CheckOverflow
+// since the last call, as "<ctx>.<field>".
+func TakeUnknownConfigFields() []string {
+	configLock.Lock()
+	defer configLock.Unlock()
+	fields := unknownConfigFields
+	unknownConfigFields = nil
+	return fields
+}
+
 // CheckOverflow enforce m to be empty. Usefull to detect unknown fields.
 func CheckOverflow(m map[string]interface{}, ctx string) error {
 	if len(m) > 0 {
@@ -12,6 +38,16 @@ func CheckOverflow(m map[string]interface{}, ctx string) error {
 		for k := range m {
 			keys = append(keys, k)
 		}
+		sort.Strings(keys)
+
+		configLock.Lock()
+		defer configLock.Unlock()
+		if !strictConfig {
+			for _, k := range keys {
+				unknownConfigFields = append(unknownConfigFields, ctx+"."+k)
+			}
+			return nil
+		}
 		return fmt.Errorf("unknown fields in %s: %s", ctx, strings.Join(keys, ", "))
 	}
 	return nil
@@ -14,10 +14,14 @@
 package utils
 
 import (
-	"errors"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -26,12 +30,56 @@ import (
 	"golang.org/x/net/context/ctxhttp"
 )
 
+// readBody reads r, failing if it is larger than max bytes. 0 means unbounded.
+func readBody(r io.Reader, max int64) ([]byte, error) {
+	if max <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	// Read one more byte to tell a body of exactly max bytes from a larger one.
+	body, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > max {
+		return nil, fmt.Errorf("response body larger than %d bytes", max)
+	}
+	return body, nil
+}
+
+// decodeBody returns a reader of the decoded body of resp, which may be
+// compressed with gzip or deflate.
+func decodeBody(resp *http.Response) (io.ReadCloser, error) {
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "gzip":
+		return gzip.NewReader(resp.Body)
+	case "deflate":
+		return zlib.NewReader(resp.Body)
+	}
+	return ioutil.NopCloser(resp.Body), nil
+}
+
+// StatusError is returned by FetchURL for HTTP error responses.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return e.Status
+}
+
 // PrepareURL return an url.URL from it's parameters
 func PrepareURL(schemeHost string, path string, params map[string]string) (*url.URL, error) {
 	values := url.Values{}
 	for k, v := range params {
 		values.Set(k, v)
 	}
+	return PrepareURLValues(schemeHost, path, values)
+}
+
+// PrepareURLValues return an url.URL from it's parameters, which may have
+// several values.
+func PrepareURLValues(schemeHost string, path string, values url.Values) (*url.URL, error) {
 	u, err := url.Parse(schemeHost)
 	if err != nil {
 		return nil, err
@@ -44,25 +92,88 @@ func PrepareURL(schemeHost string, path string, params map[string]string) (*url.
 	return u, nil
 }
 
-// FetchURL return body of a fetched url.URL
-func FetchURL(ctx context.Context, logger log.Logger, u *url.URL) ([]byte, error) {
-	level.Debug(logger).Log("url", u, "context", ctx, "msg", "Fetching URL")
+// FetchURL return body of a fetched url.URL, using client or else
+// http.DefaultClient.
+// With the POST method, the query parameters of u are sent as a form encoded
+// body instead.
+// Compressed responses are accepted and decoded, FetchURL fails when the
+// decoded body is larger than maxBytes, unless maxBytes is 0.
+// Responses to GET requests carrying an ETag or a Last-Modified header are
+// cached so that following fetches of the same url.URL are conditional requests.
+func FetchURL(ctx context.Context, client *http.Client, logger log.Logger, method string, u *url.URL, maxBytes int64) ([]byte, error) {
+	level.Debug(logger).Log("url", u, "method", method, "context", ctx, "msg", "Fetching URL")
+
+	req, err := newRequest(method, u)
+	if err != nil {
+		return nil, err
+	}
+	// Setting Accept-Encoding disables the transparent gzip decoding of the
+	// transport, responses are decoded by decodeBody instead.
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	// Conditional requests only apply to GET requests.
+	var cached *cachedResponse
+	isCached := false
+	if req.Method == http.MethodGet {
+		cached, isCached = responsesCache.get(u.String())
+	}
+	if isCached {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
 
-	hresp, err := ctxhttp.Get(ctx, http.DefaultClient, u.String())
+	hresp, err := ctxhttp.Do(ctx, client, req)
 	if err != nil {
 		return nil, err
 	}
 	defer hresp.Body.Close()
 
-	body, err := ioutil.ReadAll(hresp.Body)
+	if isCached && hresp.StatusCode == http.StatusNotModified {
+		level.Debug(logger).Log("url", u, "msg", "Using cached HTTP response body")
+		return cached.body, nil
+	}
+
+	decoded, err := decodeBody(hresp)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding response body: %s", err)
+	}
+	defer decoded.Close()
+
+	body, err := readBody(decoded, maxBytes)
 	level.Debug(logger).Log("len(body)", len(body), "err", err, "msg", "Reading HTTP response body")
 	if err != nil {
 		return nil, err
 	}
 
 	if hresp.StatusCode >= 400 {
-		return body, errors.New(hresp.Status)
+		return body, &StatusError{StatusCode: hresp.StatusCode, Status: hresp.Status}
+	}
+
+	etag, lastModified := hresp.Header.Get("ETag"), hresp.Header.Get("Last-Modified")
+	if req.Method == http.MethodGet && hresp.StatusCode == http.StatusOK && (etag != "" || lastModified != "") {
+		responsesCache.set(u.String(), &cachedResponse{
+			etag: etag, lastModified: lastModified, body: body})
 	}
 
 	return body, nil
 }
+
+// newRequest returns a POST request of u sending its query parameters as a
+// form encoded body if method is POST, or else a GET request of u.
+func newRequest(method string, u *url.URL) (*http.Request, error) {
+	if method != http.MethodPost {
+		return http.NewRequest(http.MethodGet, u.String(), nil)
+	}
+	postURL := *u
+	postURL.RawQuery = ""
+	postURL.ForceQuery = false
+	req, err := http.NewRequest(http.MethodPost, postURL.String(), strings.NewReader(u.RawQuery))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
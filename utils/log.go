@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+var timestampFormat = log.TimestampFormat(
+	func() time.Time { return time.Now().UTC() },
+	"2006-01-02T15:04:05.000Z07:00",
+)
+
+// NewBaseLogger returns a logfmt logger to stderr like promlog.New, without
+// level filter, for LevelLogger to filter its logs per component.
+func NewBaseLogger() log.Logger {
+	return log.With(log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr)), "ts", timestampFormat)
+}
+
+// LevelLogger returns base with keyvals, dropping logs below lvl, or below
+// info if lvl is unknown. The caller is added on top of the filter for it to
+// be the caller of Log.
+func LevelLogger(base log.Logger, lvl string, keyvals ...interface{}) log.Logger {
+	allow, err := AllowLevel(lvl)
+	if err != nil {
+		allow = level.AllowInfo()
+	}
+	return log.With(level.NewFilter(base, allow), append(keyvals, "caller", log.DefaultCaller)...)
+}
+
+// AllowLevel returns the filter option allowing logs at lvl and above, one of
+// debug, info, warn or error.
+func AllowLevel(lvl string) (level.Option, error) {
+	switch lvl {
+	case "debug":
+		return level.AllowDebug(), nil
+	case "info":
+		return level.AllowInfo(), nil
+	case "warn":
+		return level.AllowWarn(), nil
+	case "error":
+		return level.AllowError(), nil
+	default:
+		return nil, fmt.Errorf("unrecognized log level %q", lvl)
+	}
+}
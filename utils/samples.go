@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"io"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+// ReadSamples parses samples in Prometheus exposition text format.
+// Samples without timestamp are given the current time.
+func ReadSamples(reader io.Reader) ([]*model.Sample, error) {
+	dec := &expfmt.SampleDecoder{
+		Dec: expfmt.NewDecoder(reader, expfmt.FmtText),
+		Opts: &expfmt.DecodeOptions{
+			Timestamp: model.Now(),
+		},
+	}
+
+	var all model.Vector
+	for {
+		var smpls model.Vector
+		err := dec.Decode(&smpls)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, smpls...)
+	}
+
+	return all, nil
+}
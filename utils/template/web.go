@@ -22,13 +22,14 @@ func getTemplate(name string) (string, error) {
 }
 
 // ExecuteTemplate renders template for given name with provided data.
-func ExecuteTemplate(name string, data interface{}) ([]byte, error) {
+// funcs are available to the template along with TmplFuncMap.
+func ExecuteTemplate(name string, data interface{}, funcs template.FuncMap) ([]byte, error) {
 	text, err := getTemplate(name)
 	if err != nil {
 		return nil, err
 	}
 
-	tmpl := template.New(name).Funcs(template.FuncMap(TmplFuncMap))
+	tmpl := template.New(name).Funcs(template.FuncMap(TmplFuncMap)).Funcs(funcs)
 	tmpl, err = tmpl.Parse(text)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,184 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/gogo/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// federate answers with the latest sample of the series matched by the
+// match[] selectors, in the Prometheus exposition format, so that tools
+// speaking federation can consume series through the adapter.
+func (h *Handler) federate(w http.ResponseWriter, r *http.Request) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	level.Debug(h.logger).Log("request", r, "msg", "Handling /federate request")
+	if h.cfg.Read.Disabled {
+		http.Error(w, "remote read is disabled", http.StatusForbidden)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		h.httpError(w, fmt.Sprintf("error parsing form values: %s", err), http.StatusBadRequest)
+		return
+	}
+	selectors := r.Form["match[]"]
+	if len(selectors) == 0 {
+		h.httpError(w, "no match[] parameter provided", http.StatusBadRequest)
+		return
+	}
+
+	// Reads ignore the samples of the last read delay, look for the latest
+	// sample right before.
+	now := time.Now()
+	start := now.Add(-h.cfg.Read.Delay - h.cfg.Read.FederateLookback)
+	req := &prompb.ReadRequest{}
+	for _, selector := range selectors {
+		matchers, err := parseSelector(selector)
+		if err != nil {
+			h.httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Queries = append(req.Queries, &prompb.Query{
+			StartTimestampMs: start.UnixNano() / int64(time.Millisecond),
+			EndTimestampMs:   now.UnixNano() / int64(time.Millisecond),
+			Matchers:         matchers,
+		})
+	}
+
+	if len(h.readers) != 1 {
+		h.httpError(w, fmt.Sprintf("expected exactly one reader, found %d readers", len(h.readers)), http.StatusInternalServerError)
+		return
+	}
+	reader := h.readers[0]
+
+	resp, err := reader.Read(req, r)
+	if err != nil {
+		level.Warn(h.logger).Log(
+			"query", req, "storage", reader.Name(),
+			"err", err, "msg", "Error executing query")
+		h.httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if resp == nil {
+		resp = &prompb.ReadResponse{}
+	}
+
+	format := expfmt.Negotiate(r.Header)
+	w.Header().Set("Content-Type", string(format))
+	encoder := expfmt.NewEncoder(w, format)
+	for _, family := range federatedFamilies(resp) {
+		if err := encoder.Encode(family); err != nil {
+			level.Warn(h.logger).Log("err", err, "msg", "Error encoding /federate response")
+			return
+		}
+	}
+}
+
+// federatedFamilies returns the latest sample of the series of resp, grouped
+// by metric name. Series matched by several selectors are returned once.
+func federatedFamilies(resp *prompb.ReadResponse) []*dto.MetricFamily {
+	byName := make(map[string]*dto.MetricFamily)
+	seen := make(map[string]bool)
+	for _, result := range resp.Results {
+		for _, ts := range result.Timeseries {
+			if len(ts.Samples) == 0 {
+				continue
+			}
+			labels := make([]*dto.LabelPair, 0, len(ts.Labels))
+			name := ""
+			for _, l := range ts.Labels {
+				if l.Name == model.MetricNameLabel {
+					name = l.Value
+					continue
+				}
+				labels = append(labels, &dto.LabelPair{Name: proto.String(l.Name), Value: proto.String(l.Value)})
+			}
+			sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+
+			key := seriesKey(name, labels)
+			if name == "" || seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			family, ok := byName[name]
+			if !ok {
+				family = &dto.MetricFamily{Name: proto.String(name), Type: dto.MetricType_UNTYPED.Enum()}
+				byName[name] = family
+			}
+			latest := ts.Samples[0]
+			for _, s := range ts.Samples[1:] {
+				if s.Timestamp >= latest.Timestamp {
+					latest = s
+				}
+			}
+			family.Metric = append(family.Metric, &dto.Metric{
+				Label:       labels,
+				Untyped:     &dto.Untyped{Value: proto.Float64(latest.Value)},
+				TimestampMs: proto.Int64(latest.Timestamp),
+			})
+		}
+	}
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	families := make([]*dto.MetricFamily, 0, len(names))
+	for _, name := range names {
+		families = append(families, byName[name])
+	}
+	return families
+}
+
+func seriesKey(name string, labels []*dto.LabelPair) string {
+	var key strings.Builder
+	key.WriteString(name)
+	for _, l := range labels {
+		key.WriteByte(0xff)
+		key.WriteString(l.GetName())
+		key.WriteByte(0xff)
+		key.WriteString(l.GetValue())
+	}
+	return key.String()
+}
+
+// parseSelector parses a PromQL series selector, e.g. up{job=~"api|web"},
+// into label matchers.
+func parseSelector(selector string) ([]*prompb.LabelMatcher, error) {
+	parsed, err := promql.ParseMetricSelector(selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector %q: %s", selector, err)
+	}
+	matchers := make([]*prompb.LabelMatcher, 0, len(parsed))
+	for _, m := range parsed {
+		matcher := &prompb.LabelMatcher{Name: m.Name, Value: m.Value}
+		switch m.Type {
+		case labels.MatchEqual:
+			matcher.Type = prompb.LabelMatcher_EQ
+		case labels.MatchNotEqual:
+			matcher.Type = prompb.LabelMatcher_NEQ
+		case labels.MatchRegexp:
+			matcher.Type = prompb.LabelMatcher_RE
+		case labels.MatchNotRegexp:
+			matcher.Type = prompb.LabelMatcher_NRE
+		default:
+			return nil, fmt.Errorf("invalid selector %q: unsupported matcher type %s", selector, m.Type)
+		}
+		matchers = append(matchers, matcher)
+	}
+	return matchers, nil
+}
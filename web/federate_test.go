@@ -0,0 +1,89 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/criteo/graphite-remote-adapter/client"
+	"github.com/criteo/graphite-remote-adapter/config"
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFederate(t *testing.T) {
+	series := &prompb.TimeSeries{
+		Labels: []*prompb.Label{
+			{Name: model.MetricNameLabel, Value: "test"},
+			{Name: "owner", Value: "team-X"},
+		},
+		Samples: []prompb.Sample{{Timestamp: 1000, Value: 1}, {Timestamp: 61000, Value: 2.5}},
+	}
+	reader := &fakeReader{
+		resp: &prompb.ReadResponse{
+			// The series is matched by both selectors.
+			Results: []*prompb.QueryResult{
+				{Timeseries: []*prompb.TimeSeries{series}},
+				{Timeseries: []*prompb.TimeSeries{series}},
+			},
+		},
+	}
+	cfg := config.DefaultConfig
+	h := &Handler{cfg: &cfg, logger: log.NewNopLogger(), readers: []client.Reader{reader}}
+
+	rec := httptest.NewRecorder()
+	h.federate(rec, httptest.NewRequest("GET", `/federate?match[]=test&match[]={__name__="test",owner=~"team-.*"}`, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "# TYPE test untyped\ntest{owner=\"team-X\"} 2.5 61000\n", rec.Body.String())
+
+	require.Len(t, reader.req.Queries, 2)
+	query := reader.req.Queries[1]
+	require.Equal(t, []*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "test"},
+		{Type: prompb.LabelMatcher_RE, Name: "owner", Value: "team-.*"},
+	}, query.Matchers)
+	lookback := int64((cfg.Read.Delay + cfg.Read.FederateLookback) / 1e6)
+	require.Equal(t, lookback, query.EndTimestampMs-query.StartTimestampMs)
+
+	rec = httptest.NewRecorder()
+	h.federate(rec, httptest.NewRequest("GET", "/federate", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestParseSelector(t *testing.T) {
+	for selector, expected := range map[string][]*prompb.LabelMatcher{
+		"up": {{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "up"}},
+		`job:requests:rate5m{ job != "api" , code!~'5..',}`: {
+			{Type: prompb.LabelMatcher_NEQ, Name: "job", Value: "api"},
+			{Type: prompb.LabelMatcher_NRE, Name: "code", Value: "5.."},
+			{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "job:requests:rate5m"},
+		},
+		`{path="a\"b\\c", quote='it\'s "ok"', raw=` + "`\\d+`" + `}`: {
+			{Type: prompb.LabelMatcher_EQ, Name: "path", Value: `a"b\c`},
+			{Type: prompb.LabelMatcher_EQ, Name: "quote", Value: `it's "ok"`},
+			{Type: prompb.LabelMatcher_EQ, Name: "raw", Value: `\d+`},
+		},
+	} {
+		actual, err := parseSelector(selector)
+		require.NoError(t, err, selector)
+		require.Equal(t, expected, actual, selector)
+	}
+
+	for _, selector := range []string{
+		"",
+		"{}",
+		`{job=""}`,
+		`{job=~".*"}`,
+		`up{job}`,
+		`up{job="api"`,
+		`up{job="api}`,
+		`up{job=api}`,
+		`up{job=~"("}`,
+		`up trailing`,
+	} {
+		_, err := parseSelector(selector)
+		require.Error(t, err, selector)
+	}
+}
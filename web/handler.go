@@ -1,15 +1,19 @@
 package web
 
 import (
+	"encoding/json"
 	"fmt"
 	"html"
 	"net/http"
 	"sync"
+	gotemplate "text/template"
 
 	"github.com/criteo/graphite-remote-adapter/client"
 	"github.com/criteo/graphite-remote-adapter/client/graphite"
+	"github.com/criteo/graphite-remote-adapter/client/graphite/paths"
 	"github.com/criteo/graphite-remote-adapter/config"
 	"github.com/criteo/graphite-remote-adapter/ui"
+	"github.com/criteo/graphite-remote-adapter/utils"
 	"github.com/criteo/graphite-remote-adapter/utils/template"
 	"github.com/davecgh/go-spew/spew"
 	assetfs "github.com/elazarl/go-bindata-assetfs"
@@ -25,6 +29,13 @@ import (
 const namespace = "remote_adapter"
 const apiSubsystem = "api"
 
+// SectionRead is the configuration section holding the read and
+// graphite.read options, which can be reloaded alone.
+const SectionRead = "read"
+
+// versionHeader tells which build of the adapter served a response.
+const versionHeader = "X-Graphite-Remote-Adapter-Version"
+
 var (
 	requestCounter = promauto.NewCounterVec(
 		prometheus.CounterOpts{
@@ -57,13 +68,22 @@ var (
 	)
 )
 
+// ReloadRequest asks for the configuration to be reloaded. If Section is set,
+// only this section is applied, see ApplyConfigSection.
+type ReloadRequest struct {
+	Section string
+	Err     chan error
+}
+
 // Handler serves various HTTP endpoints of the remote adapter server
 type Handler struct {
 	logger log.Logger
+	// baseLogger is the unfiltered logger of the components, see config.Logger.
+	baseLogger log.Logger
 
 	cfg      *config.Config
 	router   *mux.Router
-	reloadCh chan chan error
+	reloadCh chan ReloadRequest
 
 	writers []client.Writer
 	readers []client.Reader
@@ -84,20 +104,50 @@ func instrumentHandler(name string, handlerFunc http.HandlerFunc) http.Handler {
 	)
 }
 
-// New initializes a new web Handler.
-func New(logger log.Logger, cfg *config.Config) *Handler {
+// withVersionHeader sets the version header on every response of next.
+func withVersionHeader(next http.Handler) http.Handler {
+	info := version.Info()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(versionHeader, info)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withPathPrefix serves next under prefix, stripping it from request paths.
+// The prefix itself is redirected to prefix + "/", the home page.
+func withPathPrefix(prefix string, next http.Handler) http.Handler {
+	if prefix == "" {
+		return next
+	}
+	stripped := http.StripPrefix(prefix, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == prefix {
+			http.Redirect(w, r, prefix+"/", http.StatusFound)
+			return
+		}
+		stripped.ServeHTTP(w, r)
+	})
+}
+
+// New initializes a new web Handler. baseLogger must not be filtered, the
+// level of each component is set by cfg.
+func New(baseLogger log.Logger, cfg *config.Config) *Handler {
 	router := mux.NewRouter()
 	h := &Handler{
-		cfg:      cfg,
-		logger:   logger,
-		router:   router,
-		reloadCh: make(chan chan error),
+		cfg:        cfg,
+		logger:     cfg.Logger(baseLogger, "web"),
+		baseLogger: baseLogger,
+		router:     router,
+		reloadCh:   make(chan ReloadRequest),
 	}
 	h.buildClients()
 
 	staticFs := http.FileServer(
 		&assetfs.AssetFS{Asset: ui.Asset, AssetDir: ui.AssetDir, AssetInfo: ui.AssetInfo, Prefix: ""})
 
+	// Registered before the pprof handler, which serves the rest of /debug/.
+	router.Methods("GET").Path("/debug/paths-cache").Handler(instrumentHandler("paths-cache", h.pathsCache))
+
 	// Add pprof handler.
 	router.PathPrefix("/debug/").Handler(http.DefaultServeMux)
 
@@ -106,18 +156,22 @@ func New(logger log.Logger, cfg *config.Config) *Handler {
 
 	router.Methods("GET").Path(h.cfg.Web.TelemetryPath).Handler(promhttp.Handler())
 	router.Methods("GET").Path("/-/healthy").Handler(instrumentHandler("healthy", h.healthy))
+	router.Methods("GET").Path("/-/ready").Handler(instrumentHandler("ready", h.ready))
 	router.Methods("POST").Path("/-/reload").Handler(instrumentHandler("reload", h.reload))
 	router.Methods("GET").Path("/").Handler(instrumentHandler("home", h.home))
 	router.Methods("GET").Path("/simulation").Handler(instrumentHandler("home", h.simulation))
+	router.Methods("POST").Path("/simulation").Handler(instrumentHandler("simulate", h.simulate))
 
 	router.Methods("POST").Path("/write").Handler(instrumentHandler("write", h.write))
 	router.Methods("POST").Path("/read").Handler(instrumentHandler("read", h.read))
+	router.Methods("POST").Path("/read-debug").Handler(instrumentHandler("read-debug", h.readDebug))
+	router.Methods("GET").Path("/federate").Handler(instrumentHandler("federate", h.federate))
 
 	return h
 }
 
 // Reload returns the receive-only channel that signals configuration reload requests.
-func (h *Handler) Reload() <-chan chan error {
+func (h *Handler) Reload() <-chan ReloadRequest {
 	return h.reloadCh
 }
 
@@ -134,16 +188,61 @@ func (h *Handler) ApplyConfig(cfg *config.Config) error {
 	}
 
 	h.cfg = cfg
+	h.logger = cfg.Logger(h.baseLogger, "web")
 	h.buildClients()
 
 	return nil
 }
 
+// ApplyConfigSection applies only the given section of cfg, or all of it if
+// section is empty.
+func (h *Handler) ApplyConfigSection(cfg *config.Config, section string) error {
+	switch section {
+	case "":
+		return h.ApplyConfig(cfg)
+	case SectionRead:
+		return h.applyReadConfig(cfg)
+	default:
+		return fmt.Errorf("unknown configuration section %q", section)
+	}
+}
+
+// applyReadConfig applies the read sections of cfg to the readers in place,
+// the writers and their connections are kept as is.
+func (h *Handler) applyReadConfig(cfg *config.Config) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	newCfg := *h.cfg
+	newCfg.Read = cfg.Read
+	newCfg.Graphite.Read = cfg.Graphite.Read
+
+	// Without readers there are no writers either, nothing would be torn down.
+	if len(h.readers) == 0 {
+		h.cfg = &newCfg
+		h.buildClients()
+		return nil
+	}
+
+	for _, r := range h.readers {
+		if _, ok := r.(client.ReadReloader); !ok {
+			return fmt.Errorf("%s can't reload its read configuration alone", r.Name())
+		}
+	}
+	for _, r := range h.readers {
+		r.(client.ReadReloader).ApplyReadConfig(&newCfg)
+	}
+	h.cfg = &newCfg
+	level.Info(h.logger).Log("num_readers", len(h.readers), "msg", "Applied read configuration")
+
+	return nil
+}
+
 func (h *Handler) buildClients() {
 	level.Info(h.logger).Log("cfg", h.cfg, "msg", "Building clients")
 	h.writers = nil
 	h.readers = nil
-	if c := graphite.NewClient(h.cfg, h.logger); c != nil {
+	if c := graphite.NewClient(h.cfg, h.baseLogger); c != nil {
 		h.writers = append(h.writers, c)
 		h.readers = append(h.readers, c)
 	}
@@ -153,8 +252,20 @@ func (h *Handler) buildClients() {
 
 // Run serves the HTTP endpoints.
 func (h *Handler) Run() error {
-	level.Info(h.logger).Log("ListenAddress", h.cfg.Web.ListenAddress, "msg", "Listening")
-	return http.ListenAndServe(h.cfg.Web.ListenAddress, h.router)
+	pathPrefix := h.cfg.Web.PathPrefix()
+	level.Info(h.logger).Log("ListenAddress", h.cfg.Web.ListenAddress, "PathPrefix", pathPrefix, "msg", "Listening")
+	return http.ListenAndServe(h.cfg.Web.ListenAddress, withVersionHeader(withPathPrefix(pathPrefix, h.router)))
+}
+
+// httpError replies with the error message, or only with the status text
+// when web.verbose_errors is disabled, as messages may hold internal addresses.
+// Hidden messages are logged instead.
+func (h *Handler) httpError(w http.ResponseWriter, msg string, code int) {
+	if !h.cfg.Web.ShowErrors() {
+		level.Warn(h.logger).Log("status", code, "err", msg, "msg", "Replying with error")
+		msg = http.StatusText(code)
+	}
+	http.Error(w, msg, code)
 }
 
 func (h *Handler) healthy(w http.ResponseWriter, r *http.Request) {
@@ -165,17 +276,79 @@ func (h *Handler) healthy(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "OK")
 }
 
+// ready reports the adapter as not ready when one of its writers is unhealthy,
+// e.g. when persistently failing to write.
+func (h *Handler) ready(w http.ResponseWriter, r *http.Request) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	for _, writer := range h.writers {
+		checker, ok := writer.(client.HealthChecker)
+		if !ok {
+			continue
+		}
+		if err := checker.Healthy(); err != nil {
+			h.httpError(w, fmt.Sprintf("%s is unhealthy: %s", writer.Name(), err), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "OK")
+}
+
 func (h *Handler) reload(w http.ResponseWriter, r *http.Request) {
+	section := r.URL.Query().Get("section")
+	if section != "" && section != SectionRead {
+		h.httpError(w, fmt.Sprintf("unknown configuration section %q", section), http.StatusBadRequest)
+		return
+	}
+
 	rc := make(chan error)
-	h.reloadCh <- rc
+	h.reloadCh <- ReloadRequest{Section: section, Err: rc}
 	if err := <-rc; err != nil {
-		http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
+		h.httpError(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "Config succesfully reloaded.")
 }
 
+// pathsCache dumps the entries of the Graphite paths cache as JSON, e.g. to
+// check whether stale paths are served after changing rules.
+func (h *Handler) pathsCache(w http.ResponseWriter, r *http.Request) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	if !h.cfg.Web.EnablePathsCacheDebug {
+		h.httpError(w, "paths cache debugging is disabled, see web.enable_paths_cache_debug", http.StatusNotFound)
+		return
+	}
+
+	entries := paths.PathsCacheEntries()
+	if entries == nil {
+		h.httpError(w, "paths cache is disabled", http.StatusNotFound)
+		return
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		h.httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// templateFuncs returns the functions building links in the UI templates.
+func (h *Handler) templateFuncs() gotemplate.FuncMap {
+	pathPrefix := h.cfg.Web.PathPrefix()
+	telemetryPath := h.cfg.Web.TelemetryPath
+	return gotemplate.FuncMap{
+		"pathPrefix":    func() string { return pathPrefix },
+		"telemetryPath": func() string { return telemetryPath },
+	}
+}
+
 func (h *Handler) home(w http.ResponseWriter, r *http.Request) {
 	status := struct {
 		VersionInfo         string
@@ -197,9 +370,9 @@ func (h *Handler) home(w http.ResponseWriter, r *http.Request) {
 		status.Writers[w.Name()] = html.EscapeString(spew.Sdump(w))
 	}
 
-	bytes, err := template.ExecuteTemplate("status.html", status)
+	bytes, err := template.ExecuteTemplate("status.html", status, h.templateFuncs())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		h.httpError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -208,12 +381,47 @@ func (h *Handler) home(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) simulation(w http.ResponseWriter, r *http.Request) {
-	bytes, err := template.ExecuteTemplate("simulation.html", nil)
+	bytes, err := template.ExecuteTemplate("simulation.html", nil, h.templateFuncs())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		h.httpError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 	w.Write(bytes)
 }
+
+// simulate parses samples in Prometheus exposition text format and answers
+// with how each writer would write them.
+func (h *Handler) simulate(w http.ResponseWriter, r *http.Request) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	samples, err := utils.ReadSamples(r.Body)
+	if err != nil {
+		h.httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	simulations := make(map[string]interface{})
+	for _, writer := range h.writers {
+		simulator, ok := writer.(client.Simulator)
+		if !ok {
+			continue
+		}
+		simulation, err := simulator.Simulate(samples, r)
+		if err != nil {
+			simulations[writer.Name()] = map[string]string{"error": err.Error()}
+			continue
+		}
+		simulations[writer.Name()] = simulation
+	}
+
+	data, err := json.Marshal(simulations)
+	if err != nil {
+		h.httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
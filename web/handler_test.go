@@ -0,0 +1,134 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/criteo/graphite-remote-adapter/client/graphite/paths"
+	"github.com/criteo/graphite-remote-adapter/config"
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/common/version"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDisabledEndpoints(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.Write.Disabled = true
+	cfg.Read.Disabled = true
+	h := &Handler{cfg: &cfg, logger: log.NewNopLogger()}
+
+	rec := httptest.NewRecorder()
+	h.write(rec, httptest.NewRequest("POST", "/write", nil))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.read(rec, httptest.NewRequest("POST", "/read", nil))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+}
+
+func TestVersionHeader(t *testing.T) {
+	handler := withVersionHeader(http.NotFoundHandler())
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/unknown", nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	require.Equal(t, version.Info(), rec.Header().Get(versionHeader))
+}
+
+func TestPathPrefix(t *testing.T) {
+	router := http.NewServeMux()
+	router.HandleFunc("/write", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handler := withPathPrefix("/graphite-adapter", router)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/graphite-adapter/write", nil))
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/write", nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/graphite-adapter", nil))
+	require.Equal(t, http.StatusFound, rec.Code)
+	require.Equal(t, "/graphite-adapter/", rec.Header().Get("Location"))
+}
+
+func TestHiddenErrors(t *testing.T) {
+	cfg := config.DefaultConfig
+	verbose := false
+	cfg.Web.VerboseErrors = &verbose
+	h := &Handler{cfg: &cfg, logger: log.NewNopLogger()}
+
+	req := httptest.NewRequest("POST", "/write", strings.NewReader("not json"))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.write(rec, req)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Equal(t, "Bad Request\n", rec.Body.String())
+
+	// Without readers.
+	req = httptest.NewRequest("POST", "/read-debug", strings.NewReader(`{"matchers": [{"name": "__name__", "value": "test"}]}`))
+	rec = httptest.NewRecorder()
+	h.readDebug(rec, req)
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+	require.Equal(t, "Internal Server Error\n", rec.Body.String())
+}
+
+func TestApplyReadConfigSection(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.Graphite.Write.CarbonAddress = "localhost:2003"
+	cfg.Graphite.Read.URL = []string{"http://localhost:8080"}
+	h := &Handler{cfg: &cfg, logger: log.NewNopLogger(), baseLogger: log.NewNopLogger()}
+	h.buildClients()
+	writer := h.writers[0]
+
+	newCfg := cfg
+	newCfg.Graphite.Write.CarbonAddress = "localhost:2004"
+	newCfg.Graphite.Read.URL = []string{"http://localhost:8081"}
+	newCfg.Read.Delay = time.Minute
+	require.NoError(t, h.ApplyConfigSection(&newCfg, SectionRead))
+
+	// Writers are kept and only the read sections are applied.
+	require.True(t, writer == h.writers[0])
+	require.Equal(t, "localhost:2003", h.cfg.Graphite.Write.CarbonAddress)
+	require.Equal(t, []string{"http://localhost:8081"}, []string(h.cfg.Graphite.Read.URL))
+	require.Equal(t, time.Minute, h.cfg.Read.Delay)
+
+	require.Error(t, h.ApplyConfigSection(&newCfg, "write"))
+
+	rec := httptest.NewRecorder()
+	h.reload(rec, httptest.NewRequest("POST", "/-/reload?section=write", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestPathsCacheDebug(t *testing.T) {
+	cfg := config.DefaultConfig
+	h := &Handler{cfg: &cfg, logger: log.NewNopLogger()}
+
+	rec := httptest.NewRecorder()
+	h.pathsCache(rec, httptest.NewRequest("GET", "/debug/paths-cache", nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	cfg.Web.EnablePathsCacheDebug = true
+	paths.InitPathsCache(time.Hour, time.Hour)
+	defer paths.DisablePathsCache()
+	s := &model.Sample{Metric: model.Metric{model.MetricNameLabel: "test"}, Value: 1}
+	_, err := paths.ToDatapoints(s, paths.Format{Type: paths.FormatCarbon}, paths.LiteralPrefix("prefix."), nil, nil)
+	require.NoError(t, err)
+
+	rec = httptest.NewRecorder()
+	h.pathsCache(rec, httptest.NewRequest("GET", "/debug/paths-cache", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var entries []paths.CachedPaths
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &entries))
+	require.Len(t, entries, 1)
+	require.Equal(t, []string{"prefix.test"}, entries[0].Paths)
+}
@@ -2,17 +2,34 @@ package web
 
 import (
 	"fmt"
-	"io/ioutil"
+	"mime"
 	"net/http"
+	"strings"
 
 	"github.com/go-kit/kit/log/level"
 	"github.com/gogo/protobuf/proto"
-	"github.com/golang/snappy"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/prometheus/prompb"
 )
 
+const (
+	remoteReadVersionHeader = "X-Prometheus-Remote-Read-Version"
+	// Only the 0.1.x remote read protocol is supported.
+	supportedRemoteReadVersion = "0.1"
+
+	sampledReadContentType  = "application/x-protobuf"
+	streamedReadContentType = "application/x-streamed-protobuf"
+)
+
+// readResponseType is the encoding used to answer a remote read request.
+type readResponseType int
+
+const (
+	// readResponseSamples is a snappy compressed prompb.ReadResponse.
+	readResponseSamples readResponseType = iota
+)
+
 var (
 	readSamples = promauto.NewCounterVec(
 		prometheus.CounterOpts{
@@ -37,30 +54,49 @@ func (h *Handler) read(w http.ResponseWriter, r *http.Request) {
 	defer h.lock.RUnlock()
 
 	level.Debug(h.logger).Log("request", r, "msg", "Handling /read request")
-	compressed, err := ioutil.ReadAll(r.Body)
+	if h.cfg.Read.Disabled {
+		http.Error(w, "remote read is disabled", http.StatusForbidden)
+		return
+	}
+	if err := checkRemoteReadVersion(r); err != nil {
+		level.Warn(h.logger).Log("err", err, "msg", "Error checking remote read version")
+		h.httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	responseType, err := negotiateReadResponseType(r)
 	if err != nil {
+		level.Warn(h.logger).Log("err", err, "msg", "Error negotiating remote read response")
+		h.httpError(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+
+	buffers := getSnappyBuffers()
+	defer buffers.put()
+
+	if err := buffers.readFrom(r.Body); err != nil {
 		level.Warn(h.logger).Log("err", err, "msg", "Error reading request body")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		h.httpError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	reqBuf, err := snappy.Decode(nil, compressed)
+	reqBuf, err := buffers.decode()
 	if err != nil {
 		level.Warn(h.logger).Log("err", err, "msg", "Error decoding request body")
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		h.httpError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	var req prompb.ReadRequest
 	if err = proto.Unmarshal(reqBuf, &req); err != nil {
 		level.Warn(h.logger).Log("err", err, "msg", "Error unmarshalling protobuf")
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		h.httpError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// TODO: Support reading from more than one reader and merging the results.
+	// The graphite client is the only reader, it merges the series of its
+	// graphite-web backends itself.
 	if len(h.readers) != 1 {
-		http.Error(w, fmt.Sprintf("expected exactly one reader, found %d readers", len(h.readers)), http.StatusInternalServerError)
+		h.httpError(w, fmt.Sprintf("expected exactly one reader, found %d readers", len(h.readers)), http.StatusInternalServerError)
 		return
 	}
 	reader := h.readers[0]
@@ -74,7 +110,7 @@ func (h *Handler) read(w http.ResponseWriter, r *http.Request) {
 			"err", err, "msg", "Error executing query")
 		failedReads.WithLabelValues(prefix, reader.Target()).Inc()
 		if h.cfg.Read.IgnoreError == false {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			h.httpError(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 	}
@@ -89,18 +125,56 @@ func (h *Handler) read(w http.ResponseWriter, r *http.Request) {
 		readSamples.WithLabelValues(prefix, reader.Target()).Add(float64(resp.Size()))
 	}
 
+	switch responseType {
+	case readResponseSamples:
+		h.writeSampledReadResponse(w, resp, buffers)
+	}
+}
+
+func (h *Handler) writeSampledReadResponse(w http.ResponseWriter, resp *prompb.ReadResponse, buffers *snappyBuffers) {
 	data, err := proto.Marshal(resp)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		h.httpError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Type", sampledReadContentType)
 	w.Header().Set("Content-Encoding", "snappy")
 
-	compressed = snappy.Encode(nil, data)
+	compressed := buffers.encode(data)
 	if _, err := w.Write(compressed); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		h.httpError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
+
+// checkRemoteReadVersion rejects remote read protocol versions we can't speak.
+// Clients that do not send a version are assumed to speak 0.1.0.
+func checkRemoteReadVersion(r *http.Request) error {
+	v := r.Header.Get(remoteReadVersionHeader)
+	if v == "" || v == supportedRemoteReadVersion || strings.HasPrefix(v, supportedRemoteReadVersion+".") {
+		return nil
+	}
+	return fmt.Errorf("unsupported remote read version %q, expected %s.x", v, supportedRemoteReadVersion)
+}
+
+// negotiateReadResponseType picks the response encoding from the Accept header.
+// Streamed chunks are not supported yet, clients asking for them fall back to
+// samples as allowed by the remote read protocol.
+func negotiateReadResponseType(r *http.Request) (readResponseType, error) {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return readResponseSamples, nil
+	}
+	for _, t := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(t))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case sampledReadContentType, streamedReadContentType, "application/*", "*/*":
+			return readResponseSamples, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported remote read response type %q, expected %s", accept, sampledReadContentType)
+}
@@ -0,0 +1,169 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// readDebugRequest is the JSON body of /read-debug requests.
+type readDebugRequest struct {
+	Matchers []readDebugMatcher `json:"matchers"`
+	// Start and End are RFC3339 dates, unix timestamps in seconds or
+	// durations relative to now such as "-1h". End defaults to now.
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+type readDebugMatcher struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type readDebugSeries struct {
+	Labels  map[string]string `json:"labels"`
+	Samples []readDebugSample `json:"samples"`
+}
+
+type readDebugSample struct {
+	Timestamp int64 `json:"timestamp"`
+	// Value is a string as JSON can't encode special floats.
+	Value string `json:"value"`
+}
+
+var matcherTypes = map[string]prompb.LabelMatcher_Type{
+	"":   prompb.LabelMatcher_EQ,
+	"=":  prompb.LabelMatcher_EQ,
+	"!=": prompb.LabelMatcher_NEQ,
+	"=~": prompb.LabelMatcher_RE,
+	"!~": prompb.LabelMatcher_NRE,
+}
+
+// readDebug runs a read request described in JSON and answers with the
+// resulting series in JSON, to debug reads without building protobufs.
+func (h *Handler) readDebug(w http.ResponseWriter, r *http.Request) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	level.Debug(h.logger).Log("request", r, "msg", "Handling /read-debug request")
+	if h.cfg.Read.Disabled {
+		http.Error(w, "remote read is disabled", http.StatusForbidden)
+		return
+	}
+
+	var debugReq readDebugRequest
+	if err := json.NewDecoder(r.Body).Decode(&debugReq); err != nil {
+		h.httpError(w, fmt.Sprintf("invalid request body: %s", err), http.StatusBadRequest)
+		return
+	}
+	query, err := debugReq.toQuery(time.Now())
+	if err != nil {
+		h.httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(h.readers) != 1 {
+		h.httpError(w, fmt.Sprintf("expected exactly one reader, found %d readers", len(h.readers)), http.StatusInternalServerError)
+		return
+	}
+	reader := h.readers[0]
+
+	resp, err := reader.Read(&prompb.ReadRequest{Queries: []*prompb.Query{query}}, r)
+	if err != nil {
+		level.Warn(h.logger).Log(
+			"query", query, "storage", reader.Name(),
+			"err", err, "msg", "Error executing query")
+		h.httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	series := []readDebugSeries{}
+	if resp != nil {
+		for _, result := range resp.Results {
+			for _, ts := range result.Timeseries {
+				series = append(series, newReadDebugSeries(ts))
+			}
+		}
+	}
+
+	data, err := json.Marshal(series)
+	if err != nil {
+		h.httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (req *readDebugRequest) toQuery(now time.Time) (*prompb.Query, error) {
+	if len(req.Matchers) == 0 {
+		return nil, fmt.Errorf("no matchers provided")
+	}
+	start, err := parseReadDebugTime(req.Start, now)
+	if err != nil {
+		return nil, fmt.Errorf("invalid start: %s", err)
+	}
+	end, err := parseReadDebugTime(req.End, now)
+	if err != nil {
+		return nil, fmt.Errorf("invalid end: %s", err)
+	}
+	if end.Before(start) {
+		return nil, fmt.Errorf("end %s is before start %s", end, start)
+	}
+
+	query := &prompb.Query{
+		StartTimestampMs: start.UnixNano() / int64(time.Millisecond),
+		EndTimestampMs:   end.UnixNano() / int64(time.Millisecond),
+	}
+	for _, m := range req.Matchers {
+		matcherType, ok := matcherTypes[m.Type]
+		if !ok {
+			return nil, fmt.Errorf("unsupported matcher type %q", m.Type)
+		}
+		query.Matchers = append(query.Matchers, &prompb.LabelMatcher{Type: matcherType, Name: m.Name, Value: m.Value})
+	}
+	return query, nil
+}
+
+// parseReadDebugTime parses a RFC3339 date, a unix timestamp in seconds or a
+// duration relative to now. An empty string means now.
+func parseReadDebugTime(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "now" {
+		return now, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if sec, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Unix(0, int64(sec*float64(time.Second))), nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(d), nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q as a date, a timestamp or a duration", s)
+}
+
+func newReadDebugSeries(ts *prompb.TimeSeries) readDebugSeries {
+	series := readDebugSeries{
+		Labels:  make(map[string]string, len(ts.Labels)),
+		Samples: make([]readDebugSample, 0, len(ts.Samples)),
+	}
+	for _, l := range ts.Labels {
+		series.Labels[l.Name] = l.Value
+	}
+	for _, s := range ts.Samples {
+		series.Samples = append(series.Samples, readDebugSample{
+			Timestamp: s.Timestamp,
+			Value:     strconv.FormatFloat(s.Value, 'f', -1, 64),
+		})
+	}
+	return series
+}
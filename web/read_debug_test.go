@@ -0,0 +1,87 @@
+package web
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/criteo/graphite-remote-adapter/client"
+	"github.com/criteo/graphite-remote-adapter/config"
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeReader struct {
+	req  *prompb.ReadRequest
+	resp *prompb.ReadResponse
+}
+
+func (r *fakeReader) Read(req *prompb.ReadRequest, _ *http.Request) (*prompb.ReadResponse, error) {
+	r.req = req
+	return r.resp, nil
+}
+func (r *fakeReader) Name() string   { return "fake" }
+func (r *fakeReader) Target() string { return "fake" }
+func (r *fakeReader) String() string { return "fake" }
+func (r *fakeReader) Shutdown()      {}
+
+func TestReadDebug(t *testing.T) {
+	reader := &fakeReader{
+		resp: &prompb.ReadResponse{
+			Results: []*prompb.QueryResult{{
+				Timeseries: []*prompb.TimeSeries{{
+					Labels:  []*prompb.Label{{Name: model.MetricNameLabel, Value: "test"}},
+					Samples: []prompb.Sample{{Timestamp: 1000, Value: 1.5}, {Timestamp: 2000, Value: math.NaN()}},
+				}},
+			}},
+		},
+	}
+	cfg := config.DefaultConfig
+	h := &Handler{cfg: &cfg, logger: log.NewNopLogger(), readers: []client.Reader{reader}}
+
+	body := `{"matchers": [{"name": "__name__", "value": "test"}, {"name": "owner", "type": "=~", "value": "team-.*"}],
+		"start": "1970-01-01T00:00:01Z", "end": "2"}`
+	rec := httptest.NewRecorder()
+	h.readDebug(rec, httptest.NewRequest("POST", "/read-debug", strings.NewReader(body)))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t,
+		`[{"labels": {"__name__": "test"}, "samples": [{"timestamp": 1000, "value": "1.5"}, {"timestamp": 2000, "value": "NaN"}]}]`,
+		rec.Body.String())
+
+	expected := &prompb.Query{
+		StartTimestampMs: 1000,
+		EndTimestampMs:   2000,
+		Matchers: []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "test"},
+			{Type: prompb.LabelMatcher_RE, Name: "owner", Value: "team-.*"},
+		},
+	}
+	require.Equal(t, []*prompb.Query{expected}, reader.req.Queries)
+
+	rec = httptest.NewRecorder()
+	h.readDebug(rec, httptest.NewRequest("POST", "/read-debug", strings.NewReader(`{"matchers": []}`)))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestParseReadDebugTime(t *testing.T) {
+	now := time.Unix(3600, 0)
+	for s, expected := range map[string]time.Time{
+		"":                     now,
+		"now":                  now,
+		"-30m":                 time.Unix(1800, 0),
+		"60":                   time.Unix(60, 0),
+		"1970-01-01T00:02:00Z": time.Unix(120, 0),
+	} {
+		actual, err := parseReadDebugTime(s, now)
+		require.NoError(t, err)
+		require.True(t, expected.Equal(actual), "%q: expected %s, got %s", s, expected, actual)
+	}
+
+	_, err := parseReadDebugTime("yesterday", now)
+	require.Error(t, err)
+}
@@ -0,0 +1,65 @@
+package web
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+// Buffers larger than this aren't pooled, so that an exceptionally large
+// request doesn't keep memory around.
+const maxPooledBufferSize = 16 << 20
+
+// snappyBuffers holds the buffers used to (de)compress remote read and write
+// bodies. Prometheus uses the snappy block format, which unlike the framing
+// format read by snappy.NewReader can't be decoded as a stream. Buffers are
+// reused across requests instead, to avoid allocating them for every batch.
+type snappyBuffers struct {
+	compressed bytes.Buffer
+	decoded    []byte
+	encoded    []byte
+}
+
+var snappyBuffersPool = sync.Pool{
+	New: func() interface{} { return &snappyBuffers{} },
+}
+
+func getSnappyBuffers() *snappyBuffers {
+	return snappyBuffersPool.Get().(*snappyBuffers)
+}
+
+// put returns the buffers to the pool, slices returned by decode and encode
+// must not be used afterwards.
+func (b *snappyBuffers) put() {
+	if b.compressed.Cap() > maxPooledBufferSize ||
+		cap(b.decoded) > maxPooledBufferSize ||
+		cap(b.encoded) > maxPooledBufferSize {
+		return
+	}
+	b.compressed.Reset()
+	snappyBuffersPool.Put(b)
+}
+
+// readFrom reads a compressed body from r.
+func (b *snappyBuffers) readFrom(r io.Reader) error {
+	_, err := b.compressed.ReadFrom(r)
+	return err
+}
+
+// decode decompresses the body read by readFrom.
+func (b *snappyBuffers) decode() ([]byte, error) {
+	decoded, err := snappy.Decode(b.decoded[:cap(b.decoded)], b.compressed.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	b.decoded = decoded
+	return decoded, nil
+}
+
+// encode compresses data.
+func (b *snappyBuffers) encode(data []byte) []byte {
+	b.encoded = snappy.Encode(b.encoded[:cap(b.encoded)], data)
+	return b.encoded
+}
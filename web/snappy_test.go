@@ -0,0 +1,33 @@
+package web
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnappyBuffers(t *testing.T) {
+	data := bytes.Repeat([]byte("prometheus-prefix.test.owner.team-X "), 1000)
+
+	buffers := &snappyBuffers{}
+	for i := 0; i < 2; i++ {
+		// Buffers are reused from one body to the next.
+		buffers.compressed.Reset()
+		require.NoError(t, buffers.readFrom(bytes.NewReader(snappy.Encode(nil, data))))
+		decoded, err := buffers.decode()
+		require.NoError(t, err)
+		require.Equal(t, data, decoded)
+
+		encoded := buffers.encode(decoded)
+		decoded, err = snappy.Decode(nil, encoded)
+		require.NoError(t, err)
+		require.Equal(t, data, decoded)
+	}
+
+	buffers.compressed.Reset()
+	require.NoError(t, buffers.readFrom(bytes.NewReader(data)))
+	_, err := buffers.decode()
+	require.Error(t, err)
+}
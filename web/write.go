@@ -2,15 +2,15 @@ package web
 
 import (
 	"encoding/json"
-	"io/ioutil"
+	"fmt"
 	"net/http"
 	"sync"
 	"time"
 
 	"github.com/criteo/graphite-remote-adapter/client"
+	"github.com/criteo/graphite-remote-adapter/config"
 	"github.com/go-kit/kit/log/level"
 	"github.com/gogo/protobuf/proto"
-	"github.com/golang/snappy"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/common/model"
@@ -42,6 +42,21 @@ var (
 		},
 		[]string{"prefix", "remote"},
 	)
+	discardedSamples = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "discarded_samples_total",
+			Help:      "Total number of received samples discarded because no writer is configured.",
+		},
+		[]string{"prefix"},
+	)
+	duplicateLabelSeries = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "duplicate_label_series_total",
+			Help:      "Total number of received series with a label name repeated.",
+		},
+	)
 	sentBatchDuration = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: namespace,
@@ -57,6 +72,10 @@ func (h *Handler) write(w http.ResponseWriter, r *http.Request) {
 	h.lock.RLock()
 	defer h.lock.RUnlock()
 	level.Debug(h.logger).Log("request", r, "msg", "Handling /write request")
+	if h.cfg.Write.Disabled {
+		http.Error(w, "remote write is disabled", http.StatusForbidden)
+		return
+	}
 
 	// As default we expected snappy encoded protobuf.
 	// But for simulation prupose we also accept json.
@@ -74,7 +93,7 @@ func (h *Handler) write(w http.ResponseWriter, r *http.Request) {
 		samples, err = h.parseWriteRequest(w, r)
 	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		h.httpError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -82,21 +101,40 @@ func (h *Handler) write(w http.ResponseWriter, r *http.Request) {
 
 	receivedSamples.WithLabelValues(prefix).Add(float64(len(samples)))
 
+	if len(h.writers) == 0 {
+		discardedSamples.WithLabelValues(prefix).Add(float64(len(samples)))
+		if !h.cfg.Write.AllowNoWriters {
+			level.Warn(h.logger).Log("num_samples", len(samples), "msg", "Discarding samples, no writer is configured")
+			http.Error(w, "no writer is configured", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
 	// Execute write on each writer clients.
 	var wg sync.WaitGroup
+	// Writers run concurrently, writeResponse is guarded by responseLock.
+	var responseLock sync.Mutex
 	writeResponse := make(map[string]string)
 	for _, writer := range h.writers {
 		wg.Add(1)
 		go func(client client.Writer) {
+			defer wg.Done()
+			var msg string
 			msgBytes, err := h.instrumentedWriteSamples(client, samples, r, dryRun)
 			if err != nil {
 				failedSamples.WithLabelValues(prefix, client.Target()).Add(float64(len(samples)))
-				writeResponse[client.Name()] = err.Error()
+				msg = err.Error()
+				if !h.cfg.Web.ShowErrors() {
+					// The error is logged by instrumentedWriteSamples.
+					msg = "write failed"
+				}
 			} else {
 				sentSamples.WithLabelValues(prefix, client.Target()).Add(float64(len(samples)))
-				writeResponse[client.Name()] = string(msgBytes)
+				msg = string(msgBytes)
 			}
-			wg.Done()
+			responseLock.Lock()
+			writeResponse[client.Name()] = msg
+			responseLock.Unlock()
 		}(writer)
 	}
 	wg.Wait()
@@ -104,7 +142,7 @@ func (h *Handler) write(w http.ResponseWriter, r *http.Request) {
 	// Write response body.
 	data, err := json.Marshal(writeResponse)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		h.httpError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	w.Write(data)
@@ -121,13 +159,15 @@ func (h *Handler) parseFakeWriteRequest(w http.ResponseWriter, r *http.Request)
 }
 
 func (h *Handler) parseWriteRequest(w http.ResponseWriter, r *http.Request) (model.Samples, error) {
-	compressed, err := ioutil.ReadAll(r.Body)
-	if err != nil {
+	buffers := getSnappyBuffers()
+	defer buffers.put()
+
+	if err := buffers.readFrom(r.Body); err != nil {
 		level.Warn(h.logger).Log("err", err, "msg", "Error reading request body")
 		return nil, err
 	}
 
-	reqBuf, err := snappy.Decode(nil, compressed)
+	reqBuf, err := buffers.decode()
 	if err != nil {
 		level.Warn(h.logger).Log("err", err, "msg", "Error decoding request body")
 		return nil, err
@@ -139,22 +179,62 @@ func (h *Handler) parseWriteRequest(w http.ResponseWriter, r *http.Request) (mod
 		return nil, err
 	}
 
-	var samples model.Samples
+	samples, duplicates, err := samplesFromWriteRequest(&req, h.cfg.Write.DuplicateLabels)
+	if duplicates > 0 {
+		duplicateLabelSeries.Add(float64(duplicates))
+		level.Warn(h.logger).Log(
+			"series", duplicates, "policy", h.cfg.Write.DuplicateLabels,
+			"msg", "Received series with a label name repeated")
+	}
+	return samples, err
+}
+
+// samplesFromWriteRequest converts a WriteRequest into model.Samples.
+// Most series only carry a single sample, so all samples are allocated at
+// once and series without samples don't get a metric allocated.
+// Of a label name repeated in a series, the last value is kept unless
+// duplicateLabels asks for the first one or to reject the request. The
+// number of series with a label name repeated is returned too.
+func samplesFromWriteRequest(req *prompb.WriteRequest, duplicateLabels string) (model.Samples, int, error) {
+	numSamples := 0
+	for _, ts := range req.Timeseries {
+		numSamples += len(ts.Samples)
+	}
+
+	samples := make(model.Samples, 0, numSamples)
+	backing := make([]model.Sample, numSamples)
+	duplicates := 0
 	for _, ts := range req.Timeseries {
+		if len(ts.Samples) == 0 {
+			continue
+		}
+
 		metric := make(model.Metric, len(ts.Labels))
 		for _, l := range ts.Labels {
 			metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
 		}
+		if len(metric) < len(ts.Labels) {
+			duplicates++
+			switch duplicateLabels {
+			case config.DuplicateLabelsReject:
+				return nil, duplicates, fmt.Errorf("label name repeated in series %s", metric)
+			case config.DuplicateLabelsFirst:
+				// Labels are set again from the last one to keep the first value.
+				for i := len(ts.Labels) - 1; i >= 0; i-- {
+					metric[model.LabelName(ts.Labels[i].Name)] = model.LabelValue(ts.Labels[i].Value)
+				}
+			}
+		}
 
 		for _, s := range ts.Samples {
-			samples = append(samples, &model.Sample{
-				Metric:    metric,
-				Value:     model.SampleValue(s.Value),
-				Timestamp: model.Time(s.Timestamp),
-			})
+			sample := &backing[len(samples)]
+			sample.Metric = metric
+			sample.Value = model.SampleValue(s.Value)
+			sample.Timestamp = model.Time(s.Timestamp)
+			samples = append(samples, sample)
 		}
 	}
-	return samples, nil
+	return samples, duplicates, nil
 }
 
 func (h *Handler) instrumentedWriteSamples(
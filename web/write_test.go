@@ -0,0 +1,171 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/criteo/graphite-remote-adapter/config"
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSamplesFromWriteRequest(t *testing.T) {
+	req := &prompb.WriteRequest{
+		Timeseries: []*prompb.TimeSeries{
+			{
+				Labels: []*prompb.Label{
+					{Name: model.MetricNameLabel, Value: "test"},
+					{Name: "owner", Value: "team-X"},
+				},
+				Samples: []prompb.Sample{
+					{Value: 18, Timestamp: 0},
+					{Value: 42, Timestamp: 300000},
+				},
+			},
+			{
+				Labels: []*prompb.Label{
+					{Name: model.MetricNameLabel, Value: "empty"},
+				},
+			},
+			{
+				Labels: []*prompb.Label{
+					{Name: model.MetricNameLabel, Value: "test"},
+					{Name: "owner", Value: "team-Y"},
+				},
+				Samples: []prompb.Sample{
+					{Value: 1, Timestamp: 0},
+				},
+			},
+		},
+	}
+
+	metricX := model.Metric{model.MetricNameLabel: "test", "owner": "team-X"}
+	metricY := model.Metric{model.MetricNameLabel: "test", "owner": "team-Y"}
+	expected := model.Samples{
+		{Metric: metricX, Value: 18, Timestamp: 0},
+		{Metric: metricX, Value: 42, Timestamp: 300000},
+		{Metric: metricY, Value: 1, Timestamp: 0},
+	}
+	samples, duplicates, err := samplesFromWriteRequest(req, "")
+	require.NoError(t, err)
+	require.Equal(t, 0, duplicates)
+	require.Equal(t, expected, samples)
+}
+
+func TestSamplesFromWriteRequestDuplicateLabels(t *testing.T) {
+	req := &prompb.WriteRequest{
+		Timeseries: []*prompb.TimeSeries{
+			{
+				Labels: []*prompb.Label{
+					{Name: model.MetricNameLabel, Value: "test"},
+					{Name: "owner", Value: "team-X"},
+					{Name: "owner", Value: "team-Y"},
+					{Name: "owner", Value: "team-Z"},
+				},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: 0}},
+			},
+		},
+	}
+
+	for _, policy := range []string{"", config.DuplicateLabelsLast} {
+		samples, duplicates, err := samplesFromWriteRequest(req, policy)
+		require.NoError(t, err)
+		require.Equal(t, 1, duplicates)
+		require.Equal(t, model.LabelValue("team-Z"), samples[0].Metric["owner"])
+	}
+
+	samples, duplicates, err := samplesFromWriteRequest(req, config.DuplicateLabelsFirst)
+	require.NoError(t, err)
+	require.Equal(t, 1, duplicates)
+	require.Equal(t, model.Metric{model.MetricNameLabel: "test", "owner": "team-X"}, samples[0].Metric)
+
+	_, _, err = samplesFromWriteRequest(req, config.DuplicateLabelsReject)
+	require.Error(t, err)
+}
+
+func BenchmarkSamplesFromWriteRequest(b *testing.B) {
+	req := &prompb.WriteRequest{}
+	for i := 0; i < 1000; i++ {
+		req.Timeseries = append(req.Timeseries, &prompb.TimeSeries{
+			Labels: []*prompb.Label{
+				{Name: model.MetricNameLabel, Value: "http_requests_total"},
+				{Name: "code", Value: "200"},
+				{Name: "instance", Value: fmt.Sprintf("host-%d:9100", i)},
+				{Name: "job", Value: "node"},
+				{Name: "method", Value: "post"},
+			},
+			Samples: []prompb.Sample{
+				{Value: float64(i), Timestamp: 1528819131000},
+			},
+		})
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		samplesFromWriteRequest(req, "")
+	}
+}
+
+type fakeWriter struct {
+	name string
+}
+
+func (w *fakeWriter) Write(samples model.Samples, _ *http.Request, _ bool) ([]byte, error) {
+	return []byte(fmt.Sprintf("wrote %d samples", len(samples))), nil
+}
+func (w *fakeWriter) Name() string   { return w.name }
+func (w *fakeWriter) Target() string { return w.name }
+func (w *fakeWriter) String() string { return w.name }
+func (w *fakeWriter) Shutdown()      {}
+
+func TestWriteWithoutWriters(t *testing.T) {
+	cfg := config.DefaultConfig
+	h := &Handler{cfg: &cfg, logger: log.NewNopLogger()}
+	newRequest := func() *http.Request {
+		body := `[{"metric": {"__name__": "test"}, "value": [0, "1"]}]`
+		req := httptest.NewRequest("POST", "/write", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		return req
+	}
+
+	rec := httptest.NewRecorder()
+	h.write(rec, newRequest())
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	cfg.Write.AllowNoWriters = true
+	rec = httptest.NewRecorder()
+	h.write(rec, newRequest())
+	require.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	cfg := config.DefaultConfig
+	h := &Handler{cfg: &cfg, logger: log.NewNopLogger()}
+	for i := 0; i < 4; i++ {
+		h.writers = append(h.writers, &fakeWriter{name: fmt.Sprintf("writer-%d", i)})
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := `[{"metric": {"__name__": "test"}, "value": [0, "1"]}]`
+			req := httptest.NewRequest("POST", "/write", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			h.write(rec, req)
+			if !strings.Contains(rec.Body.String(), `"writer-3":"wrote 1 samples"`) {
+				t.Errorf("Unexpected response %d: %s", rec.Code, rec.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+}